@@ -2,13 +2,21 @@ package cmd
 
 import (
 	"context"
+	_ "expvar" // register the metrics handler
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/aojea/kubernetes-network-driver/pkg/dra"
+	"github.com/aojea/kubernetes-network-driver/pkg/hostdevice"
 	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -20,31 +28,170 @@ const (
 	driverName = "networking.k8s.io"
 )
 
+// The content types of the requests to the API server.
+const (
+	contentTypeProtobuf = "protobuf"
+	contentTypeJSON     = "json"
+)
+
+// tempNamePrefixRegex matches the prefix of the temporary names, the prefix and
+// the interface index must fit in the 15 characters of the interface names.
+var tempNamePrefixRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,5}$`)
+
+// nriPluginIndexRegex matches the NRI plugin index, the runtime requires two
+// digits.
+var nriPluginIndexRegex = regexp.MustCompile(`^[0-9]{2}$`)
+
 var (
-	hostnameOverride string
-	kubeconfig       string
+	hostnameOverride  string
+	kubeconfig        string
+	moveRetryAttempts int
+	moveRetryDelay    time.Duration
+	maxParallelMoves  int
+	gceNetworks       string
+	bindAddress       string
+	allowUnsafeIfaces bool
+	allowEnslaved     bool
+	publishOnlyUp     bool
+	configFile        string
+	publishInterval   time.Duration
+	settleDelay       time.Duration
+	expectedDevices   int
+	gracePeriod       time.Duration
+	publishStats      bool
+	maxAllocated      int
+	sriovPartitions   bool
+	sriovKeepVFs      bool
+	nriPluginIndex    string
+	pluginsDir        string
+	disableNRI        bool
+	gatewayIface      string
+	tempNamePrefix    string
+	poolName          string
+	apiContentType    string
+	hostTargetNs      string
+	postUpExecNs      string
+	reservedIfaces    string
+	interfaceFilter   string
+	rdmaMode          string
 )
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
+	flag.StringVar(&apiContentType, "api-content-type", contentTypeProtobuf, "Content type of the requests to the API server, protobuf or json. Use json if the API server fails to serialize the resource API in protobuf.")
 	flag.StringVar(&hostnameOverride, "hostname-override", "", "If non-empty, will be used as the name of the Node that kube-network-policies is running on. If unset, the node name is assumed to be the same as the node's hostname.")
 
+	flag.IntVar(&moveRetryAttempts, "move-retry-attempts", 3, "Number of attempts to move a device into the Pod network namespace when it fails with a transient error.")
+	flag.DurationVar(&moveRetryDelay, "move-retry-delay", 100*time.Millisecond, "Initial delay between attempts to move a device, it is doubled on each attempt.")
+	flag.IntVar(&maxParallelMoves, "max-parallel-moves", 1, "Maximum number of devices of a Pod moved into its network namespace at the same time, it reduces the Pod start latency of the claims with many devices. If 1, the devices are moved one by one.")
+	flag.StringVar(&gceNetworks, "gce-networks", "", "Comma separated list of GCE networks, by name or as projects/<project>/networks/<name>, whose interfaces are published. If empty, interfaces on all networks are published.")
+	flag.StringVar(&gatewayIface, "gateway-interface", "", "Interface of the node uplink, it is never published. If empty, the interface of the first default route is used, that may not be the uplink on multi-homed nodes.")
+	flag.BoolVar(&allowUnsafeIfaces, "allow-unsafe-interfaces", false, "If true, the interfaces used by the node, with a default route or with the node addresses, are published. Allocating them to a Pod breaks the node connectivity.")
+	flag.BoolVar(&allowEnslaved, "allow-enslaved-interfaces", false, "If true, the interfaces enslaved to a bond, bridge or team are published. Allocating them to a Pod removes them from their master.")
+	flag.BoolVar(&publishOnlyUp, "publish-only-up", false, "If true, only the interfaces whose operational state is up are published, the interfaces without link or administratively down are published once they come up. If false, all the interfaces are published and their state is published in the state attribute.")
+	flag.StringVar(&reservedIfaces, "reserved-interfaces", "", "Comma separated list of interfaces reserved for the node, they are never published nor allocated. The interfaces in the Node annotation networking.k8s.io/reserved-interfaces are also reserved, the annotation is read periodically.")
+	flag.IntVar(&maxAllocated, "max-allocated-devices", 0, "Maximum number of devices that can be allocated to Pods on the node at the same time, the claims exceeding the limit fail to be prepared. If 0, there is no limit.")
+	flag.BoolVar(&sriovKeepVFs, "sriov-keep-vfs", false, "If true, the virtual functions created for the SR-IOV partitions are kept once none of them is in use, so they are reused without creating them again. If false, they are removed when the last claim using them is released.")
+	flag.BoolVar(&sriovPartitions, "sriov-partitions", false, "If true, the SR-IOV physical functions publish a device for each virtual function that is not created, named <pf>-vf<index>. The virtual functions are created when one of them is allocated.")
+	flag.StringVar(&nriPluginIndex, "nri-plugin-index", "00", "Two digit index of the NRI plugin, the runtime invokes the NRI plugins in ascending index order. The plugins that need the network devices attached to the Pod must have a higher index.")
+	flag.StringVar(&pluginsDir, "kubelet-plugins-dir", "/var/lib/kubelet/plugins", "Directory of the kubelet plugins, the registration socket is created in the plugins_registry directory next to it. Change it if the kubelet root directory is not /var/lib/kubelet.")
+	flag.BoolVar(&disableNRI, "disable-nri", false, "If true, the NRI plugin is not registered, for runtimes without NRI support. The devices are attached when the claim is prepared to the network namespace set in the netns config, the Pod network namespace is not known without NRI, so the claims without it fail.")
+	flag.StringVar(&hostTargetNs, "host-target-namespaces", "", "Comma separated list of namespaces whose claims can configure the devices on the host with the target host config, instead of moving them to the Pod. The configuration affects the host, so only trusted namespaces must be allowed. If empty, the target host is not allowed.")
+	flag.StringVar(&postUpExecNs, "post-up-exec-namespaces", "", "Comma separated list of namespaces whose claims can execute a command inside the Pod network namespace with the postUpExec config. The commands run as root, so only trusted namespaces must be allowed. If empty, postUpExec is not allowed.")
+	flag.StringVar(&poolName, "pool-name", "", "Name of the pool of the devices, per example to segment the devices by rack or network zone. It must be unique for each node. If empty, the name of the node is used.")
+	flag.StringVar(&tempNamePrefix, "temp-name-prefix", hostdevice.DefaultTempNamePrefix, "Prefix of the temporary names of the devices while they are moved, up to 5 characters. It must not be used by other plugins that move devices. The devices with a temporary name are renamed on startup to their original name.")
+	flag.StringVar(&configFile, "config", "", "Path to the YAML config file with the default settings, the flags set on the command line take precedence.")
+	flag.DurationVar(&publishInterval, "publish-interval", 1*time.Minute, "Interval to publish the resources if there are no interface changes.")
+	flag.DurationVar(&settleDelay, "publish-settle-delay", 0, "Delay of the first publication of the resources, so the interfaces attached while the node boots are published at once. If expected-devices is set, it is the maximum time to wait for the devices.")
+	flag.IntVar(&expectedDevices, "expected-devices", 0, "Number of devices to discover before the first publication of the resources. If 0, the resources are published without waiting.")
+	flag.DurationVar(&gracePeriod, "shutdown-grace-period", 30*time.Second, "Maximum time to wait on SIGTERM or SIGINT for the device operations in progress to complete before exiting. It should be lower than the terminationGracePeriodSeconds of the Pod.")
+	flag.BoolVar(&publishStats, "publish-stats", false, "If true, the interfaces rx_bytes, tx_bytes, rx_errors and tx_errors counters are published as device attributes. The counters change constantly, so the resources are updated on every publish interval instead of only when the devices change.")
+	flag.StringVar(&interfaceFilter, "interface-filter", "", "Regular expression, if non-empty, only the interfaces whose name matches are published.")
+	flag.StringVar(&rdmaMode, "rdma-mode", dra.RDMAModeExclusive, "RDMA network namespace mode of the node, exclusive or shared. In exclusive mode the RDMA devices are moved with the interfaces.")
+	flag.StringVar(&bindAddress, "bind-address", ":9177", "The IP address and port for the metrics server to serve on, metrics are exported on /debug/vars and the allocations on /debug/allocations")
+
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, "Usage: kube-network-driver [options]\n\n")
+		fmt.Fprint(os.Stderr, "Usage: kube-network-driver [options]\n")
+		fmt.Fprint(os.Stderr, "       kube-network-driver list-devices [options]\n\n")
 		flag.PrintDefaults()
 	}
 }
 
 func Main() int {
 	klog.InitFlags(nil)
+	if len(os.Args) > 1 && os.Args[1] == "list-devices" {
+		return listDevices(os.Args[2:])
+	}
 	flag.Parse()
 
+	if configFile != "" {
+		if err := loadConfig(flag.CommandLine, configFile); err != nil {
+			klog.Fatalf("invalid config: %v", err)
+		}
+	}
+
 	flag.VisitAll(func(f *flag.Flag) {
 		klog.Infof("FLAG: --%s=%q", f.Name, f.Value)
 	})
 
+	if moveRetryAttempts < 1 {
+		klog.Fatalf("move-retry-attempts must be at least 1, got %d", moveRetryAttempts)
+	}
+
+	if publishInterval <= 0 {
+		klog.Fatalf("publish-interval must be positive, got %v", publishInterval)
+	}
+	if settleDelay < 0 {
+		klog.Fatalf("publish-settle-delay must not be negative, got %v", settleDelay)
+	}
+	if expectedDevices < 0 {
+		klog.Fatalf("expected-devices must not be negative, got %d", expectedDevices)
+	}
+	if gracePeriod < 0 {
+		klog.Fatalf("shutdown-grace-period must not be negative, got %v", gracePeriod)
+	}
+	if poolName != "" {
+		if errs := validation.IsDNS1123Subdomain(poolName); len(errs) > 0 {
+			klog.Fatalf("invalid pool-name %q: %s", poolName, strings.Join(errs, ", "))
+		}
+	}
+	if !tempNamePrefixRegex.MatchString(tempNamePrefix) {
+		klog.Fatalf("temp-name-prefix must have between 1 and 5 letters, digits, - or _, got %q", tempNamePrefix)
+	}
+	if !nriPluginIndexRegex.MatchString(nriPluginIndex) {
+		klog.Fatalf("nri-plugin-index must be a two digit string, got %q", nriPluginIndex)
+	}
+	if !filepath.IsAbs(pluginsDir) {
+		klog.Fatalf("kubelet-plugins-dir must be an absolute path, got %q", pluginsDir)
+	}
+	if maxParallelMoves < 1 {
+		klog.Fatalf("max-parallel-moves must be at least 1, got %d", maxParallelMoves)
+	}
+	if maxAllocated < 0 {
+		klog.Fatalf("max-allocated-devices must not be negative, got %d", maxAllocated)
+	}
+	if rdmaMode != dra.RDMAModeExclusive && rdmaMode != dra.RDMAModeShared {
+		klog.Fatalf("rdma-mode must be %s or %s, got %s", dra.RDMAModeExclusive, dra.RDMAModeShared, rdmaMode)
+	}
+	hostTargetNamespaces, err := parseNamespaces(hostTargetNs)
+	if err != nil {
+		klog.Fatalf("invalid host-target-namespaces: %v", err)
+	}
+	postUpExecNamespaces, err := parseNamespaces(postUpExecNs)
+	if err != nil {
+		klog.Fatalf("invalid post-up-exec-namespaces: %v", err)
+	}
+	filter, err := parseInterfaceFilter(interfaceFilter)
+	if err != nil {
+		klog.Fatalf("invalid interface-filter: %v", err)
+	}
+
+	networks, err := parseGCENetworks(gceNetworks)
+	if err != nil {
+		klog.Fatalf("invalid gce-networks: %v", err)
+	}
+
 	var config *rest.Config
-	var err error
 	if kubeconfig != "" {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	} else {
@@ -55,10 +202,9 @@ func Main() int {
 		klog.Fatalf("can not create client-go configuration: %v", err)
 	}
 
-	// use protobuf for better performance at scale
-	// https://kubernetes.io/docs/reference/using-api/api-concepts/#alternate-representations-of-resources
-	config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
-	config.ContentType = "application/vnd.kubernetes.protobuf"
+	if err := setContentType(config, apiContentType); err != nil {
+		klog.Fatalf("invalid api-content-type: %v", err)
+	}
 
 	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(config)
@@ -71,7 +217,13 @@ func Main() int {
 		klog.Fatalf("can not obtain the node name, use the hostname-override flag if you want to set it to a specific value: %v", err)
 	}
 
-	// trap Ctrl+C and call cancel on the context
+	go func() {
+		err := http.ListenAndServe(bindAddress, nil)
+		klog.Infof("metrics server failed: %v", err)
+	}()
+
+	// trap Ctrl+C and the SIGTERM sent by the kubelet and call cancel on the
+	// context
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -81,22 +233,126 @@ func Main() int {
 		close(signalCh)
 		cancel()
 	}()
-	signal.Notify(signalCh, os.Interrupt, unix.SIGINT)
+	signal.Notify(signalCh, os.Interrupt, unix.SIGINT, unix.SIGTERM)
 
-	driver, err := dra.Start(ctx, driverName, clientset, nodeName)
+	opts := []dra.Option{
+		dra.WithMoveBackoff(moveRetryAttempts, moveRetryDelay),
+		dra.WithMaxParallelMoves(maxParallelMoves),
+		dra.WithGCENetworks(networks),
+		dra.WithAllowUnsafeInterfaces(allowUnsafeIfaces),
+		dra.WithAllowEnslavedInterfaces(allowEnslaved),
+		dra.WithPublishOnlyUp(publishOnlyUp),
+		dra.WithReservedInterfaces(parseReservedInterfaces(reservedIfaces)),
+		dra.WithGatewayInterface(gatewayIface),
+		dra.WithPublishInterval(publishInterval),
+		dra.WithPublishSettleDelay(settleDelay),
+		dra.WithExpectedDevices(expectedDevices),
+		dra.WithPublishStats(publishStats),
+		dra.WithMaxAllocatedDevices(maxAllocated),
+		dra.WithSRIOVPartitions(sriovPartitions),
+		dra.WithSRIOVKeepVFs(sriovKeepVFs),
+		dra.WithNRIPluginIndex(nriPluginIndex),
+		dra.WithKubeletPluginsDir(pluginsDir),
+		dra.WithNRIDisabled(disableNRI),
+		dra.WithTempNamePrefix(tempNamePrefix),
+		dra.WithPoolName(poolName),
+		dra.WithHostTargetNamespaces(hostTargetNamespaces),
+		dra.WithPostUpExecNamespaces(postUpExecNamespaces),
+		dra.WithInterfaceFilter(filter),
+		dra.WithRDMAMode(rdmaMode),
+	}
+	driver, err := dra.Start(ctx, driverName, clientset, nodeName, opts...)
 	if err != nil {
 		klog.Infof("driver failed to start: %v", err)
 		return 1
 	}
 	defer driver.Stop()
 	klog.Info("driver started")
+	http.Handle("/debug/allocations", driver.AllocationsHandler())
 
 	select {
-	case <-signalCh:
-		klog.Infof("Exiting: received signal")
+	case sig := <-signalCh:
+		klog.Infof("Exiting: received signal %v, waiting up to %v for the operations in progress", sig, gracePeriod)
+		if !driver.Drain(gracePeriod) {
+			klog.Infof("Exiting: grace period expired with operations in progress")
+		}
 		cancel()
 	case <-ctx.Done():
 	}
 
 	return 0
 }
+
+// setContentType sets the content type of the requests to the API server. The
+// protobuf is used for better performance at scale, json is for the API
+// servers that do not support it.
+// https://kubernetes.io/docs/reference/using-api/api-concepts/#alternate-representations-of-resources
+func setContentType(config *rest.Config, contentType string) error {
+	switch contentType {
+	case contentTypeProtobuf:
+		config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+		config.ContentType = "application/vnd.kubernetes.protobuf"
+	case contentTypeJSON:
+		config.AcceptContentTypes = "application/json"
+		config.ContentType = "application/json"
+	default:
+		return fmt.Errorf("content type must be %s or %s, got %s", contentTypeProtobuf, contentTypeJSON, contentType)
+	}
+	return nil
+}
+
+// parseGCENetworks parses the comma separated list of GCE networks, accepting
+// the network name or the full network path projects/<project>/networks/<name>.
+func parseGCENetworks(value string) ([]string, error) {
+	var networks []string
+	for _, network := range strings.Split(value, ",") {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if strings.Contains(network, "/") {
+			parts := strings.Split(network, "/")
+			if len(parts) != 4 || parts[0] != "projects" || parts[2] != "networks" || parts[1] == "" || parts[3] == "" {
+				return nil, fmt.Errorf("network %q must be a name or projects/<project>/networks/<name>", network)
+			}
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseReservedInterfaces parses the comma separated list of interfaces.
+func parseReservedInterfaces(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseNamespaces parses the comma separated list of namespaces.
+func parseNamespaces(value string) ([]string, error) {
+	var namespaces []string
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces, nil
+}
+
+// parseInterfaceFilter compiles the interface filter, it returns nil if empty.
+func parseInterfaceFilter(value string) (*regexp.Regexp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return regexp.Compile(value)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/aojea/kubernetes-network-driver/pkg/hostdevice"
+	"golang.org/x/sys/unix"
+	"k8s.io/client-go/rest"
+)
+
+func TestSetContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		wantAccept  string
+		wantContent string
+		wantErr     bool
+	}{
+		{
+			name:        "protobuf",
+			contentType: contentTypeProtobuf,
+			wantAccept:  "application/vnd.kubernetes.protobuf,application/json",
+			wantContent: "application/vnd.kubernetes.protobuf",
+		},
+		{
+			name:        "json",
+			contentType: contentTypeJSON,
+			wantAccept:  "application/json",
+			wantContent: "application/json",
+		},
+		{
+			name:        "unknown",
+			contentType: "yaml",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &rest.Config{}
+			if err := setContentType(config, tt.contentType); (err != nil) != tt.wantErr {
+				t.Fatalf("setContentType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if config.AcceptContentTypes != tt.wantAccept || config.ContentType != tt.wantContent {
+				t.Errorf("setContentType() = %q, %q, want %q, %q", config.AcceptContentTypes, config.ContentType, tt.wantAccept, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestTempNamePrefixRegex(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{prefix: hostdevice.DefaultTempNamePrefix, want: true},
+		{prefix: "dra-", want: true},
+		{prefix: "ab_12", want: true},
+		{prefix: ""},
+		{prefix: "toolong"},
+		{prefix: "a b"},
+		{prefix: "a/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			if got := tempNamePrefixRegex.MatchString(tt.prefix); got != tt.want {
+				t.Errorf("tempNamePrefixRegex.MatchString(%q) = %v, want %v", tt.prefix, got, tt.want)
+			}
+			// the temporary name with the highest interface index must be a
+			// valid interface name
+			if tt.want {
+				if name := fmt.Sprintf("%s%d", tt.prefix, math.MaxInt32); len(name) > unix.IFNAMSIZ-1 {
+					t.Errorf("temporary name %q exceeds the maximum interface name length", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the node-local configuration file of the driver, it allows to set
+// the defaults using a ConfigMap instead of flags. The flags explicitly set on
+// the command line take precedence over the values in the file.
+//
+//	publishInterval: 5m
+//	interfaceFilter: ^eth[1-9]
+//	rdmaMode: shared
+type Config struct {
+	// PublishInterval is the interval to publish the resources, as a duration.
+	PublishInterval string `json:"publishInterval,omitempty"`
+	// PublishSettleDelay is the delay of the first publication, as a duration.
+	PublishSettleDelay string `json:"publishSettleDelay,omitempty"`
+	// ExpectedDevices is the number of devices to discover before the first
+	// publication.
+	ExpectedDevices int `json:"expectedDevices,omitempty"`
+	// ShutdownGracePeriod is the maximum time to wait for the operations in
+	// progress on exit, as a duration.
+	ShutdownGracePeriod string `json:"shutdownGracePeriod,omitempty"`
+	// PublishStats publishes the interfaces traffic counters.
+	PublishStats *bool `json:"publishStats,omitempty"`
+	// InterfaceFilter is a regular expression, only the interfaces whose name
+	// matches are published.
+	InterfaceFilter string `json:"interfaceFilter,omitempty"`
+	// RDMAMode is the RDMA network namespace mode, exclusive or shared.
+	RDMAMode string `json:"rdmaMode,omitempty"`
+	// GCENetworks are the GCE networks whose interfaces are published.
+	GCENetworks []string `json:"gceNetworks,omitempty"`
+	// MoveRetryAttempts is the number of attempts to move a device.
+	MoveRetryAttempts int `json:"moveRetryAttempts,omitempty"`
+	// MoveRetryDelay is the initial delay between attempts, as a duration.
+	MoveRetryDelay string `json:"moveRetryDelay,omitempty"`
+	// MaxParallelMoves is the number of devices of a Pod moved at the same
+	// time.
+	MaxParallelMoves int `json:"maxParallelMoves,omitempty"`
+	// GatewayInterface is the interface of the node uplink.
+	GatewayInterface string `json:"gatewayInterface,omitempty"`
+	// AllowUnsafeInterfaces publishes the interfaces used by the node.
+	AllowUnsafeInterfaces *bool `json:"allowUnsafeInterfaces,omitempty"`
+	// AllowEnslavedInterfaces publishes the interfaces enslaved to a bond,
+	// bridge or team.
+	AllowEnslavedInterfaces *bool `json:"allowEnslavedInterfaces,omitempty"`
+	// PublishOnlyUp only publishes the interfaces whose operational state is up.
+	PublishOnlyUp *bool `json:"publishOnlyUp,omitempty"`
+	// ReservedInterfaces are the interfaces reserved for the node, they are
+	// never published nor allocated.
+	ReservedInterfaces []string `json:"reservedInterfaces,omitempty"`
+	// MaxAllocatedDevices is the maximum number of devices allocated to Pods.
+	MaxAllocatedDevices int `json:"maxAllocatedDevices,omitempty"`
+	// SRIOVPartitions publishes the VFs that are not created as partitions.
+	SRIOVPartitions *bool `json:"sriovPartitions,omitempty"`
+	// SRIOVKeepVFs keeps the VFs created for the partitions when not in use.
+	SRIOVKeepVFs *bool `json:"sriovKeepVFs,omitempty"`
+	// NRIPluginIndex is the two digit index of the NRI plugin.
+	NRIPluginIndex string `json:"nriPluginIndex,omitempty"`
+	// DisableNRI does not register the NRI plugin.
+	DisableNRI *bool `json:"disableNRI,omitempty"`
+	// HostTargetNamespaces are the namespaces allowed to configure the devices
+	// on the host.
+	HostTargetNamespaces []string `json:"hostTargetNamespaces,omitempty"`
+	// PostUpExecNamespaces are the namespaces allowed to execute commands
+	// inside the Pod network namespace.
+	PostUpExecNamespaces []string `json:"postUpExecNamespaces,omitempty"`
+	// PoolName is the name of the pool of the devices, unique for each node.
+	PoolName string `json:"poolName,omitempty"`
+	// TempNamePrefix is the prefix of the temporary names of the devices.
+	TempNamePrefix string `json:"tempNamePrefix,omitempty"`
+	// KubeletPluginsDir is the directory of the kubelet plugins.
+	KubeletPluginsDir string `json:"kubeletPluginsDir,omitempty"`
+	// APIContentType is the content type of the requests to the API server,
+	// protobuf or json.
+	APIContentType string `json:"apiContentType,omitempty"`
+	// BindAddress is the address of the metrics server.
+	BindAddress string `json:"bindAddress,omitempty"`
+}
+
+// loadConfig reads the config file and sets the value of the flags that were
+// not set on the command line, it fails on unknown fields or invalid values.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := map[string]string{
+		"publish-interval":        config.PublishInterval,
+		"publish-settle-delay":    config.PublishSettleDelay,
+		"interface-filter":        config.InterfaceFilter,
+		"rdma-mode":               config.RDMAMode,
+		"gce-networks":            strings.Join(config.GCENetworks, ","),
+		"reserved-interfaces":     strings.Join(config.ReservedInterfaces, ","),
+		"move-retry-delay":        config.MoveRetryDelay,
+		"shutdown-grace-period":   config.ShutdownGracePeriod,
+		"bind-address":            config.BindAddress,
+		"api-content-type":        config.APIContentType,
+		"gateway-interface":       config.GatewayInterface,
+		"temp-name-prefix":        config.TempNamePrefix,
+		"pool-name":               config.PoolName,
+		"host-target-namespaces":  strings.Join(config.HostTargetNamespaces, ","),
+		"post-up-exec-namespaces": strings.Join(config.PostUpExecNamespaces, ","),
+		"nri-plugin-index":        config.NRIPluginIndex,
+		"kubelet-plugins-dir":     config.KubeletPluginsDir,
+	}
+	if config.MoveRetryAttempts != 0 {
+		values["move-retry-attempts"] = strconv.Itoa(config.MoveRetryAttempts)
+	}
+	if config.MaxParallelMoves != 0 {
+		values["max-parallel-moves"] = strconv.Itoa(config.MaxParallelMoves)
+	}
+	if config.ExpectedDevices != 0 {
+		values["expected-devices"] = strconv.Itoa(config.ExpectedDevices)
+	}
+	if config.MaxAllocatedDevices != 0 {
+		values["max-allocated-devices"] = strconv.Itoa(config.MaxAllocatedDevices)
+	}
+	if config.SRIOVPartitions != nil {
+		values["sriov-partitions"] = strconv.FormatBool(*config.SRIOVPartitions)
+	}
+	if config.SRIOVKeepVFs != nil {
+		values["sriov-keep-vfs"] = strconv.FormatBool(*config.SRIOVKeepVFs)
+	}
+	if config.AllowUnsafeInterfaces != nil {
+		values["allow-unsafe-interfaces"] = strconv.FormatBool(*config.AllowUnsafeInterfaces)
+	}
+	if config.DisableNRI != nil {
+		values["disable-nri"] = strconv.FormatBool(*config.DisableNRI)
+	}
+	if config.PublishStats != nil {
+		values["publish-stats"] = strconv.FormatBool(*config.PublishStats)
+	}
+	if config.PublishOnlyUp != nil {
+		values["publish-only-up"] = strconv.FormatBool(*config.PublishOnlyUp)
+	}
+	if config.AllowEnslavedInterfaces != nil {
+		values["allow-enslaved-interfaces"] = strconv.FormatBool(*config.AllowEnslavedInterfaces)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range values {
+		if value == "" || set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in config file %s: %w", value, name, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aojea/kubernetes-network-driver/pkg/dra"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// listDevices runs the device discovery once and prints the devices that the
+// driver would publish, it is useful to debug why an interface is or isn't
+// published. It does not register with the kubelet.
+func listDevices(args []string) int {
+	fs := flag.NewFlagSet("list-devices", flag.ExitOnError)
+	// the discovery depends on the same flags used by the driver
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	output := fs.String("output", "json", "Output format, json or yaml.")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: kube-network-driver list-devices [options]\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if configFile != "" {
+		if err := loadConfig(fs, configFile); err != nil {
+			klog.Fatalf("invalid config: %v", err)
+		}
+	}
+
+	filter, err := parseInterfaceFilter(interfaceFilter)
+	if err != nil {
+		klog.Fatalf("invalid interface-filter: %v", err)
+	}
+	networks, err := parseGCENetworks(gceNetworks)
+	if err != nil {
+		klog.Fatalf("invalid gce-networks: %v", err)
+	}
+
+	devices, err := dra.ListDevices(context.Background(),
+		dra.WithGCENetworks(networks),
+		dra.WithAllowUnsafeInterfaces(allowUnsafeIfaces),
+		dra.WithAllowEnslavedInterfaces(allowEnslaved),
+		dra.WithPublishOnlyUp(publishOnlyUp),
+		dra.WithReservedInterfaces(parseReservedInterfaces(reservedIfaces)),
+		dra.WithGatewayInterface(gatewayIface),
+		dra.WithInterfaceFilter(filter),
+		dra.WithPublishStats(publishStats),
+		dra.WithSRIOVPartitions(sriovPartitions),
+	)
+	if err != nil {
+		klog.Infof("failed to list devices: %v", err)
+		return 1
+	}
+
+	var out []byte
+	switch *output {
+	case "json":
+		out, err = json.MarshalIndent(devices, "", "  ")
+	case "yaml":
+		out, err = yaml.Marshal(devices)
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+	if err != nil {
+		klog.Infof("failed to print devices: %v", err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
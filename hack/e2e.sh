@@ -0,0 +1,103 @@
+#!/bin/bash
+
+# End to end test of the driver: it creates a kind cluster, installs the driver
+# as a DaemonSet, creates a dummy interface on the worker nodes and checks that
+# the interface is attached to a Pod that claims it.
+#
+# If the kind cluster already exists the driver is assumed to be installed and
+# the cluster is not deleted at the end.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+REPO_ROOT=$(dirname "${BASH_SOURCE[0]}")/..
+KIND_CLUSTER_NAME=${KIND_CLUSTER_NAME:-dra-e2e}
+KIND_NODE_IMAGE=${KIND_NODE_IMAGE:-kindest/node:v1.31.0}
+IMAGE=${IMAGE:-aojea/kube-network-driver:test}
+IFACE=${IFACE:-dummy0}
+NAMESPACE=network-driver-e2e
+
+cd "${REPO_ROOT}"
+
+CREATED_CLUSTER=false
+
+cleanup() {
+  kubectl delete namespace "${NAMESPACE}" --ignore-not-found --timeout=2m || true
+  kubectl delete deviceclass "${NAMESPACE}" --ignore-not-found || true
+  for node in $(kind get nodes --name "${KIND_CLUSTER_NAME}" 2>/dev/null); do
+    docker exec "${node}" ip link del "${IFACE}" 2>/dev/null || true
+  done
+  if [ "${CREATED_CLUSTER}" = true ]; then
+    kind delete cluster --name "${KIND_CLUSTER_NAME}"
+  fi
+}
+trap cleanup EXIT
+
+if ! kind get clusters | grep -qx "${KIND_CLUSTER_NAME}"; then
+  kind create cluster --name "${KIND_CLUSTER_NAME}" --image "${KIND_NODE_IMAGE}" --config kind.yaml
+  CREATED_CLUSTER=true
+  docker build -t "${IMAGE}" .
+  kind load docker-image "${IMAGE}" --name "${KIND_CLUSTER_NAME}"
+  sed "s#aojea/kube-network-driver:.*#${IMAGE}#" install.yaml | kubectl apply -f -
+fi
+kubectl config use-context "kind-${KIND_CLUSTER_NAME}"
+kubectl -n kube-system rollout status daemonset/network-driver --timeout=2m
+
+# the interfaces are published once the driver detects them
+for node in $(kind get nodes --name "${KIND_CLUSTER_NAME}"); do
+  if [[ "${node}" == *control-plane* ]]; then
+    continue
+  fi
+  docker exec "${node}" ip link add "${IFACE}" type dummy
+  docker exec "${node}" ip link set up dev "${IFACE}"
+done
+
+kubectl create namespace "${NAMESPACE}"
+kubectl apply -f - <<MANIFEST
+apiVersion: resource.k8s.io/v1alpha3
+kind: DeviceClass
+metadata:
+  name: ${NAMESPACE}
+spec:
+  selectors:
+  - cel:
+      expression: device.driver == "networking.k8s.io"
+---
+apiVersion: resource.k8s.io/v1alpha3
+kind: ResourceClaim
+metadata:
+  name: dummy
+  namespace: ${NAMESPACE}
+spec:
+  devices:
+    requests:
+    - name: dummy
+      deviceClassName: ${NAMESPACE}
+      selectors:
+      - cel:
+          expression: device.attributes["networking.k8s.io"].name == "${IFACE}"
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: pod
+  namespace: ${NAMESPACE}
+spec:
+  containers:
+  - name: ctr
+    image: registry.k8s.io/e2e-test-images/agnhost:2.39
+    args: ["pause"]
+  resourceClaims:
+  - name: dummy
+    resourceClaimName: dummy
+MANIFEST
+
+kubectl -n "${NAMESPACE}" wait --for=condition=ready pod/pod --timeout=3m
+
+if ! kubectl -n "${NAMESPACE}" exec pod -- cat /proc/net/dev | grep -q "^ *${IFACE}:"; then
+  echo "interface ${IFACE} not found inside the pod"
+  kubectl -n "${NAMESPACE}" describe pod pod
+  exit 1
+fi
+echo "interface ${IFACE} attached to the pod"
@@ -0,0 +1,40 @@
+package dra
+
+import (
+	"fmt"
+	"slices"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/client-go/discovery"
+	"k8s.io/klog/v2"
+)
+
+// checkResourceAPI checks the API server serves the version of the DRA API the
+// driver is built with, the claims and the resource slices are only read and
+// written in that version. The driver does not start if the version is not
+// served, per example in clusters that only serve newer versions, instead of
+// failing on every claim. The check is skipped if the API discovery fails.
+func checkResourceAPI(client discovery.DiscoveryInterface) error {
+	groups, err := client.ServerGroups()
+	if err != nil {
+		klog.Infof("failed to discover the DRA API versions, assuming %s is served: %v", resourceapi.SchemeGroupVersion.String(), err)
+		return nil
+	}
+	for _, group := range groups.Groups {
+		if group.Name != resourceapi.GroupName {
+			continue
+		}
+		var versions []string
+		for _, version := range group.Versions {
+			versions = append(versions, version.Version)
+		}
+		if !slices.Contains(versions, resourceapi.SchemeGroupVersion.Version) {
+			return fmt.Errorf("the API server serves the DRA API versions %v, the driver requires %s", versions, resourceapi.SchemeGroupVersion.String())
+		}
+		if preferred := group.PreferredVersion.Version; preferred != resourceapi.SchemeGroupVersion.Version {
+			klog.Infof("the API server prefers the DRA API version %s, the driver uses %s", preferred, resourceapi.SchemeGroupVersion.Version)
+		}
+		return nil
+	}
+	return fmt.Errorf("the API server does not serve the DRA API group %s, the DynamicResourceAllocation feature must be enabled", resourceapi.GroupName)
+}
@@ -0,0 +1,66 @@
+package dra
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCheckResourceAPI(t *testing.T) {
+	tests := []struct {
+		name          string
+		groupVersions []string
+		discoveryErr  error
+		wantErr       bool
+	}{
+		{
+			name:          "version served",
+			groupVersions: []string{"v1", "resource.k8s.io/v1alpha3"},
+		},
+		{
+			name:          "newer version preferred",
+			groupVersions: []string{"v1", "resource.k8s.io/v1beta1", "resource.k8s.io/v1alpha3"},
+		},
+		{
+			name:          "only newer version served",
+			groupVersions: []string{"v1", "resource.k8s.io/v1beta1"},
+			wantErr:       true,
+		},
+		{
+			name:          "older version served",
+			groupVersions: []string{"v1", "resource.k8s.io/v1alpha2"},
+			wantErr:       true,
+		},
+		{
+			name:          "group not served",
+			groupVersions: []string{"v1", "apps/v1"},
+			wantErr:       true,
+		},
+		{
+			name:         "discovery failure",
+			discoveryErr: errors.New("connection refused"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			discovery := client.Discovery().(*fakediscovery.FakeDiscovery)
+			for _, groupVersion := range tt.groupVersions {
+				discovery.Resources = append(discovery.Resources, &metav1.APIResourceList{GroupVersion: groupVersion})
+			}
+			if tt.discoveryErr != nil {
+				discovery.PrependReactor("get", "group", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.discoveryErr
+				})
+			}
+			if err := checkResourceAPI(discovery); (err != nil) != tt.wantErr {
+				t.Errorf("checkResourceAPI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package dra
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/klog/v2"
+)
+
+// validateBond checks the slaves of the bond are allocated to the same request
+// and that their interfaces, obtained with linkName, are not already enslaved
+// on the host.
+func (np *NetworkPlugin) validateBond(allocation resourceapi.AllocationResult, requestName string, config *NetworkConfig, linkName func(string) string) error {
+	var allocated []string
+	for _, result := range allocation.Devices.Results {
+		if result.Driver == np.driverName && result.Request == requestName {
+			allocated = append(allocated, result.Device)
+		}
+	}
+	for _, slave := range config.Slaves {
+		if !slices.Contains(allocated, slave) {
+			return fmt.Errorf("bond slave %s is not allocated to request %s", slave, requestName)
+		}
+		link, err := netlink.LinkByName(linkName(slave))
+		if err != nil {
+			return fmt.Errorf("bond slave %s not found: %w", slave, err)
+		}
+		if link.Attrs().MasterIndex != 0 {
+			return fmt.Errorf("bond slave %s is already enslaved", slave)
+		}
+	}
+	return nil
+}
+
+// bondSlaves returns the names inside the Pod of the slaves of the bond of the
+// request. The slaves are the allocated devices, their interfaces can be a VF
+// partition or resolved by hardware address, and renamed in the Pod.
+func (np *NetworkPlugin) bondSlaves(request string, config *NetworkConfig) []string {
+	slaves := make([]string, 0, len(config.Slaves))
+	for _, slave := range config.Slaves {
+		slaves = append(slaves, config.interfaceName(request, np.linkName(slave)))
+	}
+	return slaves
+}
+
+// createBond creates the bond inside the network namespace nsPath and enslaves
+// the slaves, the names of the interfaces that have to be already in the
+// namespace. The bond is deleted if any of the slaves can not be enslaved.
+func createBond(nsPath string, name string, config *NetworkConfig, slaves []string) error {
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer containerNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: name})
+		if config.BondMode != "" {
+			bond.Mode = netlink.StringToBondMode(config.BondMode)
+		}
+		if err := netlink.LinkAdd(bond); err != nil {
+			return fmt.Errorf("failed to create bond %s: %w", name, err)
+		}
+		err := enslave(bond, slaves)
+		if err != nil {
+			if err := netlink.LinkDel(bond); err != nil {
+				klog.Infof("failed to delete bond %s: %v", name, err)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func enslave(bond *netlink.Bond, slaves []string) error {
+	for _, slave := range slaves {
+		link, err := netlink.LinkByName(slave)
+		if err != nil {
+			return fmt.Errorf("failed to find bond slave %s: %w", slave, err)
+		}
+		// interfaces must be down to be enslaved
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set %s down: %w", slave, err)
+		}
+		if err := netlink.LinkSetMaster(link, bond); err != nil {
+			return fmt.Errorf("failed to enslave %s to %s: %w", slave, bond.Name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(bond); err != nil {
+		return fmt.Errorf("failed to set %s up: %w", bond.Name, err)
+	}
+	return nil
+}
+
+// deleteBond releases the slaves, the names of the interfaces in the namespace,
+// and deletes the bond inside the network namespace nsPath, so the slaves can
+// be returned to the host.
+func deleteBond(nsPath string, name string, slaves []string) error {
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer containerNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		for _, slave := range slaves {
+			link, err := netlink.LinkByName(slave)
+			if err != nil {
+				klog.Infof("failed to find bond slave %s: %v", slave, err)
+				continue
+			}
+			if err := netlink.LinkSetNoMaster(link); err != nil {
+				klog.Infof("failed to release bond slave %s: %v", slave, err)
+			}
+		}
+		bond, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find bond %s: %w", name, err)
+		}
+		return netlink.LinkDel(bond)
+	})
+}
@@ -0,0 +1,53 @@
+package dra
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBondSlaves(t *testing.T) {
+	np := &NetworkPlugin{
+		driverName:    "dra.net",
+		resolvedLinks: resolvedLinks{links: map[string]string{}},
+		partitions:    vfPartitions{netdevs: map[string]string{}, created: map[string]bool{}},
+	}
+	np.partitions.Add("eth1-vf0", "eth1v0")
+	np.resolvedLinks.Add("eth2", "enp2s0")
+
+	tests := []struct {
+		name    string
+		request string
+		config  *NetworkConfig
+		want    []string
+	}{
+		{
+			name:    "interface names",
+			request: "bond",
+			config:  &NetworkConfig{Mode: modeBond, Slaves: []string{"eth3", "eth4"}},
+			want:    []string{"eth3", "eth4"},
+		},
+		{
+			name:    "partition and hardware address",
+			request: "bond",
+			config:  &NetworkConfig{Mode: modeBond, Slaves: []string{"eth1-vf0", "eth2"}},
+			want:    []string{"eth1v0", "enp2s0"},
+		},
+		{
+			name:    "renamed in the Pod",
+			request: "bond",
+			config: &NetworkConfig{
+				Mode:       modeBond,
+				Slaves:     []string{"eth2"},
+				Interfaces: map[string]string{"bond": "net1", "other": "net2"},
+			},
+			want: []string{"net1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := np.bondSlaves(tt.request, tt.config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bondSlaves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,645 @@
+package dra
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+)
+
+// ifNameToken is replaced in the configuration by the name of the interface
+// inside the Pod network namespace.
+const ifNameToken = "IFNAME"
+
+// hostNetNSPath is the network namespace of the driver, that runs in the host
+// network namespace.
+var hostNetNSPath = "/proc/self/ns/net"
+
+const (
+	// familyV4 and familyV6 are the IP families of the default route.
+	familyV4 = "v4"
+	familyV6 = "v6"
+	// targetHost configures the device on the host instead of the Pod.
+	targetHost = "host"
+	// modeBond creates a bond with the allocated interfaces.
+	modeBond = "bond"
+	// defaultBondName is the name of the bond inside the Pod if not set.
+	defaultBondName = "bond0"
+	// modeGRE and modeIPIP create a tunnel over the allocated interface.
+	modeGRE  = "gre"
+	modeIPIP = "ipip"
+	// modeVXLAN creates a VXLAN device over the allocated interface, or over
+	// the interface in the config.
+	modeVXLAN = "vxlan"
+	// maxVNI is the maximum VXLAN network identifier, it uses 24 bits.
+	maxVNI = 1<<24 - 1
+	// vxlanPort is the IANA assigned VXLAN UDP port.
+	vxlanPort = 4789
+	// defaultTunnelName is the name of the tunnel inside the Pod if not set,
+	// gre0 and tunl0 are reserved for the fallback devices of the kernel.
+	defaultTunnelName = "tunnel0"
+	// defaultCarrierTimeout is the time to wait for carrier if not set.
+	defaultCarrierTimeout = 10 * time.Second
+	// maxIngressMbps is the maximum rate that can be policed, the kernel uses
+	// 32 bits to store the rate in bytes per second.
+	maxIngressMbps = math.MaxUint32 * 8 / (1000 * 1000)
+)
+
+// NetworkConfig is the configuration that users can pass to the driver using
+// the opaque parameters of the ResourceClaim device configuration.
+//
+//	{"sysctls":{"net.ipv6.conf.IFNAME.disable_ipv6":"1"}}
+//
+// The configuration entries that apply to a request are merged in order, the
+// entries of the DeviceClass first and then the ones of the claim. The later
+// entries override the scalar fields they set, the maps are merged by key and
+// the addresses, routes, rules and neighbors are concatenated.
+//
+// The configuration is applied once, when the Pod sandbox is created. It is
+// not updated for the running Pods: the allocation that carries it can not be
+// changed and neither NRI nor DRA notify the driver of a new configuration, so
+// the Pod has to be recreated to apply a new configuration.
+type NetworkConfig struct {
+	// Sysctls are applied inside the Pod network namespace once the interface
+	// is up. Only network sysctls (net.*) are allowed.
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// Offloads enables or disables the interface offload features, it accepts
+	// the kernel feature names (tx-checksum-ip-generic) and the ethtool
+	// command aliases (tso, gro, ...).
+	Offloads map[string]bool `json:"offloads,omitempty"`
+	// IPv4 addresses in CIDR format to add to the interface.
+	IPv4 []string `json:"ipv4,omitempty"`
+	// IPv6 addresses in CIDR format to add to the interface, the driver waits
+	// for the duplicate address detection to complete.
+	IPv6 []string `json:"ipv6,omitempty"`
+	// SecondaryIPs are additional addresses in CIDR format, of any IP family,
+	// added to the interface after the IPv4 and IPv6 addresses. They are used
+	// by the services that bind several virtual IPs, the addresses on the
+	// subnet of a previous address are secondary addresses of the interface.
+	//
+	//	{"ipv4":["10.0.0.2/24"],"secondaryIps":["10.0.0.3/24","10.0.0.4/24"]}
+	SecondaryIPs []string `json:"secondaryIps,omitempty"`
+	// IPAM allocates an address to the interface from a subnet.
+	IPAM *IPAMConfig `json:"ipam,omitempty"`
+	// SLAAC enables the router advertisements acceptance on the interface, so
+	// it autoconfigures the IPv6 addresses and the default route.
+	SLAAC bool `json:"slaac,omitempty"`
+	// DHCPv6 obtains an IPv6 address from a DHCPv6 server, the lease is
+	// released on teardown.
+	DHCPv6 bool `json:"dhcpv6,omitempty"`
+	// RoutingTable is the table where the Routes are installed, the main
+	// table is used if not set.
+	RoutingTable int `json:"routingTable,omitempty"`
+	// Routes to add through the interface inside the Pod network namespace.
+	Routes []RouteConfig `json:"routes,omitempty"`
+	// DefaultRouteFamily is the IP family, "v4" or "v6", of the default route
+	// of dual-stack Pods, the default routes of the other family are not
+	// installed. It is "v4" if not set and the Routes have default routes of
+	// both families.
+	DefaultRouteFamily string `json:"defaultRouteFamily,omitempty"`
+	// Rules are the policy routing rules to add inside the Pod network namespace.
+	Rules []RuleConfig `json:"rules,omitempty"`
+	// Neighbors are static neighbor entries to add to the interface, used in
+	// environments that suppress ARP or use anycast gateways.
+	//
+	//	{"neighbors":[{"ip":"192.168.4.1","mac":"42:01:c0:a8:04:01"}]}
+	Neighbors []NeighborConfig `json:"neighbors,omitempty"`
+	// Interfaces are the names of the interfaces inside the Pod by request
+	// name, the interfaces keep their host names if not set. It gives
+	// predictable names to the interfaces of the claims with several requests.
+	//
+	//	{"interfaces":{"req0":"net1","req1":"net2"}}
+	Interfaces map[string]string `json:"interfaces,omitempty"`
+	// MACAddress selects the host interface of the device by its permanent MAC
+	// address, or its current one if the interface does not have a permanent
+	// address, instead of by the published device name, that changes if the
+	// interface is renamed. The claim fails to be prepared if no interface or
+	// more than one interface matches, if the interface is not the hardware of
+	// the allocated device, if it is not published by the driver, per example
+	// the gateway interface, or if it is allocated to another claim.
+	//
+	//	{"macAddress":"42:01:c0:a8:04:02"}
+	MACAddress string `json:"macAddress,omitempty"`
+	// PCIAddress selects the host interface of the device by its PCI address,
+	// if MACAddress is also set the interface must match both.
+	//
+	//	{"pciAddress":"0000:3b:00.1"}
+	PCIAddress string `json:"pciAddress,omitempty"`
+	// Target "host" configures the device on the host, instead of moving it to
+	// the Pod, and reverts the configuration on teardown. It is used by the
+	// node network agents running as Pods, only the namespaces allowed by the
+	// driver can use it.
+	//
+	//	{"target":"host","ipv4":["192.168.1.2/24"]}
+	Target string `json:"target,omitempty"`
+	// NetNS is the path of a network namespace, per example one created with
+	// "ip netns add", to attach the interface to instead of the Pod network
+	// namespace.
+	NetNS string `json:"netns,omitempty"`
+	// Promisc enables the promiscuous mode of the interface, the Pod receives
+	// all the traffic on the link. Used by packet capture and bridging.
+	Promisc bool `json:"promisc,omitempty"`
+	// AllMulti enables the reception of all the multicast traffic.
+	AllMulti bool `json:"allmulti,omitempty"`
+	// TxQueueLen is the transmit queue length of the interface, used by the
+	// high throughput applications. The length is not changed if not set.
+	//
+	//	{"txqueuelen":10000}
+	TxQueueLen int `json:"txqueuelen,omitempty"`
+	// IngressMbps limits the traffic received on the interface, the traffic
+	// exceeding the limit is dropped. Zero, the default, does not limit it.
+	IngressMbps int `json:"ingressMbps,omitempty"`
+	// EgressMbps limits the traffic sent through the interface. Zero, the
+	// default, does not limit it.
+	EgressMbps int `json:"egressMbps,omitempty"`
+	// MinSpeedMbps is the minimum negotiated speed of the device, the claim
+	// fails to be prepared if the link renegotiated a lower speed after the
+	// allocation. The devices that do not report the speed fail the check.
+	//
+	//	{"minSpeedMbps":100000}
+	MinSpeedMbps int `json:"minSpeedMbps,omitempty"`
+	// Mode "bond" creates a bond inside the Pod network namespace and enslaves
+	// the Slaves, the rest of the configuration is applied to the bond.
+	//
+	//	{"mode":"bond","slaves":["eth1","eth2"],"bondMode":"802.3ad"}
+	//
+	// Modes "gre", "ipip" and "vxlan" create a tunnel over the allocated
+	// interface, that remains on the host, and attach the tunnel to the Pod
+	// instead.
+	Mode string `json:"mode,omitempty"`
+	// Slaves are the names of the interfaces to enslave to the bond, they must
+	// be allocated to the same request.
+	Slaves []string `json:"slaves,omitempty"`
+	// BondMode is the bonding mode (balance-rr, active-backup, 802.3ad, ...),
+	// the kernel default balance-rr is used if not set.
+	BondMode string `json:"bondMode,omitempty"`
+	// BondName is the name of the bond inside the Pod, bond0 if not set.
+	BondName string `json:"bondName,omitempty"`
+	// WaitForCarrier waits until the interface is operationally up inside the
+	// Pod network namespace, the Pod fails to start if the interface does not
+	// get carrier before the Timeout.
+	//
+	//	{"waitForCarrier":true,"timeout":"10s"}
+	WaitForCarrier bool `json:"waitForCarrier,omitempty"`
+	// Timeout is the maximum time to wait for carrier, as a duration, 10s if
+	// not set.
+	Timeout string `json:"timeout,omitempty"`
+	// VerifyMTU sends a probe of the size of the interface MTU, that can not
+	// be fragmented, to the gateways of the Routes once the interface is
+	// configured. The Pod fails to start if a gateway does not reply, per
+	// example if the fabric does not support jumbo frames.
+	//
+	//	{"verifyMtu":true,"routes":[{"destination":"10.0.0.0/8","gateway":"192.168.1.1"}]}
+	VerifyMTU bool `json:"verifyMtu,omitempty"`
+	// Local is the source address of the tunnel, it must be an address of the
+	// node. It is selected by the kernel if not set.
+	//
+	//	{"mode":"gre","local":"192.168.1.2","remote":"192.168.2.2","key":42}
+	Local string `json:"local,omitempty"`
+	// Remote is the destination address of the tunnel.
+	Remote string `json:"remote,omitempty"`
+	// Key is the GRE key of the tunnel traffic.
+	Key uint32 `json:"key,omitempty"`
+	// VNI is the VXLAN network identifier.
+	//
+	//	{"mode":"vxlan","vni":100,"group":"239.1.1.1","dev":"eth0"}
+	VNI int `json:"vni,omitempty"`
+	// Group is the VXLAN multicast group, the VXLAN uses the Remote address
+	// if not set.
+	Group string `json:"group,omitempty"`
+	// Dev is the VXLAN underlay interface on the host, the allocated interface
+	// if not set.
+	Dev string `json:"dev,omitempty"`
+	// TunnelName is the name of the tunnel inside the Pod, tunnel0 if not set.
+	TunnelName string `json:"tunnelName,omitempty"`
+	// PostUpExec is a command executed inside the Pod network namespace once
+	// the interface is configured, the IFNAME token in the arguments is
+	// replaced by the interface name. Only the ip, tc, ethtool and bridge
+	// commands are allowed, with the subcommands that modify the namespace
+	// network configuration, and they must be available in the driver image.
+	// The commands run as root, so only the namespaces allowed by the driver
+	// can use it.
+	//
+	//	{"postUpExec":["ip","route","add","10.0.0.0/8","dev","IFNAME"]}
+	PostUpExec []string `json:"postUpExec,omitempty"`
+	// PreserveConfig keeps the addresses and routes that the interface has on
+	// the host, they are restored inside the Pod in the same operation that
+	// moves the interface, per example to not lose a DHCP lease. The addresses
+	// and routes of the configuration are added to them.
+	PreserveConfig bool `json:"preserveConfig,omitempty"`
+	// NoBringUp attaches the interface to the Pod but leaves it down, for the
+	// applications that manage the interface, per example DPDK. The interface
+	// is not configured, so it can not be combined with other settings than
+	// netns, dryRun and minSpeedMbps, and no addresses are assigned.
+	NoBringUp bool `json:"noBringUp,omitempty"`
+	// DryRun validates the claim on prepare but the devices are not attached
+	// to the Pod.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// RouteConfig is a route through the interface.
+type RouteConfig struct {
+	// Destination in CIDR format, the default route if empty.
+	Destination string `json:"destination,omitempty"`
+	// Gateway IP address, the route is directly connected if empty.
+	Gateway string `json:"gateway,omitempty"`
+	// Gateways are the next hops of an ECMP route, the traffic is balanced
+	// between them. They must be reachable through the interface, and it can
+	// not be combined with Gateway.
+	//
+	//	{"routes":[{"destination":"10.0.0.0/8","gateways":["192.168.1.1","192.168.1.254"]}]}
+	Gateways []string `json:"gateways,omitempty"`
+}
+
+// gateways returns the next hops of the route, empty if it is directly
+// connected.
+func (r RouteConfig) gateways() []string {
+	if r.Gateway != "" {
+		return []string{r.Gateway}
+	}
+	return r.Gateways
+}
+
+// isDefault returns true if the route is a default route.
+func (r RouteConfig) isDefault() bool {
+	return r.Destination == "" || r.Destination == "0.0.0.0/0" || r.Destination == "::/0"
+}
+
+// family returns the IP family of the route, from the gateway or the
+// destination, the IPv4 family if none is set.
+func (r RouteConfig) family() string {
+	if gateways := r.gateways(); len(gateways) > 0 && ipFamily(net.ParseIP(gateways[0])) == netlink.FAMILY_V6 {
+		return familyV6
+	}
+	if ip, _, err := net.ParseCIDR(r.Destination); err == nil && ip.To4() == nil {
+		return familyV6
+	}
+	return familyV4
+}
+
+// defaultRouteFamily returns the family of the default routes to install, the
+// IPv4 family if it is not set and there are default routes of both families,
+// or empty to install the default routes of the only family configured.
+func (c *NetworkConfig) defaultRouteFamily() string {
+	if c.DefaultRouteFamily != "" {
+		return c.DefaultRouteFamily
+	}
+	families := map[string]bool{}
+	for _, route := range c.Routes {
+		if route.isDefault() {
+			families[route.family()] = true
+		}
+	}
+	if families[familyV4] && families[familyV6] {
+		return familyV4
+	}
+	return ""
+}
+
+// NeighborConfig is a static neighbor entry.
+type NeighborConfig struct {
+	// IP is the address of the neighbor.
+	IP string `json:"ip"`
+	// MAC is the hardware address of the neighbor.
+	MAC string `json:"mac"`
+}
+
+// RuleConfig is a policy routing rule.
+type RuleConfig struct {
+	// Source in CIDR format.
+	Source string `json:"src,omitempty"`
+	// Destination in CIDR format.
+	Destination string `json:"dst,omitempty"`
+	// Table to lookup for the traffic matching the rule.
+	Table int `json:"table"`
+	// Priority of the rule, assigned by the kernel if not set.
+	Priority int `json:"priority,omitempty"`
+}
+
+// Validate checks the configuration is valid and safe to apply.
+func (c *NetworkConfig) Validate() error {
+	for key := range c.Sysctls {
+		if !strings.HasPrefix(key, "net.") {
+			return fmt.Errorf("sysctl %q not allowed, only net.* sysctls are supported", key)
+		}
+	}
+	for _, address := range c.IPv4 {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("invalid IPv4 address %q: %w", address, err)
+		}
+		if ip.To4() == nil {
+			return fmt.Errorf("address %q is not IPv4", address)
+		}
+	}
+	for _, address := range c.IPv6 {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("invalid IPv6 address %q: %w", address, err)
+		}
+		if ip.To4() != nil {
+			return fmt.Errorf("address %q is not IPv6", address)
+		}
+	}
+	for _, address := range c.SecondaryIPs {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("invalid secondary address %q: %w", address, err)
+		}
+	}
+	addresses := map[string]bool{}
+	for _, address := range slices.Concat(c.IPv4, c.IPv6, c.SecondaryIPs) {
+		ip, _, _ := net.ParseCIDR(address)
+		if addresses[ip.String()] {
+			return fmt.Errorf("address %s is configured more than once", ip.String())
+		}
+		addresses[ip.String()] = true
+	}
+	if c.IPAM != nil {
+		if err := c.IPAM.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.RoutingTable < 0 {
+		return fmt.Errorf("invalid routing table %d", c.RoutingTable)
+	}
+	for _, route := range c.Routes {
+		if route.Destination != "" {
+			if _, _, err := net.ParseCIDR(route.Destination); err != nil {
+				return fmt.Errorf("invalid route destination %q: %w", route.Destination, err)
+			}
+		}
+		if route.Gateway != "" && len(route.Gateways) > 0 {
+			return fmt.Errorf("route %q can not have a gateway and gateways", route.Destination)
+		}
+		gateways := map[string]bool{}
+		for _, gateway := range route.gateways() {
+			ip := net.ParseIP(gateway)
+			if ip == nil {
+				return fmt.Errorf("invalid route gateway %q", gateway)
+			}
+			if ipFamily(ip) != ipFamily(net.ParseIP(route.gateways()[0])) {
+				return fmt.Errorf("route %q gateways must be of the same IP family", route.Destination)
+			}
+			if gateways[ip.String()] {
+				return fmt.Errorf("route %q has the gateway %s more than once", route.Destination, gateway)
+			}
+			gateways[ip.String()] = true
+		}
+	}
+	if c.DefaultRouteFamily != "" {
+		if c.DefaultRouteFamily != familyV4 && c.DefaultRouteFamily != familyV6 {
+			return fmt.Errorf("invalid defaultRouteFamily %q, must be %q or %q", c.DefaultRouteFamily, familyV4, familyV6)
+		}
+		hasGateway := slices.ContainsFunc(c.Routes, func(route RouteConfig) bool {
+			return route.isDefault() && len(route.gateways()) > 0 && route.family() == c.DefaultRouteFamily
+		})
+		if !hasGateway {
+			return fmt.Errorf("defaultRouteFamily %q requires a default route with a gateway of the same family", c.DefaultRouteFamily)
+		}
+	}
+	for _, neighbor := range c.Neighbors {
+		if net.ParseIP(neighbor.IP) == nil {
+			return fmt.Errorf("invalid neighbor address %q", neighbor.IP)
+		}
+		if _, err := net.ParseMAC(neighbor.MAC); err != nil {
+			return fmt.Errorf("invalid neighbor %s hardware address %q: %w", neighbor.IP, neighbor.MAC, err)
+		}
+	}
+	for _, rule := range c.Rules {
+		if rule.Table <= 0 {
+			return fmt.Errorf("invalid rule table %d", rule.Table)
+		}
+		if rule.Source == "" && rule.Destination == "" {
+			return fmt.Errorf("rule for table %d requires a source or a destination", rule.Table)
+		}
+		for _, cidr := range []string{rule.Source, rule.Destination} {
+			if cidr == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid rule prefix %q: %w", cidr, err)
+			}
+		}
+	}
+	if err := validatePostUpExec(c.PostUpExec); err != nil {
+		return err
+	}
+	if c.NetNS != "" && !filepath.IsAbs(c.NetNS) {
+		return fmt.Errorf("netns %q must be an absolute path", c.NetNS)
+	}
+	if c.IngressMbps < 0 || c.IngressMbps > maxIngressMbps {
+		return fmt.Errorf("invalid ingressMbps %d, must be between 0 (unlimited) and %d", c.IngressMbps, maxIngressMbps)
+	}
+	if c.EgressMbps < 0 {
+		return fmt.Errorf("invalid egressMbps %d, must not be negative", c.EgressMbps)
+	}
+	if c.MinSpeedMbps < 0 {
+		return fmt.Errorf("invalid minSpeedMbps %d, must not be negative", c.MinSpeedMbps)
+	}
+	if c.TxQueueLen < 0 {
+		return fmt.Errorf("invalid txqueuelen %d, must not be negative", c.TxQueueLen)
+	}
+	if c.Timeout != "" {
+		if !c.WaitForCarrier {
+			return fmt.Errorf("timeout requires waitForCarrier")
+		}
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %w", c.Timeout, err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q, must be positive", c.Timeout)
+		}
+	}
+	if c.VerifyMTU && !slices.ContainsFunc(c.Routes, func(route RouteConfig) bool { return len(route.gateways()) > 0 }) {
+		return fmt.Errorf("verifyMtu requires a route with a gateway")
+	}
+	if c.Target != "" {
+		if c.Target != targetHost {
+			return fmt.Errorf("invalid target %q, only %q is supported", c.Target, targetHost)
+		}
+		if c.NetNS != "" || c.Mode != "" || len(c.Interfaces) > 0 || c.NoBringUp || c.PreserveConfig {
+			return fmt.Errorf("target %q can not be combined with netns, mode, interfaces, noBringUp or preserveConfig, the device is not moved", c.Target)
+		}
+	}
+	if c.NoBringUp {
+		rest := *c
+		rest.NoBringUp, rest.NetNS, rest.DryRun, rest.MinSpeedMbps = false, "", false, 0
+		rest.MACAddress, rest.PCIAddress = "", ""
+		if !reflect.DeepEqual(rest, NetworkConfig{}) {
+			return fmt.Errorf("noBringUp can not be combined with other settings than netns, dryRun, minSpeedMbps, macAddress and pciAddress, the interface is not configured")
+		}
+	}
+	names := map[string]bool{}
+	if c.MACAddress != "" {
+		if _, err := net.ParseMAC(c.MACAddress); err != nil {
+			return fmt.Errorf("invalid MAC address %q: %w", c.MACAddress, err)
+		}
+	}
+	if c.PCIAddress != "" && !pciAddressRegex.MatchString(c.PCIAddress) {
+		return fmt.Errorf("invalid PCI address %q, the format is <domain>:<bus>:<device>.<function>", c.PCIAddress)
+	}
+	for request, name := range c.Interfaces {
+		if name == "" || len(name) > unix.IFNAMSIZ-1 || strings.ContainsAny(name, "/: ") {
+			return fmt.Errorf("invalid interface name %q for request %s", name, request)
+		}
+		if names[name] {
+			return fmt.Errorf("interface name %q is used by more than one request", name)
+		}
+		names[name] = true
+	}
+	// the bond slaves and the tunnel underlays do not keep their addresses
+	if c.PreserveConfig && c.Mode != "" {
+		return fmt.Errorf("preserveConfig is not supported in mode %q", c.Mode)
+	}
+	switch c.Mode {
+	case "":
+		if len(c.Slaves) > 0 || c.BondMode != "" || c.BondName != "" {
+			return fmt.Errorf("slaves, bondMode and bondName require mode %q", modeBond)
+		}
+		if c.Local != "" || c.Remote != "" || c.Key != 0 || c.TunnelName != "" {
+			return fmt.Errorf("local, remote, key and tunnelName require a tunnel mode")
+		}
+		if c.VNI != 0 || c.Group != "" || c.Dev != "" {
+			return fmt.Errorf("vni, group and dev require mode %q", modeVXLAN)
+		}
+	case modeBond:
+		if len(c.Slaves) == 0 {
+			return fmt.Errorf("mode %q requires at least one slave", modeBond)
+		}
+		if c.BondMode != "" && netlink.StringToBondMode(c.BondMode) == netlink.BOND_MODE_UNKNOWN {
+			return fmt.Errorf("invalid bond mode %q", c.BondMode)
+		}
+		if c.BondName != "" && len(c.BondName) > unix.IFNAMSIZ-1 {
+			return fmt.Errorf("invalid bond name %q", c.BondName)
+		}
+	case modeGRE, modeIPIP, modeVXLAN:
+		if err := c.validateTunnel(); err != nil {
+			return err
+		}
+		// only the VXLAN tunnels carry Ethernet frames
+		if c.Mode != modeVXLAN && (c.Promisc || c.AllMulti) {
+			return fmt.Errorf("promisc and allmulti are not supported in mode %q", c.Mode)
+		}
+		if c.TunnelName != "" && len(c.TunnelName) > unix.IFNAMSIZ-1 {
+			return fmt.Errorf("invalid tunnel name %q", c.TunnelName)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	return nil
+}
+
+// namespace returns the network namespace to attach the interface, the Pod
+// network namespace podNs unless other is configured.
+func (c *NetworkConfig) namespace(podNs string) string {
+	if c.isHostTarget() {
+		return hostNetNSPath
+	}
+	if c != nil && c.NetNS != "" {
+		return c.NetNS
+	}
+	return podNs
+}
+
+// isHostTarget returns true if the device is configured on the host.
+func (c *NetworkConfig) isHostTarget() bool {
+	return c != nil && c.Target == targetHost
+}
+
+// interfaceNames returns the names of the interfaces inside the Pod by request.
+func (c *NetworkConfig) interfaceNames() map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.Interfaces
+}
+
+// interfaceName returns the name inside the Pod of the device of the request,
+// the name of the device if it is not configured.
+func (c *NetworkConfig) interfaceName(request string, device string) string {
+	if name, ok := c.interfaceNames()[request]; ok {
+		return name
+	}
+	return device
+}
+
+// carrierTimeout returns the time to wait for the interface to get carrier.
+func (c *NetworkConfig) carrierTimeout() time.Duration {
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return defaultCarrierTimeout
+	}
+	return timeout
+}
+
+// selectsHardware returns true if the device is selected by its hardware
+// address instead of by its name.
+func (c *NetworkConfig) selectsHardware() bool {
+	return c != nil && (c.MACAddress != "" || c.PCIAddress != "")
+}
+
+// bondName returns the name of the bond inside the Pod network namespace.
+func (c *NetworkConfig) bondName() string {
+	if c.BondName != "" {
+		return c.BondName
+	}
+	return defaultBondName
+}
+
+// concatLists sets the lists that are concatenated on merge to the lists of the
+// previous entries prev followed by the lists of the entry.
+func (c *NetworkConfig) concatLists(prev NetworkConfig, entry NetworkConfig) {
+	c.IPv4 = slices.Concat(prev.IPv4, entry.IPv4)
+	c.IPv6 = slices.Concat(prev.IPv6, entry.IPv6)
+	c.SecondaryIPs = slices.Concat(prev.SecondaryIPs, entry.SecondaryIPs)
+	c.Routes = slices.Concat(prev.Routes, entry.Routes)
+	c.Rules = slices.Concat(prev.Rules, entry.Rules)
+	c.Neighbors = slices.Concat(prev.Neighbors, entry.Neighbors)
+}
+
+// deviceConfig returns the opaque configuration addressed to this driver that
+// applies to the request, or nil if there is none. The configuration for other
+// drivers is ignored, it may not even be valid for this driver.
+func (np *NetworkPlugin) deviceConfig(allocation resourceapi.AllocationResult, requestName string) (*NetworkConfig, error) {
+	var config *NetworkConfig
+	for _, c := range allocation.Devices.Config {
+		if c.Opaque == nil ||
+			c.Opaque.Driver != np.driverName ||
+			len(c.Requests) > 0 && !slices.Contains(c.Requests, requestName) {
+			continue
+		}
+		if config == nil {
+			config = &NetworkConfig{}
+		}
+		// the lists of the entry are obtained on their own to concatenate them
+		entry := NetworkConfig{}
+		if err := json.Unmarshal(c.Opaque.Parameters.Raw, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse config for request %s: %w", requestName, err)
+		}
+		prev := *config
+		// decoding into the lists of the previous entries overwrites them
+		config.IPv4, config.IPv6, config.SecondaryIPs = nil, nil, nil
+		config.Routes, config.Rules, config.Neighbors = nil, nil, nil
+		if err := json.Unmarshal(c.Opaque.Parameters.Raw, config); err != nil {
+			return nil, fmt.Errorf("failed to parse config for request %s: %w", requestName, err)
+		}
+		config.concatLists(prev, entry)
+	}
+	if config == nil {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for request %s: %w", requestName, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,290 @@
+package dra
+
+import (
+	"reflect"
+	"testing"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDefaultRouteFamily(t *testing.T) {
+	v4Default := RouteConfig{Destination: "0.0.0.0/0", Gateway: "192.168.1.1"}
+	v6Default := RouteConfig{Destination: "::/0", Gateway: "fd00::1"}
+	v4Route := RouteConfig{Destination: "10.0.0.0/8", Gateway: "192.168.1.1"}
+	tests := []struct {
+		name    string
+		config  NetworkConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "unset dual-stack defaults to v4",
+			config: NetworkConfig{Routes: []RouteConfig{v4Default, v6Default}},
+			want:   familyV4,
+		},
+		{
+			name:   "unset only v4",
+			config: NetworkConfig{Routes: []RouteConfig{v4Default}},
+		},
+		{
+			name:   "unset only v6",
+			config: NetworkConfig{Routes: []RouteConfig{v6Default, v4Route}},
+		},
+		{
+			name:   "unset without default routes",
+			config: NetworkConfig{Routes: []RouteConfig{v4Route}},
+		},
+		{
+			name:   "v4",
+			config: NetworkConfig{DefaultRouteFamily: familyV4, Routes: []RouteConfig{v4Default, v6Default}},
+			want:   familyV4,
+		},
+		{
+			name:   "v6",
+			config: NetworkConfig{DefaultRouteFamily: familyV6, Routes: []RouteConfig{v4Default, v6Default}},
+			want:   familyV6,
+		},
+		{
+			name:    "v6 without a v6 gateway",
+			config:  NetworkConfig{DefaultRouteFamily: familyV6, Routes: []RouteConfig{v4Default}},
+			want:    familyV6,
+			wantErr: true,
+		},
+		{
+			name:    "v4 without a v4 gateway",
+			config:  NetworkConfig{DefaultRouteFamily: familyV4, Routes: []RouteConfig{v6Default, v4Route}},
+			want:    familyV4,
+			wantErr: true,
+		},
+		{
+			name:    "invalid family",
+			config:  NetworkConfig{DefaultRouteFamily: "ipv4", Routes: []RouteConfig{v4Default}},
+			want:    "ipv4",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := tt.config.defaultRouteFamily(); got != tt.want {
+				t.Errorf("defaultRouteFamily() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceConfigMerge(t *testing.T) {
+	opaque := func(driver string, parameters string, requests ...string) resourceapi.DeviceAllocationConfiguration {
+		return resourceapi.DeviceAllocationConfiguration{
+			Source:   resourceapi.AllocationConfigSourceClaim,
+			Requests: requests,
+			DeviceConfiguration: resourceapi.DeviceConfiguration{
+				Opaque: &resourceapi.OpaqueDeviceConfiguration{
+					Driver:     driver,
+					Parameters: runtime.RawExtension{Raw: []byte(parameters)},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		config  []resourceapi.DeviceAllocationConfiguration
+		want    *NetworkConfig
+		wantErr bool
+	}{
+		{
+			name: "no config",
+		},
+		{
+			name: "other driver and request",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("other.net", `{"ipv4":["192.168.1.2/24"]}`),
+				opaque("dra.net", `{"ipv4":["192.168.2.2/24"]}`, "other"),
+			},
+		},
+		{
+			name: "class and claim entries",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("dra.net", `{"sysctls":{"net.ipv4.conf.IFNAME.rp_filter":"0","net.ipv6.conf.IFNAME.disable_ipv6":"1"},"ipv4":["192.168.1.2/24"],"interfaces":{"req-eth1":"net1"}}`),
+				opaque("dra.net", `{"sysctls":{"net.ipv6.conf.IFNAME.disable_ipv6":"0"},"ipv4":["192.168.2.2/24"],"interfaces":{"req-eth1":"net2"}}`, "req-eth1"),
+			},
+			want: &NetworkConfig{
+				Sysctls:    map[string]string{"net.ipv4.conf.IFNAME.rp_filter": "0", "net.ipv6.conf.IFNAME.disable_ipv6": "0"},
+				IPv4:       []string{"192.168.1.2/24", "192.168.2.2/24"},
+				Interfaces: map[string]string{"req-eth1": "net2"},
+			},
+		},
+		{
+			name: "routes concatenated",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("dra.net", `{"ipv4":["192.168.1.2/24"],"routes":[{"destination":"10.0.0.0/8","gateway":"192.168.1.1"}]}`),
+				opaque("dra.net", `{"routes":[{"destination":"172.16.0.0/12","gateway":"192.168.1.1"}]}`),
+			},
+			want: &NetworkConfig{
+				IPv4: []string{"192.168.1.2/24"},
+				Routes: []RouteConfig{
+					{Destination: "10.0.0.0/8", Gateway: "192.168.1.1"},
+					{Destination: "172.16.0.0/12", Gateway: "192.168.1.1"},
+				},
+			},
+		},
+		{
+			name: "secondary addresses concatenated",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("dra.net", `{"secondaryIps":["192.168.1.2/24","fd00::2/64"]}`),
+				opaque("dra.net", `{"secondaryIps":["192.168.1.3/24"]}`),
+			},
+			// the addresses of the later entry do not overwrite the previous ones
+			want: &NetworkConfig{
+				SecondaryIPs: []string{"192.168.1.2/24", "fd00::2/64", "192.168.1.3/24"},
+			},
+		},
+		{
+			name: "invalid entry",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("dra.net", `{"ipv4":["192.168.1.2/24"]}`),
+				opaque("dra.net", `{"ipv4":"192.168.2.2/24"}`),
+			},
+			wantErr: true,
+		},
+	}
+	np := &NetworkPlugin{driverName: "dra.net"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocation := newAllocation("dra.net", "eth1")
+			allocation.Devices.Config = tt.config
+			got, err := np.deviceConfig(allocation, "req-eth1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deviceConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deviceConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  NetworkConfig
+		wantErr bool
+	}{
+		{
+			name:   "unlimited",
+			config: NetworkConfig{},
+		},
+		{
+			name:   "limited",
+			config: NetworkConfig{IngressMbps: 1000, EgressMbps: 1000},
+		},
+		{
+			name:   "maximum ingress",
+			config: NetworkConfig{IngressMbps: maxIngressMbps},
+		},
+		{
+			name:    "ingress too high",
+			config:  NetworkConfig{IngressMbps: maxIngressMbps + 1},
+			wantErr: true,
+		},
+		{
+			name:    "negative ingress",
+			config:  NetworkConfig{IngressMbps: -1},
+			wantErr: true,
+		},
+		{
+			name:    "negative egress",
+			config:  NetworkConfig{EgressMbps: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   RouteConfig
+		wantErr bool
+	}{
+		{
+			name:  "gateway",
+			route: RouteConfig{Destination: "10.0.0.0/8", Gateway: "192.168.1.1"},
+		},
+		{
+			name:  "ECMP next hops",
+			route: RouteConfig{Destination: "10.0.0.0/8", Gateways: []string{"192.168.1.1", "192.168.1.3"}},
+		},
+		{
+			name:    "invalid next hop",
+			route:   RouteConfig{Destination: "10.0.0.0/8", Gateways: []string{"192.168.1.1", "192.168.1"}},
+			wantErr: true,
+		},
+		{
+			name:    "next hops of both families",
+			route:   RouteConfig{Destination: "10.0.0.0/8", Gateways: []string{"192.168.1.1", "fd00::1"}},
+			wantErr: true,
+		},
+		{
+			name:    "repeated next hop",
+			route:   RouteConfig{Destination: "10.0.0.0/8", Gateways: []string{"192.168.1.1", "192.168.1.1"}},
+			wantErr: true,
+		},
+		{
+			name:    "gateway and next hops",
+			route:   RouteConfig{Destination: "10.0.0.0/8", Gateway: "192.168.1.1", Gateways: []string{"192.168.1.3"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NetworkConfig{Routes: []RouteConfig{tt.route}}
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNoBringUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  NetworkConfig
+		wantErr bool
+	}{
+		{
+			name:   "no bring up",
+			config: NetworkConfig{NoBringUp: true},
+		},
+		{
+			name:   "with namespace and dry run",
+			config: NetworkConfig{NoBringUp: true, NetNS: "/var/run/netns/test", DryRun: true},
+		},
+		{
+			name:    "with addresses",
+			config:  NetworkConfig{NoBringUp: true, IPv4: []string{"192.168.1.2/24"}},
+			wantErr: true,
+		},
+		{
+			name:    "with promisc",
+			config:  NetworkConfig{NoBringUp: true, Promisc: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
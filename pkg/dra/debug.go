@@ -0,0 +1,52 @@
+package dra
+
+import (
+	"encoding/json"
+	"net/http"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// allocationInfo is an allocation stored by the driver and the names of the
+// devices allocated to this driver.
+type allocationInfo struct {
+	Devices    []string                     `json:"devices"`
+	Allocation resourceapi.AllocationResult `json:"allocation"`
+}
+
+// allocationsDump is the internal allocation state, by Pod UID and by claim UID.
+type allocationsDump struct {
+	Pods   map[types.UID]allocationInfo `json:"pods"`
+	Claims map[types.UID]allocationInfo `json:"claims"`
+}
+
+// AllocationsHandler returns an HTTP handler that dumps the allocations the
+// driver stores as JSON, to debug which devices the driver considers attached.
+// The handler is served on the node local metrics server so nothing is redacted.
+func (np *NetworkPlugin) AllocationsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dump := allocationsDump{
+			Pods:   np.allocationsInfo(np.podAllocations.List()),
+			Claims: np.allocationsInfo(np.claimAllocations.List()),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(dump); err != nil {
+			klog.Infof("failed to write the allocations: %v", err)
+		}
+	})
+}
+
+func (np *NetworkPlugin) allocationsInfo(allocations map[types.UID]resourceapi.AllocationResult) map[types.UID]allocationInfo {
+	info := make(map[types.UID]allocationInfo, len(allocations))
+	for uid, allocation := range allocations {
+		info[uid] = allocationInfo{
+			Devices:    np.allocatedDevices(allocation),
+			Allocation: allocation,
+		}
+	}
+	return info
+}
@@ -0,0 +1,270 @@
+package dra
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+)
+
+// Minimal DHCPv6 client to obtain a non temporary address for an interface.
+// https://www.rfc-editor.org/rfc/rfc8415
+const (
+	dhcpv6ClientPort = 546
+	dhcpv6ServerPort = 547
+
+	dhcpv6Solicit   = 1
+	dhcpv6Advertise = 2
+	dhcpv6Request   = 3
+	dhcpv6Reply     = 7
+	dhcpv6Release   = 8
+
+	dhcpv6OptClientID     = 1
+	dhcpv6OptServerID     = 2
+	dhcpv6OptIANA         = 3
+	dhcpv6OptIAAddr       = 5
+	dhcpv6OptElapsedTime  = 8
+	dhcpv6OptStatusCode   = 13
+	dhcpv6OptRapidCommit  = 14
+	dhcpv6DUIDLinkLayer   = 3
+	dhcpv6HwTypeEthernet  = 1
+	dhcpv6RetransmitDelay = 1 * time.Second
+	dhcpv6Timeout         = 10 * time.Second
+)
+
+var dhcpv6AllServers = net.ParseIP("ff02::1:2")
+
+// dhcpv6Lease is the address leased by a DHCPv6 server.
+type dhcpv6Lease struct {
+	ClientID  []byte
+	ServerID  []byte
+	IAID      uint32
+	Address   net.IP
+	Preferred uint32
+	Valid     uint32
+}
+
+type dhcpv6Option struct {
+	code uint16
+	data []byte
+}
+
+func dhcpv6MarshalOptions(options []dhcpv6Option) []byte {
+	var buf bytes.Buffer
+	for _, o := range options {
+		_ = binary.Write(&buf, binary.BigEndian, o.code)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(o.data)))
+		buf.Write(o.data)
+	}
+	return buf.Bytes()
+}
+
+func dhcpv6Marshal(msgType byte, xid []byte, options []dhcpv6Option) []byte {
+	msg := append([]byte{msgType}, xid...)
+	return append(msg, dhcpv6MarshalOptions(options)...)
+}
+
+func dhcpv6ParseOptions(b []byte) ([]dhcpv6Option, error) {
+	var options []dhcpv6Option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated option")
+		}
+		code := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		options = append(options, dhcpv6Option{code: code, data: b[4 : 4+length]})
+		b = b[4+length:]
+	}
+	return options, nil
+}
+
+func dhcpv6IANA(iaid uint32, addr net.IP) dhcpv6Option {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], iaid)
+	if addr != nil {
+		iaAddr := make([]byte, 24)
+		copy(iaAddr[0:16], addr.To16())
+		data = append(data, dhcpv6MarshalOptions([]dhcpv6Option{{code: dhcpv6OptIAAddr, data: iaAddr}})...)
+	}
+	return dhcpv6Option{code: dhcpv6OptIANA, data: data}
+}
+
+// dhcpv6ParseReply returns the lease from an Advertise or Reply message.
+func dhcpv6ParseReply(msg []byte, xid []byte, lease *dhcpv6Lease) (byte, error) {
+	if len(msg) < 4 || !bytes.Equal(msg[1:4], xid) {
+		return 0, fmt.Errorf("unexpected message")
+	}
+	options, err := dhcpv6ParseOptions(msg[4:])
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range options {
+		switch o.code {
+		case dhcpv6OptServerID:
+			lease.ServerID = bytes.Clone(o.data)
+		case dhcpv6OptStatusCode:
+			if len(o.data) >= 2 && binary.BigEndian.Uint16(o.data[0:2]) != 0 {
+				return 0, fmt.Errorf("server returned status %d: %s", binary.BigEndian.Uint16(o.data[0:2]), string(o.data[2:]))
+			}
+		case dhcpv6OptIANA:
+			if len(o.data) < 12 || binary.BigEndian.Uint32(o.data[0:4]) != lease.IAID {
+				continue
+			}
+			iaOptions, err := dhcpv6ParseOptions(o.data[12:])
+			if err != nil {
+				return 0, err
+			}
+			for _, iaOpt := range iaOptions {
+				switch iaOpt.code {
+				case dhcpv6OptIAAddr:
+					if len(iaOpt.data) < 24 {
+						continue
+					}
+					lease.Address = net.IP(bytes.Clone(iaOpt.data[0:16]))
+					lease.Preferred = binary.BigEndian.Uint32(iaOpt.data[16:20])
+					lease.Valid = binary.BigEndian.Uint32(iaOpt.data[20:24])
+				case dhcpv6OptStatusCode:
+					if len(iaOpt.data) >= 2 && binary.BigEndian.Uint16(iaOpt.data[0:2]) != 0 {
+						return 0, fmt.Errorf("server returned status %d: %s", binary.BigEndian.Uint16(iaOpt.data[0:2]), string(iaOpt.data[2:]))
+					}
+				}
+			}
+		}
+	}
+	return msg[0], nil
+}
+
+// dhcpv6Exchange sends the message and waits for a response, retransmitting
+// the message until the response is received or the timeout expires.
+func dhcpv6Exchange(conn *net.UDPConn, dst *net.UDPAddr, msg []byte, xid []byte, lease *dhcpv6Lease, timeout time.Duration) (byte, error) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(msg, dst); err != nil {
+			return 0, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(dhcpv6RetransmitDelay))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			msgType, err := dhcpv6ParseReply(buf[:n], xid, lease)
+			if err != nil {
+				klog.V(4).Infof("discarding DHCPv6 message: %v", err)
+				continue
+			}
+			return msgType, nil
+		}
+	}
+	return 0, fmt.Errorf("timeout waiting for DHCPv6 server")
+}
+
+func dhcpv6Conn(link netlink.Link) (*net.UDPConn, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			return net.ListenUDP("udp6", &net.UDPAddr{IP: addr.IP, Port: dhcpv6ClientPort, Zone: link.Attrs().Name})
+		}
+	}
+	return nil, fmt.Errorf("no link-local address on %s", link.Attrs().Name)
+}
+
+// dhcpv6Acquire obtains an address for the link, it has to be executed inside
+// the network namespace of the link once the link-local address is ready.
+func dhcpv6Acquire(link netlink.Link) (*dhcpv6Lease, error) {
+	if err := waitForDAD(link, dadTimeout); err != nil {
+		return nil, err
+	}
+	conn, err := dhcpv6Conn(link)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: dhcpv6AllServers, Port: dhcpv6ServerPort, Zone: link.Attrs().Name}
+
+	// DUID based on the link layer address
+	clientID := make([]byte, 4)
+	binary.BigEndian.PutUint16(clientID[0:2], dhcpv6DUIDLinkLayer)
+	binary.BigEndian.PutUint16(clientID[2:4], dhcpv6HwTypeEthernet)
+	clientID = append(clientID, link.Attrs().HardwareAddr...)
+	lease := &dhcpv6Lease{
+		ClientID: clientID,
+		IAID:     uint32(link.Attrs().Index),
+	}
+
+	xid := make([]byte, 3)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, err
+	}
+	solicit := dhcpv6Marshal(dhcpv6Solicit, xid, []dhcpv6Option{
+		{code: dhcpv6OptClientID, data: lease.ClientID},
+		{code: dhcpv6OptElapsedTime, data: []byte{0, 0}},
+		{code: dhcpv6OptRapidCommit},
+		dhcpv6IANA(lease.IAID, nil),
+	})
+	msgType, err := dhcpv6Exchange(conn, dst, solicit, xid, lease, dhcpv6Timeout)
+	if err != nil {
+		return nil, err
+	}
+	// the server may commit the address directly if supports rapid commit
+	if msgType == dhcpv6Advertise {
+		if _, err := rand.Read(xid); err != nil {
+			return nil, err
+		}
+		request := dhcpv6Marshal(dhcpv6Request, xid, []dhcpv6Option{
+			{code: dhcpv6OptClientID, data: lease.ClientID},
+			{code: dhcpv6OptServerID, data: lease.ServerID},
+			{code: dhcpv6OptElapsedTime, data: []byte{0, 0}},
+			dhcpv6IANA(lease.IAID, lease.Address),
+		})
+		msgType, err = dhcpv6Exchange(conn, dst, request, xid, lease, dhcpv6Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if msgType != dhcpv6Reply || lease.Address == nil {
+		return nil, fmt.Errorf("DHCPv6 server did not assign an address")
+	}
+	return lease, nil
+}
+
+// dhcpv6ReleaseLease releases the lease, it has to be executed inside the
+// network namespace of the link.
+func dhcpv6ReleaseLease(link netlink.Link, lease *dhcpv6Lease) error {
+	conn, err := dhcpv6Conn(link)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: dhcpv6AllServers, Port: dhcpv6ServerPort, Zone: link.Attrs().Name}
+
+	xid := make([]byte, 3)
+	if _, err := rand.Read(xid); err != nil {
+		return err
+	}
+	release := dhcpv6Marshal(dhcpv6Release, xid, []dhcpv6Option{
+		{code: dhcpv6OptClientID, data: lease.ClientID},
+		{code: dhcpv6OptServerID, data: lease.ServerID},
+		{code: dhcpv6OptElapsedTime, data: []byte{0, 0}},
+		dhcpv6IANA(lease.IAID, lease.Address),
+	})
+	_, err = dhcpv6Exchange(conn, dst, release, xid, &dhcpv6Lease{IAID: lease.IAID}, dhcpv6RetransmitDelay*3)
+	return err
+}
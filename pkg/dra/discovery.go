@@ -0,0 +1,572 @@
+package dra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/Mellanox/rdmamap"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// gceMetadataTimeout bounds the time to fetch the GCE metadata, the devices
+// are published without the GCE attributes if the metadata server does not
+// answer. It is a variable so the tests do not wait for it.
+var gceMetadataTimeout = 5 * time.Second
+
+// cloudProviderGCE is the cloud provider of the devices with GCE metadata.
+const cloudProviderGCE = "gce"
+
+// gvnicDriver is the kernel driver of the Google Virtual NIC.
+const gvnicDriver = "gve"
+
+// getGCEInterfaces returns the network interfaces from the google compute
+// instance metadata, it returns nil if not running on GCE.
+// https://cloud.google.com/compute/docs/metadata/predefined-metadata-keys
+func getGCEInterfaces(ctx context.Context) []gceNetworkInterface {
+	var gceInterfaces []gceNetworkInterface
+	if metadata.OnGCE() {
+		ctx, cancel := context.WithTimeout(ctx, gceMetadataTimeout)
+		defer cancel()
+
+		instanceName, err := metadata.InstanceNameWithContext(ctx)
+		if err != nil {
+			klog.Infof("could not get instance name on GCE .... skipping GCE network interface attributes: %v", err)
+		} else {
+			klog.Infof("Getting GCE network interface attributes for instance %s", instanceName)
+		}
+
+		// projects/<project>/machineTypes/<machine type>, the accelerator
+		// optimized machines, per example a3-highgpu-8g, have high performance
+		// NICs for the GPU traffic
+		instanceType, err := metadata.GetWithContext(ctx, "instance/machine-type")
+		if err != nil {
+			klog.Infof("could not get instance type on GCE .... skipping GCE machine type attribute: %v", err)
+		} else {
+			klog.Infof("Getting GCE accelerator attributes for instance type %s", instanceType)
+		}
+
+		//  curl "http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/?recursive=true" -H "Metadata-Flavor: Google"
+		// [{"accessConfigs":[{"externalIp":"35.225.164.134","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"10.128.0.1","ip":"10.128.0.70","ipAliases":["10.24.3.0/24"],"mac":"42:01:0a:80:00:46","mtu":1460,"network":"projects/628944397724/networks/default","subnetmask":"255.255.240.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.1.1","ip":"192.168.1.2","ipAliases":[],"mac":"42:01:c0:a8:01:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-1","subnetmask":"255.255.255.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.2.1","ip":"192.168.2.2","ipAliases":[],"mac":"42:01:c0:a8:02:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-2","subnetmask":"255.255.255.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.3.1","ip":"192.168.3.2","ipAliases":[],"mac":"42:01:c0:a8:03:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-3","subnetmask":"255.255.255.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.4.1","ip":"192.168.4.2","ipAliases":[],"mac":"42:01:c0:a8:04:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-4","subnetmask":"255.255.255.0","targetInstanceIps":[]}]
+		gceInterfacesRaw, err := metadata.GetWithContext(ctx, "instance/network-interfaces/?recursive=true&alt=json")
+		if err != nil {
+			klog.Infof("could not get network interfaces on GCE .... skipping GCE network interface attributes: %v", err)
+		} else {
+			klog.Infof("Getting GCE accelerator attributes for instance type %s", instanceType)
+			if err = json.Unmarshal([]byte(gceInterfacesRaw), &gceInterfaces); err != nil {
+				klog.Infof("could not get network interfaces on GCE .... skipping GCE network interface attributes: %v", err)
+			}
+			if instanceType != "" {
+				for i := range gceInterfaces {
+					gceInterfaces[i].MachineType = path.Base(instanceType)
+				}
+			}
+		}
+	}
+	return gceInterfaces
+}
+
+// gceMetadataTTL is the time the GCE network interfaces are cached, the
+// metadata changes when network interfaces are attached to the instance.
+const gceMetadataTTL = 5 * time.Minute
+
+// gceInterfacesCache caches the GCE network interfaces, to avoid fetching the
+// metadata on every publish cycle.
+type gceInterfacesCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	expiration time.Time
+	interfaces []gceNetworkInterface
+	// fetch gets the interfaces from the metadata server
+	fetch func(ctx context.Context) []gceNetworkInterface
+}
+
+// Get returns the cached GCE network interfaces, they are fetched again from
+// the metadata server once the cache expires.
+func (c *gceInterfacesCache) Get(ctx context.Context) []gceNetworkInterface {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.expiration) {
+		return c.interfaces
+	}
+	c.interfaces = c.fetch(ctx)
+	c.expiration = time.Now().Add(c.ttl)
+	return c.interfaces
+}
+
+// discoverDevices returns the network interfaces on the host that can be
+// published as devices.
+func (np *NetworkPlugin) discoverDevices(gceInterfaces []gceNetworkInterface) []resourceapi.Device {
+	var devices []resourceapi.Device
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		klog.Infof("error getting system interfaces: %v", err)
+	}
+	routeLinks, err := defaultRouteLinks()
+	if err != nil {
+		klog.Infof("error getting the default routes: %v", err)
+	}
+	allocatedLinks := np.allocatedLinks()
+	// the GCE network interfaces are matched by MAC, the bonds, VLANs and
+	// cloned interfaces share the MAC so the match is ambiguous
+	duplicatedMACs := duplicatedMACs(ifaces)
+	// the interfaces not published are counted by reason for the summary
+	skipped := map[string]int{}
+	for _, iface := range ifaces {
+		klog.V(7).Infof("Checking iface %s", iface.Name)
+		link, reason := np.interfaceSkipReason(iface, routeLinks)
+		if reason != "" {
+			skipped[reason]++
+			continue
+		}
+		deviceGCEInterfaces := gceInterfaces
+		if mac := normalizeMAC(iface.HardwareAddr.String()); len(gceInterfaces) > 0 && duplicatedMACs[mac] {
+			klog.Warningf("iface %s shares the MAC %s with other interfaces, skipping GCE network interface attributes", iface.Name, mac)
+			deviceGCEInterfaces = nil
+		}
+		device := buildDevice(iface, link, deviceGCEInterfaces)
+		if np.publishStats {
+			addStatsAttributes(device, link)
+		}
+		addVFCapacity(device, iface.Name, allocatedLinks)
+
+		// only publish the interfaces on the allowed GCE networks
+		if len(np.gceNetworks) > 0 {
+			var network string
+			if attr, ok := device.Basic.Attributes["gceNetwork"]; ok {
+				network = *attr.StringValue
+			}
+			if !np.gceNetworkAllowed(network) {
+				klog.V(2).Infof("iface %s on GCE network %q filtered by the GCE networks allowlist", iface.Name, network)
+				skipped["gce_network"]++
+				continue
+			}
+		}
+		devices = append(devices, device)
+		if np.sriovPartitions && sriovTotalVFs(iface.Name) > 0 {
+			devices = append(devices, partitionDevices(iface.Name)...)
+		}
+	}
+	recordNetworkDevices(devices, allocatedLinks)
+	np.logDiscoverySummary(len(devices), skipped)
+	return devices
+}
+
+// interfaceSkipReason returns the link of the interface and the reason it is
+// not published, or an empty reason if it can be published. The reasons are
+// the keys of the discovery summary.
+func (np *NetworkPlugin) interfaceSkipReason(iface net.Interface, routeLinks map[int]bool) (netlink.Link, string) {
+	// skip default interface
+	if iface.Name == np.ifaceGw {
+		return nil, "gateway"
+	}
+	// only interested in interfaces that match the regex
+	if len(validation.IsDNS1123Label(iface.Name)) > 0 {
+		klog.V(2).Infof("iface %s does not pass validation", iface.Name)
+		return nil, "invalid_name"
+	}
+	// skip loopback interface
+	if iface.Flags&net.FlagLoopback == net.FlagLoopback {
+		return nil, "loopback"
+	}
+	if np.interfaceFilter != nil && !np.interfaceFilter.MatchString(iface.Name) {
+		klog.V(2).Infof("iface %s does not match the interface filter", iface.Name)
+		return nil, "filter"
+	}
+	if np.reserved.Has(iface.Name) {
+		klog.V(2).Infof("iface %s is reserved for the node", iface.Name)
+		return nil, "reserved"
+	}
+	if partition, ok := np.partitions.Owner(iface.Name); ok {
+		klog.V(2).Infof("iface %s is the VF of the partition %s", iface.Name, partition)
+		return nil, "partition"
+	}
+
+	link, err := netlink.LinkByName(iface.Name)
+	if err != nil {
+		klog.Infof("Error getting link by name %v", err)
+		return nil, "link_error"
+	}
+	if reason := np.linkSkipReason(iface, link, routeLinks); reason != "" {
+		return nil, reason
+	}
+	return link, ""
+}
+
+// linkSkipReason returns the reason to not publish the link of the interface,
+// or an empty string if it is published.
+func (np *NetworkPlugin) linkSkipReason(iface net.Interface, link netlink.Link, routeLinks map[int]bool) string {
+	switch link := link.(type) {
+	case *netlink.Veth:
+		// TODO improve this heuristic to detect veth associated to Pods
+		// link.PeerNamespace maybe
+		if link.PeerName == "eth0" {
+			return "veth"
+		}
+		// Skip all veth interfaces
+		return "veth"
+	default:
+	}
+	// the slaves of a bond, bridge or team can not be moved independently
+	if master := link.Attrs().MasterIndex; master != 0 && !np.allowEnslavedInterfaces {
+		klog.V(2).Infof("iface %s is enslaved to interface index %d", iface.Name, master)
+		return "enslaved"
+	}
+	// allocating the interfaces used by the node breaks its connectivity
+	if reason := np.unsafeInterfaceReason(iface, routeLinks); reason != "" {
+		if !np.allowUnsafeInterfaces {
+			klog.V(2).Infof("iface %s is not safe to publish: %s", iface.Name, reason)
+			return "unsafe"
+		}
+		klog.V(2).Infof("iface %s is published but it is not safe: %s", iface.Name, reason)
+	}
+	// the interfaces without link are republished once they come up,
+	// through the netlink notifications
+	if np.publishOnlyUp && !linkOperUp(link) {
+		klog.V(2).Infof("iface %s operational state is %s", iface.Name, link.Attrs().OperState)
+		return "oper_down"
+	}
+	return ""
+}
+
+// findGCEInterface returns the GCE network interface with the MAC address,
+// the addresses are compared in their canonical format.
+func findGCEInterface(gceInterfaces []gceNetworkInterface, mac string) (gceNetworkInterface, bool) {
+	mac = normalizeMAC(mac)
+	// this is bounded and small number O(N) is ok
+	for _, gceIf := range gceInterfaces {
+		if normalizeMAC(gceIf.Mac) == mac {
+			return gceIf, true
+		}
+	}
+	return gceNetworkInterface{}, false
+}
+
+// duplicatedMACs returns the MAC addresses used by more than one interface.
+func duplicatedMACs(ifaces []net.Interface) map[string]bool {
+	count := map[string]int{}
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		count[normalizeMAC(iface.HardwareAddr.String())]++
+	}
+	duplicated := map[string]bool{}
+	for mac, n := range count {
+		if n > 1 {
+			duplicated[mac] = true
+		}
+	}
+	return duplicated
+}
+
+// logDiscoverySummary logs a line with the number of devices discovered and
+// the interfaces skipped by reason. The summary is logged at the default
+// verbosity only if it changed since the last discovery, to not flood the logs
+// on every publish cycle, the details of each interface are logged at higher
+// verbosity.
+func (np *NetworkPlugin) logDiscoverySummary(devices int, skipped map[string]int) {
+	total := 0
+	var reasons []string
+	for reason, count := range skipped {
+		total += count
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+	}
+	sort.Strings(reasons)
+	summary := fmt.Sprintf("Discovered %d devices, skipped %d interfaces [%s]", devices, total, strings.Join(reasons, " "))
+	if summary == np.lastDiscoverySummary {
+		klog.V(4).Info(summary)
+		return
+	}
+	np.lastDiscoverySummary = summary
+	klog.Info(summary)
+}
+
+// unsafeInterfaceReason returns why the interface is not safe to publish, or
+// an empty string if it is safe. The interfaces with a default route or with
+// the node addresses are used by the node.
+func (np *NetworkPlugin) unsafeInterfaceReason(iface net.Interface, routeLinks map[int]bool) string {
+	if routeLinks[iface.Index] {
+		return "it has a default route"
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, nodeIP := range np.nodeIPs {
+			if ipNet.IP.Equal(nodeIP) {
+				return fmt.Sprintf("it has the node address %s", nodeIP)
+			}
+		}
+	}
+	return ""
+}
+
+// addStatsAttributes adds the traffic counters of the link to the device, the
+// counters change constantly so the resources are published on every cycle.
+func addStatsAttributes(device resourceapi.Device, link netlink.Link) {
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return
+	}
+	for name, value := range map[resourceapi.QualifiedName]uint64{
+		"rx_bytes":  stats.RxBytes,
+		"tx_bytes":  stats.TxBytes,
+		"rx_errors": stats.RxErrors,
+		"tx_errors": stats.TxErrors,
+	} {
+		value := int64(value)
+		device.Basic.Attributes[name] = resourceapi.DeviceAttribute{IntValue: &value}
+	}
+}
+
+// buildDevice returns the device with the attributes of the network interface,
+// the gceInterfaces are used to obtain the GCE network the interface belongs to.
+func buildDevice(iface net.Interface, link netlink.Link, gceInterfaces []gceNetworkInterface) resourceapi.Device {
+	device := resourceapi.Device{
+		Name: iface.Name,
+		Basic: &resourceapi.BasicDevice{
+			Attributes: make(map[resourceapi.QualifiedName]resourceapi.DeviceAttribute),
+			Capacity:   make(map[resourceapi.QualifiedName]resource.Quantity),
+		},
+	}
+	device.Basic.Attributes["name"] = resourceapi.DeviceAttribute{StringValue: &iface.Name}
+	uid := deviceUID(iface.Name)
+	device.Basic.Attributes["uid"] = resourceapi.DeviceAttribute{StringValue: &uid}
+
+	// iface attributes
+	linkType := link.Type()
+	linkAttrs := link.Attrs()
+
+	// TODO we can get more info from the kernel
+	// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-net
+	// Ref: https://github.com/canonical/lxd/blob/main/lxd/resources/network.go
+
+	// sriov device plugin has a more detailed and better discovery
+	// https://github.com/k8snetworkplumbingwg/sriov-network-device-plugin/blob/ed1c14dd4c313c7dd9fe4730a60358fbeffbfdd4/cmd/sriovdp/manager.go#L243
+
+	if ips, err := iface.Addrs(); err == nil && len(ips) > 0 {
+		// TODO assume only one addres by now
+		ip := ips[0].String()
+		device.Basic.Attributes["ip"] = resourceapi.DeviceAttribute{StringValue: &ip}
+		mac := normalizeMAC(iface.HardwareAddr.String())
+		device.Basic.Attributes["mac"] = resourceapi.DeviceAttribute{StringValue: &mac}
+		mtu := int64(iface.MTU)
+		device.Basic.Attributes["mtu"] = resourceapi.DeviceAttribute{IntValue: &mtu}
+	}
+
+	// check if there is GCE metadata associated
+	if gceIf, ok := findGCEInterface(gceInterfaces, iface.HardwareAddr.String()); ok {
+		device.Basic.Attributes["gceNetwork"] = resourceapi.DeviceAttribute{StringValue: &gceIf.Network}
+		// the claims select any interface on a network by its name,
+		// the scheduler allocates one of the devices not in use
+		network := path.Base(gceIf.Network)
+		device.Basic.Attributes["cloud_network"] = resourceapi.DeviceAttribute{StringValue: &network}
+		provider := cloudProviderGCE
+		device.Basic.Attributes["cloud_provider"] = resourceapi.DeviceAttribute{StringValue: &provider}
+		if gceIf.MachineType != "" {
+			device.Basic.Attributes["gce_machine_type"] = resourceapi.DeviceAttribute{StringValue: &gceIf.MachineType}
+		}
+		// the gVNIC is the high performance virtual NIC of GCE
+		if info, err := ethtoolDriverInfo(iface.Name); err == nil {
+			gvnic := unix.ByteSliceToString(info.Driver[:]) == gvnicDriver
+			device.Basic.Attributes["gvnic"] = resourceapi.DeviceAttribute{BoolValue: &gvnic}
+		}
+	}
+
+	device.Basic.Attributes["encapsulation"] = resourceapi.DeviceAttribute{StringValue: &linkAttrs.EncapType}
+	operState := linkAttrs.OperState.String()
+	device.Basic.Attributes["state"] = resourceapi.DeviceAttribute{StringValue: &operState}
+	carrier := isCarrierUp(iface.Name)
+	device.Basic.Attributes["carrier"] = resourceapi.DeviceAttribute{BoolValue: &carrier}
+	device.Basic.Attributes["alias"] = resourceapi.DeviceAttribute{StringValue: &linkAttrs.Alias}
+	device.Basic.Attributes["type"] = resourceapi.DeviceAttribute{StringValue: &linkType}
+	if linkAttrs.MasterIndex != 0 {
+		if master, err := netlink.LinkByIndex(linkAttrs.MasterIndex); err == nil {
+			device.Basic.Attributes["enslaved_to"] = resourceapi.DeviceAttribute{StringValue: &master.Attrs().Name}
+		}
+	}
+
+	if info, err := ethtoolDriverInfo(iface.Name); err == nil {
+		// drivers may not report the firmware versions
+		if fwVersion := unix.ByteSliceToString(info.Fw_version[:]); fwVersion != "" {
+			device.Basic.Attributes["fw_version"] = resourceapi.DeviceAttribute{StringValue: &fwVersion}
+		}
+		if eromVersion := unix.ByteSliceToString(info.Erom_version[:]); eromVersion != "" {
+			device.Basic.Attributes["erom_version"] = resourceapi.DeviceAttribute{StringValue: &eromVersion}
+		}
+	}
+
+	// claims requiring jumbo frames can filter the devices that support them
+	if minMTU, maxMTU, err := linkMTURange(linkAttrs.Index); err == nil {
+		if minMTU > 0 {
+			minMTU := int64(minMTU)
+			device.Basic.Attributes["min_mtu"] = resourceapi.DeviceAttribute{IntValue: &minMTU}
+		}
+		if maxMTU > 0 {
+			maxMTU := int64(maxMTU)
+			device.Basic.Attributes["max_mtu"] = resourceapi.DeviceAttribute{IntValue: &maxMTU}
+		}
+	}
+
+	// The bandwidth in bits per second allows claims to request a share of
+	// the link, DRA only tracks the consumption, it is not enforced.
+	if speed := linkSpeed(iface.Name); speed > 0 {
+		device.Basic.Capacity["bandwidth"] = *resource.NewQuantity(int64(speed)*1000*1000, resource.DecimalSI)
+	}
+
+	// virtual devices are not backed by a PCI device
+	if vendor, pciDevice, err := pciIDs(iface.Name); err == nil {
+		device.Basic.Attributes["pci_vendor"] = resourceapi.DeviceAttribute{StringValue: &vendor}
+		device.Basic.Attributes["pci_device"] = resourceapi.DeviceAttribute{StringValue: &pciDevice}
+		if vendorName, ok := pciVendorNames[vendor]; ok {
+			device.Basic.Attributes["pci_vendor_name"] = resourceapi.DeviceAttribute{StringValue: &vendorName}
+		}
+	}
+
+	// the running address can be changed, the permanent address identifies the hardware
+	if permAddr, err := ethtoolPermAddr(iface.Name); err == nil {
+		permanentMac := permAddr.String()
+		device.Basic.Attributes["permanent_mac"] = resourceapi.DeviceAttribute{StringValue: &permanentMac}
+	}
+
+	isRDMA := rdmamap.IsRDmaDeviceForNetdevice(iface.Name)
+	device.Basic.Attributes["rdma"] = resourceapi.DeviceAttribute{BoolValue: &isRDMA}
+	// the RDMA workloads consume GID entries for their addresses, and queue
+	// pairs and completion queues for their connections
+	if isRDMA {
+		if rdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(iface.Name); err == nil {
+			if gids, err := rdmaFreeGIDs(iface.Name, rdmaDev); err == nil {
+				device.Basic.Capacity["rdma_gids"] = *resource.NewQuantity(int64(gids), resource.DecimalSI)
+			}
+			for capacity, limit := range rdmaResourceLimits(rdmaDev) {
+				device.Basic.Capacity[resourceapi.QualifiedName(capacity)] = *resource.NewQuantity(limit, resource.DecimalSI)
+			}
+		}
+	}
+	// InfiniBand devices publish the fabric and the partitions they belong to,
+	// RoCE devices use Ethernet and do not have partitions
+	if isRDMA && linkAttrs.EncapType == "infiniband" {
+		if rdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(iface.Name); err == nil {
+			if guid, err := infinibandNodeGUID(rdmaDev); err == nil {
+				device.Basic.Attributes["ib_node_guid"] = resourceapi.DeviceAttribute{StringValue: &guid}
+			}
+			if pkeys, err := infinibandPKeys(iface.Name, rdmaDev); err == nil && len(pkeys) > 0 {
+				value := strings.Join(pkeys, ",")
+				device.Basic.Attributes["ib_pkeys"] = resourceapi.DeviceAttribute{StringValue: &value}
+			}
+		}
+	}
+	// from https://github.com/k8snetworkplumbingwg/sriov-network-device-plugin/blob/ed1c14dd4c313c7dd9fe4730a60358fbeffbfdd4/pkg/netdevice/netDeviceProvider.go#L99
+	isSRIOV := sriovTotalVFs(iface.Name) > 0
+	device.Basic.Attributes["sriov"] = resourceapi.DeviceAttribute{BoolValue: &isSRIOV}
+	if isSRIOV {
+		vfs := int64(sriovNumVFs(iface.Name))
+		device.Basic.Attributes["sriov_vfs"] = resourceapi.DeviceAttribute{IntValue: &vfs}
+		// the maximum number of VFs is published even if none is created, so
+		// the claims of the VFs created on demand can select the PF
+		device.Basic.Capacity["sriov_totalvfs"] = *resource.NewQuantity(int64(sriovTotalVFs(iface.Name)), resource.DecimalSI)
+	}
+	// the eswitch mode tells if the offloads of the switchdev mode are possible
+	if mode, err := devlinkEswitchMode(iface.Name); err == nil {
+		device.Basic.Attributes["eswitch_mode"] = resourceapi.DeviceAttribute{StringValue: &mode}
+	}
+	// the PTP clients need hardware timestamps and the clock of the device
+	if hwTimestamps, phcIndex, err := ethtoolTimestampInfo(iface.Name); err == nil && hwTimestamps {
+		device.Basic.Attributes["hw_timestamping"] = resourceapi.DeviceAttribute{BoolValue: &hwTimestamps}
+		if phcIndex >= 0 {
+			index := int64(phcIndex)
+			device.Basic.Attributes["ptp_clock_index"] = resourceapi.DeviceAttribute{IntValue: &index}
+		}
+	}
+	// switchdev devices publish the eswitch port, the representors also
+	// publish the virtual function they represent
+	if portName := physPortName(iface.Name); portName != "" {
+		device.Basic.Attributes["phys_port_name"] = resourceapi.DeviceAttribute{StringValue: &portName}
+		if switchID := physSwitchID(iface.Name); switchID != "" {
+			device.Basic.Attributes["phys_switch_id"] = resourceapi.DeviceAttribute{StringValue: &switchID}
+		}
+		if vfAddress, err := representorVF(iface.Name); err == nil {
+			device.Basic.Attributes["representor_for"] = resourceapi.DeviceAttribute{StringValue: &vfAddress}
+		}
+	}
+	// virtual functions publish the physical function they belong to
+	if pfBusInfo, vfID, err := sriovVFInfo(iface.Name); err == nil {
+		device.Basic.Attributes["pf_bus_info"] = resourceapi.DeviceAttribute{StringValue: &pfBusInfo}
+		id := int64(vfID)
+		device.Basic.Attributes["vf_id"] = resourceapi.DeviceAttribute{IntValue: &id}
+	}
+	return device
+}
+
+// deviceUID returns an identifier of the hardware backing the interface that
+// does not depend on the interface name, so claims can select a device even if
+// it is renamed across reboots. It is the hash of the permanent MAC address and
+// the PCI address, the virtual devices have none of them and use their name.
+func deviceUID(name string) string {
+	var identity []string
+	if permAddr, err := ethtoolPermAddr(name); err == nil {
+		identity = append(identity, "mac="+permAddr.String())
+	}
+	if address, err := getPCIAddress(name); err == nil {
+		identity = append(identity, "pci="+address)
+	}
+	if len(identity) == 0 {
+		identity = append(identity, "name="+name)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(identity, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ListDevices runs the device discovery once and returns the devices that the
+// driver would publish, it does not register the driver with the kubelet.
+func ListDevices(ctx context.Context, opts ...Option) ([]resourceapi.Device, error) {
+	plugin := &NetworkPlugin{}
+	for _, o := range opts {
+		o(plugin)
+	}
+	if err := plugin.resolveGatewayInterface(); err != nil {
+		return nil, err
+	}
+	return plugin.discoverDevices(getGCEInterfaces(ctx)), nil
+}
+
+// resolveGatewayInterface detects the interface of the default route, that is
+// never published, unless it is configured. The detection picks the first
+// default route, on multi-homed nodes it may not be the uplink.
+func (np *NetworkPlugin) resolveGatewayInterface() error {
+	if np.ifaceGw != "" {
+		if _, err := netlink.LinkByName(np.ifaceGw); err != nil {
+			return fmt.Errorf("gateway interface %s not found: %w", np.ifaceGw, err)
+		}
+		klog.Infof("Using configured gateway interface %s", np.ifaceGw)
+		return nil
+	}
+	ifaceGw, err := getDefaultGwIf()
+	if err != nil {
+		return fmt.Errorf("failed to get interface for the default route: %v", err)
+	}
+	np.ifaceGw = ifaceGw
+	klog.Infof("Detected gateway interface %s", np.ifaceGw)
+	return nil
+}
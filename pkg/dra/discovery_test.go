@@ -0,0 +1,598 @@
+package dra
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+)
+
+// fakeInterface returns an interface with an index that does not exist, so it
+// does not have addresses.
+func fakeInterface(name string) net.Interface {
+	return net.Interface{Index: 1 << 30, Name: name}
+}
+
+func TestLinkSkipReasonEnslaved(t *testing.T) {
+	tests := []struct {
+		name          string
+		link          netlink.Link
+		allowEnslaved bool
+		want          string
+	}{
+		{
+			name: "not enslaved",
+			link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}},
+		},
+		{
+			name: "bond slave",
+			link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", MasterIndex: 10}},
+			want: "enslaved",
+		},
+		{
+			name:          "bond slave allowed",
+			link:          &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", MasterIndex: 10}},
+			allowEnslaved: true,
+		},
+		{
+			name: "veth",
+			link: &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}, PeerName: "eth0"},
+			want: "veth",
+		},
+		{
+			name:          "veth enslaved to a bridge",
+			link:          &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth1", MasterIndex: 10}},
+			allowEnslaved: true,
+			want:          "veth",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			np := &NetworkPlugin{allowEnslavedInterfaces: tt.allowEnslaved}
+			if got := np.linkSkipReason(fakeInterface(tt.link.Attrs().Name), tt.link, nil); got != tt.want {
+				t.Errorf("linkSkipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkSkipReasonOperState(t *testing.T) {
+	tests := []struct {
+		name          string
+		attrs         netlink.LinkAttrs
+		publishOnlyUp bool
+		want          string
+	}{
+		{
+			name:  "down published by default",
+			attrs: netlink.LinkAttrs{Name: "eth1", OperState: netlink.OperDown},
+		},
+		{
+			name:          "up",
+			attrs:         netlink.LinkAttrs{Name: "eth1", OperState: netlink.OperUp},
+			publishOnlyUp: true,
+		},
+		{
+			name:          "down",
+			attrs:         netlink.LinkAttrs{Name: "eth1", OperState: netlink.OperDown},
+			publishOnlyUp: true,
+			want:          "oper_down",
+		},
+		{
+			name:          "lower layer down",
+			attrs:         netlink.LinkAttrs{Name: "eth1", OperState: netlink.OperLowerLayerDown},
+			publishOnlyUp: true,
+			want:          "oper_down",
+		},
+		{
+			name:          "unknown state with carrier",
+			attrs:         netlink.LinkAttrs{Name: "eth1", OperState: netlink.OperUnknown, RawFlags: unix.IFF_UP | unix.IFF_LOWER_UP},
+			publishOnlyUp: true,
+		},
+		{
+			name:          "unknown state without carrier",
+			attrs:         netlink.LinkAttrs{Name: "eth1", OperState: netlink.OperUnknown, RawFlags: unix.IFF_UP},
+			publishOnlyUp: true,
+			want:          "oper_down",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			np := &NetworkPlugin{publishOnlyUp: tt.publishOnlyUp}
+			link := &netlink.Device{LinkAttrs: tt.attrs}
+			if got := np.linkSkipReason(fakeInterface(tt.attrs.Name), link, nil); got != tt.want {
+				t.Errorf("linkSkipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkSkipReasonUnsafe(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatalf("failed to get the loopback interface: %v", err)
+	}
+	tests := []struct {
+		name        string
+		iface       net.Interface
+		routeLinks  map[int]bool
+		nodeIPs     []net.IP
+		allowUnsafe bool
+		want        string
+	}{
+		{
+			name:       "default route on another link",
+			iface:      fakeInterface("eth1"),
+			routeLinks: map[int]bool{2: true},
+		},
+		{
+			name:       "default route",
+			iface:      fakeInterface("eth1"),
+			routeLinks: map[int]bool{2: true, 1 << 30: true},
+			want:       "unsafe",
+		},
+		{
+			name:        "default route allowed",
+			iface:       fakeInterface("eth1"),
+			routeLinks:  map[int]bool{1 << 30: true},
+			allowUnsafe: true,
+		},
+		{
+			name:    "node address",
+			iface:   *lo,
+			nodeIPs: []net.IP{net.ParseIP("127.0.0.1")},
+			want:    "unsafe",
+		},
+		{
+			name:    "other node address",
+			iface:   *lo,
+			nodeIPs: []net.IP{net.ParseIP("192.168.1.2")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			np := &NetworkPlugin{nodeIPs: tt.nodeIPs, allowUnsafeInterfaces: tt.allowUnsafe}
+			link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: tt.iface.Name, Index: tt.iface.Index}}
+			if got := np.linkSkipReason(tt.iface, link, tt.routeLinks); got != tt.want {
+				t.Errorf("linkSkipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultRouteLinks(t *testing.T) {
+	netns := newTestNS(t)
+	eth1 := addTestVeth(t, netns, "eth1")
+	eth2 := addTestVeth(t, netns, "eth2")
+	eth3 := addTestVeth(t, netns, "eth3")
+	var got map[int]bool
+	err := netns.Do(func(ns.NetNS) error {
+		for _, config := range []struct {
+			link    netlink.Link
+			address string
+		}{
+			{eth1, "192.168.1.2/24"},
+			{eth2, "192.168.2.2/24"},
+			{eth3, "fd00::2/64"},
+		} {
+			addr, _ := netlink.ParseAddr(config.address)
+			addr.Flags = unix.IFA_F_NODAD
+			if err := netlink.AddrAdd(config.link, addr); err != nil {
+				return err
+			}
+		}
+		// only eth1 and eth3 carry default routes, eth2 has a specific route
+		_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+		routes := []*netlink.Route{
+			{LinkIndex: eth1.Attrs().Index, Gw: net.ParseIP("192.168.1.1")},
+			{LinkIndex: eth2.Attrs().Index, Dst: dst, Gw: net.ParseIP("192.168.2.1")},
+			{LinkIndex: eth3.Attrs().Index, Gw: net.ParseIP("fd00::1")},
+		}
+		for _, route := range routes {
+			if err := netlink.RouteAdd(route); err != nil {
+				return fmt.Errorf("failed to add route %s: %w", route, err)
+			}
+		}
+		var err error
+		got, err = defaultRouteLinks()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("defaultRouteLinks() error = %v", err)
+	}
+	want := map[int]bool{eth1.Attrs().Index: true, eth3.Attrs().Index: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("defaultRouteLinks() = %v, want %v", got, want)
+	}
+}
+
+func TestGetGCEInterfacesTimeout(t *testing.T) {
+	// the metadata server accepts the requests but never answers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	oldTimeout := gceMetadataTimeout
+	gceMetadataTimeout = 100 * time.Millisecond
+	defer func() { gceMetadataTimeout = oldTimeout }()
+
+	done := make(chan []gceNetworkInterface)
+	go func() {
+		done <- getGCEInterfaces(context.Background())
+	}()
+	select {
+	case interfaces := <-done:
+		if len(interfaces) != 0 {
+			t.Errorf("getGCEInterfaces() = %v, want no interfaces", interfaces)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("getGCEInterfaces() blocked on the metadata server")
+	}
+}
+
+func TestGCEInterfacesCache(t *testing.T) {
+	fetches := 0
+	cache := &gceInterfacesCache{
+		ttl: 100 * time.Millisecond,
+		fetch: func(context.Context) []gceNetworkInterface {
+			fetches++
+			// a network interface is attached to the instance on each fetch
+			interfaces := make([]gceNetworkInterface, fetches)
+			for i := range interfaces {
+				interfaces[i] = gceNetworkInterface{Mac: fmt.Sprintf("42:01:c0:a8:0%d:02", i)}
+			}
+			return interfaces
+		},
+	}
+	ctx := context.Background()
+	if got := len(cache.Get(ctx)); got != 1 {
+		t.Fatalf("Get() returned %d interfaces, want 1", got)
+	}
+	// the cached interfaces are used until the TTL expires
+	if got := len(cache.Get(ctx)); got != 1 || fetches != 1 {
+		t.Errorf("Get() returned %d interfaces after %d fetches, want the cached interface", got, fetches)
+	}
+	time.Sleep(150 * time.Millisecond)
+	// the new interfaces are obtained once the cache expires
+	if got := len(cache.Get(ctx)); got != 2 || fetches != 2 {
+		t.Errorf("Get() returned %d interfaces after %d fetches, want 2 after the refresh", got, fetches)
+	}
+}
+
+func TestFindGCEInterface(t *testing.T) {
+	gceInterfaces := []gceNetworkInterface{
+		{Mac: "42:01:C0:A8:01:02", Network: "projects/1/networks/net-1"},
+		{Mac: "42:01:c0:a8:02:02", Network: "projects/1/networks/net-2"},
+	}
+	tests := []struct {
+		name        string
+		mac         string
+		wantNetwork string
+		wantOK      bool
+	}{
+		{
+			name:        "uppercase metadata",
+			mac:         "42:01:c0:a8:01:02",
+			wantNetwork: "projects/1/networks/net-1",
+			wantOK:      true,
+		},
+		{
+			name:        "uppercase interface",
+			mac:         "42:01:C0:A8:02:02",
+			wantNetwork: "projects/1/networks/net-2",
+			wantOK:      true,
+		},
+		{
+			name: "not found",
+			mac:  "42:01:c0:a8:03:02",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gceIf, ok := findGCEInterface(gceInterfaces, tt.mac)
+			if ok != tt.wantOK || gceIf.Network != tt.wantNetwork {
+				t.Errorf("findGCEInterface(%q) = %q, %v, want %q, %v", tt.mac, gceIf.Network, ok, tt.wantNetwork, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestDuplicatedMACs(t *testing.T) {
+	withMAC := func(name string, mac string) net.Interface {
+		iface := fakeInterface(name)
+		iface.HardwareAddr, _ = net.ParseMAC(mac)
+		return iface
+	}
+	tests := []struct {
+		name   string
+		ifaces []net.Interface
+		want   map[string]bool
+	}{
+		{
+			name: "unique MACs",
+			ifaces: []net.Interface{
+				withMAC("eth0", "42:01:c0:a8:01:02"),
+				withMAC("eth1", "42:01:c0:a8:02:02"),
+			},
+			want: map[string]bool{},
+		},
+		{
+			name: "bond and VLAN share the MAC of the slave",
+			ifaces: []net.Interface{
+				withMAC("eth0", "42:01:c0:a8:01:02"),
+				withMAC("eth1", "42:01:c0:a8:02:02"),
+				withMAC("bond0", "42:01:C0:A8:02:02"),
+				withMAC("bond0.100", "42:01:c0:a8:02:02"),
+			},
+			want: map[string]bool{"42:01:c0:a8:02:02": true},
+		},
+		{
+			name: "interfaces without MAC",
+			ifaces: []net.Interface{
+				fakeInterface("lo"),
+				fakeInterface("wg0"),
+			},
+			want: map[string]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := duplicatedMACs(tt.ifaces); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("duplicatedMACs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildDeviceSRIOV(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		wantSRIOV    bool
+		wantVFs      int64
+		wantTotalVFs int64
+		wantCapacity bool
+	}{
+		{
+			name: "PF without VFs",
+			files: map[string]string{
+				"class/net/ens9f0/device/sriov_totalvfs": "8\n",
+				"class/net/ens9f0/device/sriov_numvfs":   "0\n",
+			},
+			wantSRIOV:    true,
+			wantTotalVFs: 8,
+			wantCapacity: true,
+		},
+		{
+			name: "PF with VFs",
+			files: map[string]string{
+				"class/net/ens9f0/device/sriov_totalvfs": "8\n",
+				"class/net/ens9f0/device/sriov_numvfs":   "4\n",
+			},
+			wantSRIOV:    true,
+			wantVFs:      4,
+			wantTotalVFs: 8,
+			wantCapacity: true,
+		},
+		{
+			name: "not SR-IOV capable",
+			files: map[string]string{
+				"class/net/ens9f0/mtu": "1500\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, tt.files)
+			link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ens9f0", Index: 1 << 30}}
+			device := buildDevice(fakeInterface("ens9f0"), link, nil)
+			if sriov := device.Basic.Attributes["sriov"].BoolValue; sriov == nil || *sriov != tt.wantSRIOV {
+				t.Errorf("sriov attribute = %v, want %v", sriov, tt.wantSRIOV)
+			}
+			if vfs := device.Basic.Attributes["sriov_vfs"].IntValue; tt.wantSRIOV && (vfs == nil || *vfs != tt.wantVFs) {
+				t.Errorf("sriov_vfs attribute = %v, want %d", vfs, tt.wantVFs)
+			}
+			totalVFs, ok := device.Basic.Capacity["sriov_totalvfs"]
+			if ok != tt.wantCapacity {
+				t.Fatalf("sriov_totalvfs capacity published = %v, want %v", ok, tt.wantCapacity)
+			}
+			if got := totalVFs.Value(); got != tt.wantTotalVFs {
+				t.Errorf("sriov_totalvfs capacity = %d, want %d", got, tt.wantTotalVFs)
+			}
+		})
+	}
+}
+
+func TestBuildDeviceCloudNetwork(t *testing.T) {
+	// the GCE metadata of the instance, with the MAC addresses in the
+	// format of the metadata server
+	gceInterfaces := []gceNetworkInterface{
+		{Mac: "42:01:c0:a8:04:02", Network: "projects/628944397724/networks/aojea-dra-net-1"},
+		{Mac: "42:01:C0:A8:05:02", Network: "projects/628944397724/networks/aojea-dra-net-2", MachineType: "a3-highgpu-8g"},
+	}
+	tests := []struct {
+		name            string
+		mac             string
+		wantNetwork     string
+		wantMachineType string
+	}{
+		{
+			name:        "interface on network 1",
+			mac:         "42:01:c0:a8:04:02",
+			wantNetwork: "aojea-dra-net-1",
+		},
+		{
+			name:            "interface on network 2",
+			mac:             "42:01:c0:a8:05:02",
+			wantNetwork:     "aojea-dra-net-2",
+			wantMachineType: "a3-highgpu-8g",
+		},
+		{
+			name: "interface without metadata",
+			mac:  "42:01:c0:a8:06:02",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, map[string]string{})
+			iface := fakeInterface("eth1")
+			iface.HardwareAddr, _ = net.ParseMAC(tt.mac)
+			link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: iface.Index}}
+			device := buildDevice(iface, link, gceInterfaces)
+			attributes := map[resourceapi.QualifiedName]string{
+				"cloud_network":    tt.wantNetwork,
+				"gce_machine_type": tt.wantMachineType,
+			}
+			if tt.wantNetwork != "" {
+				attributes["cloud_provider"] = cloudProviderGCE
+			}
+			for name, want := range attributes {
+				var got string
+				if value := device.Basic.Attributes[name].StringValue; value != nil {
+					got = *value
+				}
+				if got != want {
+					t.Errorf("%s attribute = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordNetworkDevices(t *testing.T) {
+	newDevice := func(name string, network string) resourceapi.Device {
+		device := resourceapi.Device{Name: name, Basic: &resourceapi.BasicDevice{Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{}}}
+		if network != "" {
+			device.Basic.Attributes["cloud_network"] = resourceapi.DeviceAttribute{StringValue: &network}
+		}
+		return device
+	}
+	devices := []resourceapi.Device{
+		newDevice("eth1", "net-1"),
+		newDevice("eth2", "net-1"),
+		newDevice("eth3", "net-2"),
+		newDevice("eth4", ""),
+	}
+	tests := []struct {
+		name           string
+		devices        []resourceapi.Device
+		allocatedLinks map[string]bool
+		want           map[string]int64
+	}{
+		{
+			name:    "all available",
+			devices: devices,
+			want:    map[string]int64{"net-1": 2, "net-2": 1},
+		},
+		{
+			name:           "allocated devices",
+			devices:        devices,
+			allocatedLinks: map[string]bool{"eth1": true, "eth3": true, "eth4": true},
+			want:           map[string]int64{"net-1": 1, "net-2": 0},
+		},
+		{
+			name:    "network without devices",
+			devices: devices[:2],
+			want:    map[string]int64{"net-1": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordNetworkDevices(tt.devices, tt.allocatedLinks)
+			got := map[string]int64{}
+			networkDevices.Do(func(kv expvar.KeyValue) {
+				got[kv.Key] = kv.Value.(*expvar.Int).Value()
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("network_driver_network_devices = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildDeviceMTURange(t *testing.T) {
+	netns := newTestNS(t)
+	addTestVeth(t, netns, "eth1")
+	err := netns.Do(func(ns.NetNS) error {
+		for _, link := range []netlink.Link{
+			&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br1"}},
+			&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: "ifb1"}},
+		} {
+			if err := netlink.LinkAdd(link); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create the links: %v", err)
+	}
+	tests := []struct {
+		name    string
+		wantMin int64
+		wantMax int64
+	}{
+		{
+			name:    "eth1",
+			wantMin: 68,
+			wantMax: 65535,
+		},
+		{
+			name:    "br1",
+			wantMin: 68,
+			wantMax: 65535,
+		},
+		{
+			// the driver does not report the range
+			name: "ifb1",
+		},
+		{
+			name: "lo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, map[string]string{})
+			var device resourceapi.Device
+			err := netns.Do(func(ns.NetNS) error {
+				iface, err := net.InterfaceByName(tt.name)
+				if err != nil {
+					return err
+				}
+				link, err := netlink.LinkByName(tt.name)
+				if err != nil {
+					return err
+				}
+				device = buildDevice(*iface, link, nil)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to build the device: %v", err)
+			}
+			for name, want := range map[resourceapi.QualifiedName]int64{"min_mtu": tt.wantMin, "max_mtu": tt.wantMax} {
+				value := device.Basic.Attributes[name].IntValue
+				if want == 0 {
+					if value != nil {
+						t.Errorf("%s attribute = %d, want it omitted", name, *value)
+					}
+					continue
+				}
+				if value == nil || *value != want {
+					t.Errorf("%s attribute = %v, want %d", name, value, want)
+				}
+			}
+		})
+	}
+}
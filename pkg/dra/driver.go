@@ -2,12 +2,18 @@ package dra
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Mellanox/rdmamap"
@@ -18,15 +24,17 @@ import (
 	"github.com/containerd/nri/pkg/stub"
 
 	"cloud.google.com/go/compute/metadata"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	resourceapi "k8s.io/api/resource/v1alpha3"
-	"k8s.io/apimachinery/pkg/api/resource"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
 	"k8s.io/klog/v2"
 	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
 )
@@ -55,65 +63,534 @@ func (s *storage) Remove(uid types.UID) {
 	delete(s.cache, uid)
 }
 
+// AddWithinLimit adds the allocation if the devices of all the allocations,
+// counted by count, do not exceed the limit with it, 0 means no limit. The
+// count and the addition are atomic, so concurrent allocations can not exceed
+// the limit. It returns the devices already allocated if it is not added.
+func (s *storage) AddWithinLimit(uid types.UID, allocation resourceapi.AllocationResult, count func(resourceapi.AllocationResult) int, limit int) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit > 0 {
+		allocated := 0
+		for _, a := range s.cache {
+			allocated += count(a)
+		}
+		if allocated+count(allocation) > limit {
+			return allocated, false
+		}
+	}
+	s.cache[uid] = allocation
+	return 0, true
+}
+
+// List returns a copy of the allocations.
+func (s *storage) List() map[types.UID]resourceapi.AllocationResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.cache)
+}
+
+// podDeviceStates stores the state of the devices attached to each Pod.
+type podDeviceStates struct {
+	mu    sync.RWMutex
+	cache map[types.UID]map[string]deviceState
+}
+
+func (s *podDeviceStates) Add(uid types.UID, device string, state deviceState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cache[uid]; !ok {
+		s.cache[uid] = map[string]deviceState{}
+	}
+	s.cache[uid][device] = state
+}
+
+func (s *podDeviceStates) Get(uid types.UID, device string) (deviceState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, ok := s.cache[uid][device]
+	return state, ok
+}
+
+func (s *podDeviceStates) Remove(uid types.UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, uid)
+}
+
+// Pop removes and returns the states of the device on all the Pods.
+func (s *podDeviceStates) Pop(device string) map[types.UID]deviceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := map[types.UID]deviceState{}
+	for uid, devices := range s.cache {
+		if state, ok := devices[device]; ok {
+			states[uid] = state
+			delete(devices, device)
+		}
+	}
+	return states
+}
+
+// deviceLocks serializes the operations on the same devices.
+type deviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// Lock locks the devices and returns the function to unlock them. The devices
+// are locked in order to avoid deadlocks between operations on multiple devices.
+func (l *deviceLocks) Lock(devices ...string) func() {
+	devices = slices.Clone(devices)
+	slices.Sort(devices)
+	devices = slices.Compact(devices)
+
+	l.mu.Lock()
+	locks := make([]*sync.Mutex, 0, len(devices))
+	for _, device := range devices {
+		lock, ok := l.locks[device]
+		if !ok {
+			lock = &sync.Mutex{}
+			l.locks[device] = lock
+		}
+		locks = append(locks, lock)
+	}
+	l.mu.Unlock()
+
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+const (
+	// RDMAModeExclusive is the RDMA network namespace mode where the devices
+	// are only visible in one network namespace.
+	RDMAModeExclusive = "exclusive"
+	// RDMAModeShared is the RDMA network namespace mode where the devices are
+	// visible in all the network namespaces.
+	RDMAModeShared = "shared"
+)
+
 var _ drapb.NodeServer = &NetworkPlugin{}
 
 type NetworkPlugin struct {
 	driverName string
+	nodeName   string
 	kubeClient kubernetes.Interface
 	draPlugin  kubeletplugin.DRAPlugin
 	nriPlugin  stub.Stub
 
+	// poolName is the pool of the devices, the kubelet plugin publishes them
+	// in a pool named after the node if it is not set
+	poolName        string
+	nodeUID         types.UID
+	sliceController *resourceslice.Controller
+
 	podAllocations   storage
 	claimAllocations storage
+	deviceStates     podDeviceStates
+	deviceLocks      deviceLocks
+	deviceNames      *deviceNames
+	ipam             *ipamStore
+	partitions       vfPartitions
+	resolvedLinks    resolvedLinks
+	published        publishedDevices
+
+	// cancel stops the plugins and the publication of the resources
+	cancel context.CancelFunc
+
+	// inflight is the number of operations on the devices in progress
+	inflight atomic.Int32
+	// publishCh triggers a publication of the resources
+	publishCh chan struct{}
 
 	ifaceGw string
+
+	moveBackoff wait.Backoff
+	// maxParallelMoves is the number of devices of a Pod moved at the same time
+	maxParallelMoves int
+	gceNetworks      []string
+	healthServer     *health.Server
+
+	gceInterfaces *gceInterfacesCache
+
+	nodeIPs                 []net.IP
+	allowUnsafeInterfaces   bool
+	allowEnslavedInterfaces bool
+	publishOnlyUp           bool
+	reserved                reservedInterfaces
+
+	maxAllocatedDevices int
+	sriovPartitions     bool
+	sriovKeepVFs        bool
+
+	publishInterval time.Duration
+	publishStats    bool
+	// the first publication waits for the node to settle
+	publishSettleDelay time.Duration
+	expectedDevices    int
+	// hostTargetNamespaces are the namespaces allowed to configure the devices
+	// on the host
+	hostTargetNamespaces []string
+	// postUpExecNamespaces are the namespaces allowed to execute commands
+	// inside the Pod network namespace
+	postUpExecNamespaces []string
+	// lastDiscoverySummary is the summary of the last discovery logged
+	lastDiscoverySummary string
+
+	interfaceFilter *regexp.Regexp
+	rdmaMode        string
+	nriPluginIndex  string
+	pluginsDir      string
+	disableNRI      bool
+	tempNamePrefix  string
+}
+
+// Option configures the NetworkPlugin.
+type Option func(*NetworkPlugin)
+
+// WithMoveBackoff sets the number of attempts and the initial delay, doubled on
+// each attempt, used to retry moving a device that hits a transient error.
+func WithMoveBackoff(attempts int, delay time.Duration) Option {
+	return func(np *NetworkPlugin) {
+		np.moveBackoff.Steps = attempts
+		np.moveBackoff.Duration = delay
+	}
+}
+
+// WithMaxParallelMoves sets the number of devices of a Pod that are moved to
+// its network namespace at the same time, 1 moves them one by one.
+func WithMaxParallelMoves(moves int) Option {
+	return func(np *NetworkPlugin) {
+		np.maxParallelMoves = moves
+	}
+}
+
+// WithGCENetworks only publishes the interfaces attached to the GCE networks
+// in the list, the networks can be the full network path or only the name.
+func WithGCENetworks(networks []string) Option {
+	return func(np *NetworkPlugin) {
+		np.gceNetworks = networks
+	}
+}
+
+// WithAllowUnsafeInterfaces publishes the interfaces used by the node, with
+// a default route or with the node addresses, allocating them to a Pod breaks
+// the node connectivity.
+func WithAllowUnsafeInterfaces(allow bool) Option {
+	return func(np *NetworkPlugin) {
+		np.allowUnsafeInterfaces = allow
+	}
+}
+
+// WithAllowEnslavedInterfaces publishes the interfaces enslaved to a bond,
+// bridge or team, moving them to a Pod removes them from their master.
+func WithAllowEnslavedInterfaces(allow bool) Option {
+	return func(np *NetworkPlugin) {
+		np.allowEnslavedInterfaces = allow
+	}
 }
 
-func Start(ctx context.Context, driverName string, kubeClient kubernetes.Interface, nodeName string) (*NetworkPlugin, error) {
+// WithPublishOnlyUp only publishes the interfaces whose operational state is
+// up, so the Pods are not scheduled to the interfaces without link.
+func WithPublishOnlyUp(onlyUp bool) Option {
+	return func(np *NetworkPlugin) {
+		np.publishOnlyUp = onlyUp
+	}
+}
+
+// WithReservedInterfaces sets the interfaces reserved for the node, they are
+// never published nor allocated.
+func WithReservedInterfaces(names []string) Option {
+	return func(np *NetworkPlugin) {
+		np.reserved.static = names
+	}
+}
+
+// WithGatewayInterface sets the interface of the node uplink, that is never
+// published, instead of the interface of the first default route.
+func WithGatewayInterface(name string) Option {
+	return func(np *NetworkPlugin) {
+		np.ifaceGw = name
+	}
+}
+
+// WithMaxAllocatedDevices limits the number of devices that can be allocated
+// to Pods on the node at the same time, 0 means no limit.
+func WithMaxAllocatedDevices(limit int) Option {
+	return func(np *NetworkPlugin) {
+		np.maxAllocatedDevices = limit
+	}
+}
+
+// WithSRIOVPartitions publishes a device for each VF that the SR-IOV physical
+// functions support but are not created, the VFs are created when a partition
+// is allocated.
+func WithSRIOVPartitions(enabled bool) Option {
+	return func(np *NetworkPlugin) {
+		np.sriovPartitions = enabled
+	}
+}
+
+// WithSRIOVKeepVFs keeps the VFs created for the partitions once they are not in
+// use, so they are reused by the next claims without creating them again.
+func WithSRIOVKeepVFs(keep bool) Option {
+	return func(np *NetworkPlugin) {
+		np.sriovKeepVFs = keep
+	}
+}
+
+// WithPublishInterval sets the interval to publish the resources if there are
+// no interface changes.
+func WithPublishInterval(interval time.Duration) Option {
+	return func(np *NetworkPlugin) {
+		np.publishInterval = interval
+	}
+}
+
+// WithHostTargetNamespaces sets the namespaces of the trusted workloads that
+// can configure the devices on the host instead of moving them to the Pod.
+func WithHostTargetNamespaces(namespaces []string) Option {
+	return func(np *NetworkPlugin) {
+		np.hostTargetNamespaces = namespaces
+	}
+}
+
+// WithPostUpExecNamespaces sets the namespaces of the trusted workloads that
+// can execute a command inside the Pod network namespace with postUpExec.
+func WithPostUpExecNamespaces(namespaces []string) Option {
+	return func(np *NetworkPlugin) {
+		np.postUpExecNamespaces = namespaces
+	}
+}
+
+// WithPoolName sets the name of the pool of the devices, so the devices can be
+// segmented by rack or network zone. The name must be unique for each node.
+func WithPoolName(name string) Option {
+	return func(np *NetworkPlugin) {
+		np.poolName = name
+	}
+}
+
+// WithPublishSettleDelay delays the first publication of the resources, so the
+// interfaces attached while the node boots are published at once.
+func WithPublishSettleDelay(delay time.Duration) Option {
+	return func(np *NetworkPlugin) {
+		np.publishSettleDelay = delay
+	}
+}
+
+// WithExpectedDevices delays the first publication of the resources until the
+// number of devices is discovered, the settle delay bounds the wait if set.
+func WithExpectedDevices(devices int) Option {
+	return func(np *NetworkPlugin) {
+		np.expectedDevices = devices
+	}
+}
+
+// WithPublishStats publishes the traffic counters of the interfaces as device
+// attributes. The counters change constantly, so the resources are updated on
+// every publish cycle instead of being skipped if the devices did not change.
+func WithPublishStats(publish bool) Option {
+	return func(np *NetworkPlugin) {
+		np.publishStats = publish
+	}
+}
+
+// WithInterfaceFilter only publishes the interfaces whose name matches the filter.
+func WithInterfaceFilter(filter *regexp.Regexp) Option {
+	return func(np *NetworkPlugin) {
+		np.interfaceFilter = filter
+	}
+}
+
+// WithRDMAMode sets the RDMA subsystem network namespace mode of the node. In
+// exclusive mode the RDMA devices are moved with the interfaces, in shared
+// mode they are visible in all the network namespaces.
+func WithRDMAMode(mode string) Option {
+	return func(np *NetworkPlugin) {
+		np.rdmaMode = mode
+	}
+}
+
+// WithNRIPluginIndex sets the index of the NRI plugin, the runtime invokes the
+// plugins in the order of their index, so the plugins that need the network
+// devices must have a higher index.
+func WithNRIPluginIndex(index string) Option {
+	return func(np *NetworkPlugin) {
+		np.nriPluginIndex = index
+	}
+}
+
+// WithNRIDisabled does not register the NRI plugin, the devices are attached
+// when the claim is prepared to the network namespace in the device config,
+// since the Pod network namespace is only known by the NRI hooks. The claims
+// without a network namespace in the config fail to be prepared.
+func WithNRIDisabled(disabled bool) Option {
+	return func(np *NetworkPlugin) {
+		np.disableNRI = disabled
+	}
+}
+
+// WithTempNamePrefix sets the prefix of the temporary names of the devices
+// while they are moved, it must not be used by other plugins.
+func WithTempNamePrefix(prefix string) Option {
+	return func(np *NetworkPlugin) {
+		np.tempNamePrefix = prefix
+	}
+}
+
+// WithKubeletPluginsDir sets the kubelet plugins directory, the registration
+// socket is created in the plugins_registry directory next to it.
+func WithKubeletPluginsDir(dir string) Option {
+	return func(np *NetworkPlugin) {
+		np.pluginsDir = dir
+	}
+}
+
+func Start(ctx context.Context, driverName string, kubeClient kubernetes.Interface, nodeName string, opts ...Option) (*NetworkPlugin, error) {
 	plugin := &NetworkPlugin{
 		driverName:       driverName,
+		nodeName:         nodeName,
 		kubeClient:       kubeClient,
 		podAllocations:   storage{cache: make(map[types.UID]resourceapi.AllocationResult)},
 		claimAllocations: storage{cache: make(map[types.UID]resourceapi.AllocationResult)},
+		deviceStates:     podDeviceStates{cache: make(map[types.UID]map[string]deviceState)},
+		deviceLocks:      deviceLocks{locks: make(map[string]*sync.Mutex)},
+		partitions:       vfPartitions{netdevs: make(map[string]string), created: make(map[string]bool)},
+		resolvedLinks:    resolvedLinks{links: make(map[string]string)},
+		publishCh:        make(chan struct{}, 1),
+		gceInterfaces:    &gceInterfacesCache{ttl: gceMetadataTTL, fetch: getGCEInterfaces},
+		moveBackoff: wait.Backoff{
+			Duration: 100 * time.Millisecond,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    3,
+		},
+		maxParallelMoves: 1,
+		publishInterval:  1 * time.Minute,
+		rdmaMode:         RDMAModeExclusive,
+		nriPluginIndex:   "00",
+		pluginsDir:       "/var/lib/kubelet/plugins",
+		tempNamePrefix:   hostdevice.DefaultTempNamePrefix,
+	}
+	for _, o := range opts {
+		o(plugin)
 	}
 
-	pluginRegistrationPath := "/var/lib/kubelet/plugins_registry/" + driverName + ".sock"
-	driverPluginPath := "/var/lib/kubelet/plugins/" + driverName
+	pluginRegistrationPath := filepath.Join(filepath.Dir(plugin.pluginsDir), "plugins_registry", driverName+".sock")
+	driverPluginPath := filepath.Join(plugin.pluginsDir, driverName)
 	err := os.MkdirAll(driverPluginPath, 0750)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create plugin path %s: %v", driverPluginPath, err)
 	}
+	// the sockets and the driver state are stored in the plugin path
+	f, err := os.CreateTemp(driverPluginPath, ".write-check")
+	if err != nil {
+		return nil, fmt.Errorf("plugin path %s is not writable: %v", driverPluginPath, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
 	driverPluginSocketPath := driverPluginPath + "/plugin.sock"
+	healthSocketPath := driverPluginPath + "/health.sock"
+
+	hostdevice.SetTempNamePrefix(plugin.tempNamePrefix)
+
+	// restore the host names of the devices released while the driver was down
+	plugin.deviceNames, err = loadDeviceNames(driverPluginPath + "/device-names.json")
+	if err != nil {
+		klog.Infof("failed to load the device names: %v", err)
+	}
+	plugin.deviceNames.Reconcile()
 
-	ifaceGw, err := getDefaultGwIf()
+	plugin.ipam, err = loadIPAMStore(driverPluginPath + "/ipam.json")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get interface for the default route: %v", err)
+		klog.Infof("failed to load the ipam allocations: %v", err)
 	}
-	plugin.ifaceGw = ifaceGw
 
-	nriOpts := []stub.Option{
-		stub.WithPluginName(driverName),
-		stub.WithPluginIdx("00"),
+	// the VFs created before a restart are removed once they are released
+	if err := plugin.partitions.load(driverPluginPath + "/partitions.json"); err != nil {
+		klog.Infof("failed to load the VF partitions: %v", err)
 	}
 
-	stub, err := stub.New(plugin, nriOpts...)
+	if err := plugin.resolveGatewayInterface(); err != nil {
+		return nil, err
+	}
+
+	if err := checkResourceAPI(kubeClient.Discovery()); err != nil {
+		return nil, err
+	}
+
+	// the interfaces with the node addresses or reserved for the node are not
+	// published
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create plugin stub: %v", err)
+		klog.Infof("failed to get node %s addresses: %v", nodeName, err)
+		// the node owns the resource slices of the pool
+		if plugin.poolName != "" {
+			return nil, fmt.Errorf("failed to get node %s owner of the pool %s: %w", nodeName, plugin.poolName, err)
+		}
+	} else {
+		plugin.nodeUID = node.UID
+		for _, address := range node.Status.Addresses {
+			if ip := net.ParseIP(address.Address); ip != nil {
+				plugin.nodeIPs = append(plugin.nodeIPs, ip)
+			}
+		}
+		plugin.reserved.SetAnnotation(node.Annotations[driverName+"/"+reservedInterfacesAnnotation])
 	}
 
-	plugin.nriPlugin = stub
+	// the VFs of the partitions prepared before a restart are still in use,
+	// they are restored before the resources are published
+	if err := plugin.restorePartitions(ctx); err != nil {
+		klog.Infof("failed to restore the VF partitions: %v", err)
+	}
 
 	// cancel the plugin if the nri plugin fails for any reason
 	inCtx, cancel := context.WithCancel(ctx)
-	go func() {
-		defer cancel()
-		err = plugin.nriPlugin.Run(inCtx)
+	plugin.cancel = cancel
+
+	if !plugin.disableNRI {
+		nriOpts := []stub.Option{
+			stub.WithPluginName(driverName),
+			stub.WithPluginIdx(plugin.nriPluginIndex),
+		}
+
+		stub, err := stub.New(plugin, nriOpts...)
 		if err != nil {
-			klog.Infof("NRI plugin failed with error %v", err)
+			cancel()
+			return nil, fmt.Errorf("failed to create plugin stub: %v", err)
 		}
-	}()
 
-	opts := []kubeletplugin.Option{
+		plugin.nriPlugin = stub
+	} else {
+		klog.Infof("NRI plugin disabled, the devices are attached on prepare to the network namespace of the config")
+	}
+
+	// the health service reports serving once the resources are published
+	plugin.healthServer = health.NewServer()
+	plugin.healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	err = startHealthServer(inCtx, healthSocketPath, plugin.healthServer)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if plugin.nriPlugin != nil {
+		go func() {
+			defer cancel()
+			err = plugin.nriPlugin.Run(inCtx)
+			if err != nil {
+				klog.Infof("NRI plugin failed with error %v", err)
+			}
+		}()
+	}
+
+	kubeletOpts := []kubeletplugin.Option{
 		kubeletplugin.DriverName(driverName),
 		kubeletplugin.NodeName(nodeName),
 		kubeletplugin.KubeClient(kubeClient),
@@ -121,8 +598,9 @@ func Start(ctx context.Context, driverName string, kubeClient kubernetes.Interfa
 		kubeletplugin.PluginSocketPath(driverPluginSocketPath),
 		kubeletplugin.KubeletPluginSocketPath(driverPluginSocketPath),
 	}
-	d, err := kubeletplugin.Start(inCtx, plugin, opts...)
+	d, err := kubeletplugin.Start(inCtx, plugin, kubeletOpts...)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("start kubelet plugin: %w", err)
 	}
 	plugin.draPlugin = d
@@ -134,6 +612,7 @@ func Start(ctx context.Context, driverName string, kubeClient kubernetes.Interfa
 		return status.PluginRegistered, nil
 	})
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 	// publish available resources
@@ -142,123 +621,559 @@ func Start(ctx context.Context, driverName string, kubeClient kubernetes.Interfa
 }
 
 func (np *NetworkPlugin) Stop() {
-	np.nriPlugin.Stop()
+	defer np.cancel()
+	if np.nriPlugin != nil {
+		np.nriPlugin.Stop()
+	}
+	if np.sliceController != nil {
+		np.sliceController.Stop()
+	}
 	np.draPlugin.Stop()
 }
 
-func (np *NetworkPlugin) RunPodSandbox(_ context.Context, pod *api.PodSandbox) error {
+// pool returns the name of the pool of the devices.
+func (np *NetworkPlugin) pool() string {
+	if np.poolName != "" {
+		return np.poolName
+	}
+	return np.nodeName
+}
+
+// publish publishes the devices in the pool of the driver, the kubelet plugin
+// only publishes them in a pool named after the node.
+func (np *NetworkPlugin) publish(ctx context.Context, resources kubeletplugin.Resources) {
+	np.published.Set(resources.Devices)
+	if np.poolName == "" {
+		np.draPlugin.PublishResources(ctx, resources)
+		return
+	}
+	driverResources := &resourceslice.DriverResources{
+		Pools: map[string]resourceslice.Pool{
+			np.poolName: {Devices: resources.Devices},
+		},
+	}
+	if np.sliceController == nil {
+		// the resource slices owned by the node are local to the node
+		owner := resourceslice.Owner{APIVersion: "v1", Kind: "Node", Name: np.nodeName, UID: np.nodeUID}
+		np.sliceController = resourceslice.StartController(ctx, np.kubeClient, np.driverName, owner, driverResources)
+		return
+	}
+	np.sliceController.Update(driverResources)
+}
+
+// Drain waits up to the grace period for the operations on the devices in
+// progress to complete, so the devices are not left half configured when the
+// driver exits. It returns false if there are operations still in progress.
+func (np *NetworkPlugin) Drain(gracePeriod time.Duration) bool {
+	err := wait.PollUntilContextTimeout(context.Background(), 100*time.Millisecond, gracePeriod, true, func(context.Context) (bool, error) {
+		return np.inflight.Load() == 0, nil
+	})
+	return err == nil
+}
+
+// track counts an operation in progress until the returned function is called.
+func (np *NetworkPlugin) track() func() {
+	np.inflight.Add(1)
+	return func() { np.inflight.Add(-1) }
+}
+
+// allocatedDevices returns the names of the devices allocated by this driver.
+func (np *NetworkPlugin) allocatedDevices(allocation resourceapi.AllocationResult) []string {
+	var devices []string
+	for _, result := range allocation.Devices.Results {
+		if result.Driver == np.driverName {
+			devices = append(devices, result.Device)
+		}
+	}
+	return devices
+}
+
+// addClaimAllocation stores the allocation of the prepared claim, it fails if
+// the devices of the claim exceed the maximum number of allocated devices.
+func (np *NetworkPlugin) addClaimAllocation(uid types.UID, allocation resourceapi.AllocationResult) error {
+	count := func(a resourceapi.AllocationResult) int {
+		return len(np.allocatedDevices(a))
+	}
+	if allocated, ok := np.claimAllocations.AddWithinLimit(uid, allocation, count, np.maxAllocatedDevices); !ok {
+		return fmt.Errorf("requires %d devices, %d of the maximum of %d devices are already allocated on the node", count(allocation), allocated, np.maxAllocatedDevices)
+	}
+	return nil
+}
+
+// getNetworkNamespace returns the path of the network namespace of the Pod, or
+// an empty string if the Pod does not declare one and uses the host network.
+// The Pod must declare at most one network namespace, it is not possible to
+// know which one the Pod uses if there are more.
+func getNetworkNamespace(pod *api.PodSandbox) (string, error) {
+	var paths []string
+	for _, namespace := range pod.Linux.GetNamespaces() {
+		if namespace.Type == "network" {
+			paths = append(paths, namespace.Path)
+		}
+	}
+	switch len(paths) {
+	case 0:
+		return "", nil
+	case 1:
+		return paths[0], nil
+	default:
+		return "", fmt.Errorf("pod %s/%s has multiple network namespaces: %v", pod.Namespace, pod.Name, paths)
+	}
+}
+
+func (np *NetworkPlugin) RunPodSandbox(ctx context.Context, pod *api.PodSandbox) (err error) {
 	klog.V(2).Infof("RunPodSandbox pod %s/%s", pod.Namespace, pod.Name)
+	defer np.track()()
 
 	allocation, ok := np.podAllocations.Get(types.UID(pod.Uid))
 	if !ok {
 		klog.V(2).Infof("RunPodSandbox pod %s/%s does not have allocations", pod.Namespace, pod.Name)
 		return nil
 	}
+	defer np.deviceLocks.Lock(np.allocatedDevices(allocation)...)()
 
-	// get the pod network namespace
-	var ns string
-	for _, namespace := range pod.Linux.GetNamespaces() {
-		if namespace.Type == "network" {
-			ns = namespace.Path
-			break
+	// a failure in any step undoes the steps already done in reverse order,
+	// so all the devices return to the host and the Pod is not left half
+	// configured
+	var undo rollback
+	defer func() {
+		if err != nil {
+			if rollbackErr := undo.Run(); rollbackErr != nil {
+				klog.Infof("RunPodSandbox pod %s/%s failed to roll back: %v", pod.Namespace, pod.Name, rollbackErr)
+			}
 		}
+	}()
+	undo.Add(func() error {
+		np.ipam.Release(pod.Uid)
+		np.deviceStates.Remove(types.UID(pod.Uid))
+		return nil
+	})
+
+	// get the pod network namespace
+	ns, err := getNetworkNamespace(pod)
+	if err != nil {
+		return err
 	}
 	// TODO check host network namespace
 	if ns == "" {
-		klog.V(2).Infof("RunPodSandbox pod %s/%s using host network, skipping", pod.Namespace, pod.Name)
-		return nil
+		klog.V(2).Infof("RunPodSandbox pod %s/%s using host network", pod.Namespace, pod.Name)
 	}
 
-	for _, config := range allocation.Devices.Config {
-		if config.Opaque == nil {
+	// attach the network devices to the pod namespace, or to the namespace
+	// in the device configuration
+	var bonds []*NetworkConfig
+	// the slaves of the bonds are the devices of the request
+	bondRequests := map[*NetworkConfig]string{}
+	// the tunnels are created over the underlay devices
+	var tunnels []*NetworkConfig
+	underlays := map[*NetworkConfig]string{}
+	// the interfaces attached and their addresses are published on success
+	var statuses []interfaceStatus
+	// the devices are moved before configuring them, so they can be moved
+	// in parallel
+	var attachments []deviceAttachment
+	for _, result := range allocation.Devices.Results {
+		if result.Driver != np.driverName {
+			continue
+		}
+		klog.Infof("RunPodSandbox allocation.Devices.Result: %#v", result)
+		device := np.linkName(result.Device)
+		config, err := np.deviceConfig(allocation, result.Request)
+		if err != nil {
+			return err
+		}
+		netns := config.namespace(ns)
+		if netns == "" {
+			klog.V(2).Infof("RunPodSandbox pod %s/%s skipping device %s without network namespace", pod.Namespace, pod.Name, device)
 			continue
 		}
-		// TODO config.Request seems to be a sort of filter
-		klog.Infof("RunPodSandbox config.Opaque.Parameters: %s", config.Opaque.Parameters.String())
-		// TODO get config options here, it can add ips or commands
-		// to add routes, run dhcp, rename the interface ... whatever
+		// the tunnel is created over the device, that remains on the host
+		if config.isTunnel() {
+			if !slices.ContainsFunc(tunnels, func(c *NetworkConfig) bool { return c.tunnelName() == config.tunnelName() }) {
+				tunnels = append(tunnels, config)
+				underlays[config] = device
+			}
+			continue
+		}
+		attachments = append(attachments, deviceAttachment{
+			device:  device,
+			request: result.Request,
+			ifName:  config.interfaceName(result.Request, device),
+			netns:   netns,
+			config:  config,
+		})
+	}
+	if err := np.attachDevices(ctx, pod, attachments, &undo); err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		device, ifName, netns, config := attachment.device, attachment.ifName, attachment.netns, attachment.config
+		// the bond configuration is applied once all the slaves are attached
+		if config != nil && config.Mode == modeBond {
+			if !slices.ContainsFunc(bonds, func(c *NetworkConfig) bool { return c.bondName() == config.bondName() }) {
+				bonds = append(bonds, config)
+				bondRequests[config] = attachment.request
+			}
+		} else if config == nil || config.NoBringUp {
+			statuses = append(statuses, interfaceStatus{Device: device, Interface: ifName})
+		} else {
+			config, err := np.ipamConfig(pod.Uid, ifName, config)
+			if err != nil {
+				return fmt.Errorf("failed to allocate address to device %s: %w", device, err)
+			}
+			klog.V(4).Infof("RunPodSandbox applying config %#v to device %s", config, ifName)
+			state, err := applyNetworkConfig(netns, ifName, config)
+			// store the state even on error so it can be restored
+			if attached, ok := np.deviceStates.Get(types.UID(pod.Uid), device); ok {
+				state.RDMADevice = attached.RDMADevice
+			}
+			np.deviceStates.Add(types.UID(pod.Uid), device, state)
+			undo.Add(func() error { return restoreNetworkConfig(netns, ifName, state) })
+			if err != nil {
+				return fmt.Errorf("failed to configure device %s in namespace %s: %w", ifName, netns, err)
+			}
+			if config.WaitForCarrier {
+				if err := waitForCarrier(ctx, netns, ifName, config.carrierTimeout()); err != nil {
+					return err
+				}
+			}
+			if config.VerifyMTU {
+				if err := verifyMTU(netns, ifName, config); err != nil {
+					return err
+				}
+			}
+			statuses = append(statuses, newInterfaceStatus(device, ifName, state))
+		}
+	}
 
+	for _, config := range bonds {
+		name := config.bondName()
+		netns := config.namespace(ns)
+		slaves := np.bondSlaves(bondRequests[config], config)
+		klog.V(4).Infof("RunPodSandbox creating bond %s with slaves %v", name, slaves)
+		if err := createBond(netns, name, config, slaves); err != nil {
+			return fmt.Errorf("failed to create bond %s in namespace %s: %w", name, netns, err)
+		}
+		undo.Add(func() error { return deleteBond(netns, name, slaves) })
+		config, err := np.ipamConfig(pod.Uid, name, config)
+		if err != nil {
+			return fmt.Errorf("failed to allocate address to bond %s: %w", name, err)
+		}
+		state, err := applyNetworkConfig(netns, name, config)
+		// store the state even on error so it can be restored
+		np.deviceStates.Add(types.UID(pod.Uid), name, state)
+		undo.Add(func() error { return restoreNetworkConfig(netns, name, state) })
+		if err != nil {
+			return fmt.Errorf("failed to configure bond %s in namespace %s: %w", name, netns, err)
+		}
+		if config.WaitForCarrier {
+			if err := waitForCarrier(ctx, netns, name, config.carrierTimeout()); err != nil {
+				return err
+			}
+		}
+		if config.VerifyMTU {
+			if err := verifyMTU(netns, name, config); err != nil {
+				return err
+			}
+		}
+		statuses = append(statuses, newInterfaceStatus(name, name, state))
+	}
+
+	for _, config := range tunnels {
+		name := config.tunnelName()
+		netns := config.namespace(ns)
+		hostName := tunnelHostName(pod.Uid, name)
+		klog.V(4).Infof("RunPodSandbox creating %s tunnel %s over %s", config.Mode, name, underlays[config])
+		if err := createTunnel(hostName, underlays[config], config); err != nil {
+			return err
+		}
+		err := retryOnTransientError(ctx, np.moveBackoff, func() error {
+			return hostdevice.MoveLinkIn(hostName, netns, name, false)
+		})
+		recordDeviceResult(moveTotal, deviceTypeTunnel, err)
+		if err != nil {
+			if link, linkErr := netlink.LinkByName(hostName); linkErr == nil {
+				_ = netlink.LinkDel(link)
+			}
+			return fmt.Errorf("failed to move tunnel %s to namespace %s: %w", name, netns, err)
+		}
+		undo.Add(func() error { return deleteLink(netns, name) })
+		config, err := np.ipamConfig(pod.Uid, name, config)
+		if err != nil {
+			return fmt.Errorf("failed to allocate address to tunnel %s: %w", name, err)
+		}
+		state, err := applyNetworkConfig(netns, name, config)
+		// store the state even on error so it can be restored
+		np.deviceStates.Add(types.UID(pod.Uid), name, state)
+		undo.Add(func() error { return restoreNetworkConfig(netns, name, state) })
+		if err != nil {
+			return fmt.Errorf("failed to configure tunnel %s in namespace %s: %w", name, netns, err)
+		}
+		if config.WaitForCarrier {
+			if err := waitForCarrier(ctx, netns, name, config.carrierTimeout()); err != nil {
+				return err
+			}
+		}
+		if config.VerifyMTU {
+			if err := verifyMTU(netns, name, config); err != nil {
+				return err
+			}
+		}
+		statuses = append(statuses, newInterfaceStatus(underlays[config], name, state))
 	}
+	np.publishNetworkStatus(ctx, pod, statuses)
+	return nil
+}
 
-	// attach the network devices to the pod namespace
+func (np *NetworkPlugin) StopPodSandbox(ctx context.Context, pod *api.PodSandbox) error {
+	klog.V(2).Infof("StopPodSandbox pod %s/%s", pod.Namespace, pod.Name)
+	defer np.track()()
+	allocation, ok := np.podAllocations.Get(types.UID(pod.Uid))
+	if !ok {
+		klog.V(2).Infof("StopPodSandbox pod %s/%s does not have allocations", pod.Namespace, pod.Name)
+		return nil
+	}
+	defer np.deviceLocks.Lock(np.allocatedDevices(allocation)...)()
+	defer np.podAllocations.Remove(types.UID(pod.Uid))
+	defer np.deviceStates.Remove(types.UID(pod.Uid))
+	defer np.ipam.Release(pod.Uid)
+
+	// get the pod network namespace
+	ns, err := getNetworkNamespace(pod)
+	if err != nil {
+		return err
+	}
+	// TODO check host network namespace
+	if ns == "" {
+		klog.V(2).Infof("StopPodSandbox pod %s/%s using host network", pod.Namespace, pod.Name)
+	}
+
+	// delete the bonds first to release the slaves
 	for _, result := range allocation.Devices.Results {
-		klog.Infof("RunPodSandbox allocation.Devices.Result: %#v", result)
-		err := hostdevice.MoveLinkIn(result.Device, ns, result.Device)
+		if result.Driver != np.driverName {
+			continue
+		}
+		config, err := np.deviceConfig(allocation, result.Request)
+		if err != nil || config == nil || config.Mode != modeBond {
+			continue
+		}
+		name := config.bondName()
+		state, ok := np.deviceStates.Get(types.UID(pod.Uid), name)
+		if !ok {
+			continue
+		}
+		if err := restoreNetworkConfig(state.NetNS, name, state); err != nil {
+			klog.Infof("StopPodSandbox pod %s/%s failed to restore config for bond %s: %v", pod.Namespace, pod.Name, name, err)
+		}
+		if err := deleteBond(state.NetNS, name, np.bondSlaves(result.Request, config)); err != nil {
+			klog.Infof("StopPodSandbox pod %s/%s failed to delete bond %s: %v", pod.Namespace, pod.Name, name, err)
+		}
+	}
+
+	// release the network devices from the pod namespace
+	deletedTunnels := map[string]bool{}
+	for _, result := range allocation.Devices.Results {
+		if result.Driver != np.driverName {
+			continue
+		}
+		klog.Infof("StopPodSandbox allocation.Devices.Result: %#v", result)
+		device := np.linkName(result.Device)
+		// the device may be attached to the namespace in the device config
+		config, err := np.deviceConfig(allocation, result.Request)
 		if err != nil {
-			klog.Infof("RunPodSandbox error moving device %s to namespace %s: %v", result.Device, ns, err)
-			return err
+			klog.Infof("StopPodSandbox pod %s/%s invalid config for device %s: %v", pod.Namespace, pod.Name, device, err)
+		}
+		netns := config.namespace(ns)
+		if netns == "" {
+			continue
+		}
+		// the tunnels are deleted, the device was not moved
+		if config.isTunnel() {
+			name := config.tunnelName()
+			state, ok := np.deviceStates.Get(types.UID(pod.Uid), name)
+			if !ok || deletedTunnels[name] {
+				continue
+			}
+			deletedTunnels[name] = true
+			if err := restoreNetworkConfig(netns, name, state); err != nil {
+				klog.Infof("StopPodSandbox pod %s/%s failed to restore config for tunnel %s: %v", pod.Namespace, pod.Name, name, err)
+			}
+			if err := deleteLink(netns, name); err != nil {
+				klog.Infof("StopPodSandbox pod %s/%s failed to delete tunnel %s: %v", pod.Namespace, pod.Name, name, err)
+			}
+			continue
 		}
-		rdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(result.Device)
-		if err != nil {
-			klog.Infof("RunPodSandbox error getting RDMA device %s to namespace %s: %v", result.Device, ns, err)
+		// the devices are detached in the reverse order they were attached,
+		// and all the steps run even if one fails, deleting the namespace
+		// returns the devices to the root namespace anyway
+		ifName := config.interfaceName(result.Request, device)
+		state, ok := np.deviceStates.Get(types.UID(pod.Uid), device)
+		if ok {
+			if err := restoreNetworkConfig(netns, ifName, state); err != nil {
+				klog.Infof("StopPodSandbox pod %s/%s failed to restore config for device %s: %v", pod.Namespace, pod.Name, ifName, err)
+			}
+		}
+		if config.isHostTarget() {
 			continue
 		}
-		// TODO signal this via DRA
-		if rdmaDev != "" {
-			err = hostdevice.MoveRDMALinkIn(rdmaDev, ns)
-			if err != nil {
-				klog.Infof("RunPodSandbox error getting RDMA device %s to namespace %s: %v", result.Device, ns, err)
+		if state.RDMADevice != "" {
+			if err := hostdevice.MoveRDMALinkOut(netns, state.RDMADevice); err != nil {
+				klog.Infof("StopPodSandbox pod %s/%s failed to release RDMA device %s: %v", pod.Namespace, pod.Name, state.RDMADevice, err)
+			}
+		}
+		if err := hostdevice.MoveLinkOut(netns, ifName); err != nil {
+			// the kernel returns the devices to the host when the namespace
+			// is destroyed, with the name they had in the Pod
+			if isNetNSGone(err) {
+				klog.Infof("StopPodSandbox pod %s/%s network namespace %s is gone, restoring device %s name", pod.Namespace, pod.Name, netns, device)
+				if err := np.deviceNames.Restore(device, netnsReleaseTimeout); err != nil {
+					klog.Infof("StopPodSandbox pod %s/%s failed to restore device %s name: %v", pod.Namespace, pod.Name, device, err)
+				}
 				continue
 			}
+			klog.Infof("StopPodSandbox pod %s/%s failed to release device %s: %v", pod.Namespace, pod.Name, device, err)
+			continue
 		}
+		np.deviceNames.Remove(device)
 	}
 	return nil
 }
 
-func (np *NetworkPlugin) StopPodSandbox(ctx context.Context, pod *api.PodSandbox) error {
-	klog.V(2).Infof("StopPodSandbox pod %s/%s", pod.Namespace, pod.Name)
-	allocation, ok := np.podAllocations.Get(types.UID(pod.Uid))
-	if !ok {
-		klog.V(2).Infof("StopPodSandbox pod %s/%s does not have allocations", pod.Namespace, pod.Name)
+// deviceAttachment is a device of the request to attach to a network namespace
+// with the name ifName.
+type deviceAttachment struct {
+	device  string
+	request string
+	ifName  string
+	netns   string
+	config  *NetworkConfig
+}
+
+// attachDevices attaches the devices, except the ones of the host target, up
+// to maxParallelMoves at the same time. The devices that fail are rolled back
+// by attachDevice, and the devices attached are added to undo, so a failure of
+// any device or of a later step returns all of them to the host. The errors of
+// all the devices are returned.
+func (np *NetworkPlugin) attachDevices(ctx context.Context, pod *api.PodSandbox, attachments []deviceAttachment, undo *rollback) error {
+	// the devices of the host target are configured on the host
+	attachments = slices.DeleteFunc(slices.Clone(attachments), func(a deviceAttachment) bool {
+		return a.config.isHostTarget()
+	})
+	return attachAll(attachments, np.maxParallelMoves, undo,
+		func(a deviceAttachment) error {
+			return np.attachDevice(ctx, pod, a.device, a.ifName, a.netns, a.config)
+		},
+		func(a deviceAttachment) error {
+			return np.detachDevice(pod, a.device, a.ifName, a.netns)
+		})
+}
+
+// attachAll runs attach for the attachments, up to maxParallel at the same
+// time, and adds detach to undo for each attachment that succeeds. The
+// attachments stop on the first error when they run one by one.
+func attachAll(attachments []deviceAttachment, maxParallel int, undo *rollback, attach, detach func(deviceAttachment) error) error {
+	if maxParallel <= 1 || len(attachments) <= 1 {
+		for _, a := range attachments {
+			if err := attach(a); err != nil {
+				return err
+			}
+			undo.Add(func() error { return detach(a) })
+		}
 		return nil
 	}
-	defer np.podAllocations.Remove(types.UID(pod.Uid))
 
-	// get the pod network namespace
-	var ns string
-	for _, namespace := range pod.Linux.GetNamespaces() {
-		if namespace.Type == "network" {
-			ns = namespace.Path
-			break
-		}
+	var wg sync.WaitGroup
+	errs := make([]error, len(attachments))
+	sem := make(chan struct{}, maxParallel)
+	for i, a := range attachments {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = attach(a)
+		}()
 	}
-	// TODO check host network namespace
-	if ns == "" {
-		return nil
+	wg.Wait()
+	for i, a := range attachments {
+		if errs[i] == nil {
+			undo.Add(func() error { return detach(a) })
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	// release the network devices from the pod namespace
-	for _, config := range allocation.Devices.Config {
-		if config.Opaque == nil {
-			continue
+// detachDevice moves a device attached by attachDevice, and its RDMA device,
+// back to the host.
+func (np *NetworkPlugin) detachDevice(pod *api.PodSandbox, device string, ifName string, netns string) error {
+	var errs []error
+	if state, ok := np.deviceStates.Get(types.UID(pod.Uid), device); ok && state.RDMADevice != "" {
+		if err := hostdevice.MoveRDMALinkOut(netns, state.RDMADevice); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release RDMA device %s: %w", state.RDMADevice, err))
 		}
-		// TODO config.Request seems to be a sort of filter
-		klog.Infof("StopPodSandbox config.Opaque.Parameters: %s", config.Opaque.Parameters.String())
-		// TODO get config options here, it can add ips or commands
-		// to add routes, run dhcp, rename the interface ... whatever
 	}
+	if err := hostdevice.MoveLinkOut(netns, ifName); err != nil {
+		errs = append(errs, fmt.Errorf("failed to release device %s: %w", device, err))
+		return errors.Join(errs...)
+	}
+	np.deviceNames.Remove(device)
+	return errors.Join(errs...)
+}
 
-	// attach the network devices to the pod namespace
-	for _, result := range allocation.Devices.Results {
-		klog.Infof("StopPodSandbox allocation.Devices.Result: %#v", result)
-		err := hostdevice.MoveLinkOut(result.Device, ns)
+// attachDevice moves the device and its RDMA device to the network namespace,
+// with the name ifName, if a step fails the steps already done are undone in
+// reverse order.
+func (np *NetworkPlugin) attachDevice(ctx context.Context, pod *api.PodSandbox, device string, ifName string, netns string, config *NetworkConfig) (err error) {
+	var undo rollback
+	defer func() {
 		if err != nil {
-			// Swallow error as deleting the namespace will return the interface to the root namespace anyway
-			klog.V(2).Infof("StopPodSandbox pod %s/%s failed to deallocate interface", pod.Namespace, pod.Name)
-			return nil
+			if rollbackErr := undo.Run(); rollbackErr != nil {
+				klog.Infof("RunPodSandbox pod %s/%s failed to roll back device %s: %v", pod.Namespace, pod.Name, device, rollbackErr)
+			}
 		}
-		rdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(result.Device)
+	}()
+
+	// the RDMA device can not be obtained once the interface is moved, the
+	// RDMA devices are already visible in the namespace in shared mode
+	var rdmaDev string
+	if np.rdmaMode != RDMAModeShared {
+		rdmaDev, err = rdmamap.GetRdmaDeviceForNetdevice(device)
 		if err != nil {
-			klog.Infof("RunPodSandbox error getting RDMA device %s to namespace %s: %v", result.Device, ns, err)
-			continue
+			klog.V(2).Infof("RunPodSandbox device %s does not have an RDMA device: %v", device, err)
+			rdmaDev = ""
 		}
-		if rdmaDev != "" {
-			err = hostdevice.MoveRDMALinkIn(rdmaDev, ns)
-			if err != nil {
-				klog.Infof("RunPodSandbox error getting RDMA device %s to namespace %s: %v", result.Device, ns, err)
-				continue
-			}
+	}
+
+	np.deviceNames.Add(device)
+	deviceType := linkDeviceType(device)
+	err = retryOnTransientError(ctx, np.moveBackoff, func() error {
+		if config != nil && config.NoBringUp {
+			return hostdevice.MoveLinkInDown(device, netns, ifName)
+		}
+		return hostdevice.MoveLinkIn(device, netns, ifName, config != nil && config.PreserveConfig)
+	})
+	recordDeviceResult(moveTotal, deviceType, err)
+	if err != nil {
+		klog.Infof("RunPodSandbox error moving device %s to namespace %s: %v", device, netns, err)
+		return err
+	}
+	undo.Add(func() error {
+		if err := hostdevice.MoveLinkOut(netns, ifName); err != nil {
+			return err
+		}
+		np.deviceNames.Remove(device)
+		return nil
+	})
+
+	// TODO signal this via DRA
+	if rdmaDev != "" {
+		err = hostdevice.MoveRDMALinkIn(rdmaDev, netns)
+		recordDeviceResult(moveTotal, deviceTypeRDMA, err)
+		if err != nil {
+			return fmt.Errorf("failed to move RDMA device %s of device %s to namespace %s: %w", rdmaDev, device, netns, err)
 		}
+		np.deviceStates.Add(types.UID(pod.Uid), device, deviceState{NetNS: netns, RDMADevice: rdmaDev})
 	}
 	return nil
 }
@@ -290,177 +1205,214 @@ type gceNetworkInterface struct {
 	Mac     string   `json:"mac,omitempty"`
 	MTU     int      `json:"mtu,omitempty"`
 	Network string   `json:"network,omitempty"`
+	// MachineType is the machine type of the instance, it is not part of the
+	// network interface metadata.
+	MachineType string `json:"-"`
 }
 
-func (np *NetworkPlugin) PublishResources(ctx context.Context) {
-	klog.V(2).Infof("Publishing resources")
-	// Get google compute instance metadata for network interfaces
-	// https://cloud.google.com/compute/docs/metadata/predefined-metadata-keys
-
-	var gceInterfaces []gceNetworkInterface
-
-	if metadata.OnGCE() {
-		instanceName, err := metadata.InstanceNameWithContext(ctx)
-		if err != nil {
-			klog.Infof("could not get instance name on GCE .... skipping GCE network interface attributes: %v", err)
-		} else {
-			klog.Infof("Getting GCE network interface attributes for instance %s", instanceName)
-		}
-
-		// TODO Check accelerator type machines
-		instanceType, err := metadata.GetWithContext(ctx, "instance/machine-type")
-		if err != nil {
-			klog.Infof("could not get instance type on GCE .... skipping GCE network interface attributes: %v", err)
-		} else {
-			klog.Infof("Getting GCE accelerator attributes for instance type %s", instanceType)
-		}
-
-		//  curl "http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/?recursive=true" -H "Metadata-Flavor: Google"
-		// [{"accessConfigs":[{"externalIp":"35.225.164.134","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"10.128.0.1","ip":"10.128.0.70","ipAliases":["10.24.3.0/24"],"mac":"42:01:0a:80:00:46","mtu":1460,"network":"projects/628944397724/networks/default","subnetmask":"255.255.240.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.1.1","ip":"192.168.1.2","ipAliases":[],"mac":"42:01:c0:a8:01:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-1","subnetmask":"255.255.255.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.2.1","ip":"192.168.2.2","ipAliases":[],"mac":"42:01:c0:a8:02:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-2","subnetmask":"255.255.255.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.3.1","ip":"192.168.3.2","ipAliases":[],"mac":"42:01:c0:a8:03:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-3","subnetmask":"255.255.255.0","targetInstanceIps":[]},{"accessConfigs":[{"externalIp":"","type":"ONE_TO_ONE_NAT"}],"dnsServers":["169.254.169.254"],"forwardedIps":[],"gateway":"192.168.4.1","ip":"192.168.4.2","ipAliases":[],"mac":"42:01:c0:a8:04:02","mtu":8244,"network":"projects/628944397724/networks/aojea-dra-net-4","subnetmask":"255.255.255.0","targetInstanceIps":[]}]
-		gceInterfacesRaw, err := metadata.GetWithContext(ctx, "instance/network-interfaces/?recursive=true&alt=json")
-		if err != nil {
-			klog.Infof("could not get network interfaces on GCE .... skipping GCE network interface attributes: %v", err)
-		} else {
-			klog.Infof("Getting GCE accelerator attributes for instance type %s", instanceType)
-			if err = json.Unmarshal([]byte(gceInterfacesRaw), &gceInterfaces); err != nil {
-				klog.Infof("could not get network interfaces on GCE .... skipping GCE network interface attributes: %v", err)
-			}
+// gceNetworkAllowed returns true if the GCE network, in the format
+// projects/<project>/networks/<name>, is in the allowlist.
+func (np *NetworkPlugin) gceNetworkAllowed(network string) bool {
+	if network == "" {
+		return false
+	}
+	for _, allowed := range np.gceNetworks {
+		if allowed == network || allowed == path.Base(network) {
+			return true
 		}
-
 	}
+	return false
+}
 
+func (np *NetworkPlugin) PublishResources(ctx context.Context) {
+	klog.V(2).Infof("Publishing resources")
+	if len(np.gceNetworks) > 0 && !metadata.OnGCE() {
+		klog.Infof("GCE networks allowlist %v configured but not running on GCE, no interfaces will be published", np.gceNetworks)
+	}
 	// Resources are published periodically or if there is a netlink notification
 	// indicating a new interfaces was added or changed
-	nlChannel := make(chan netlink.LinkUpdate)
+	// the subscription is retried with backoff if it fails, meanwhile the
+	// resources are only published periodically.
 	doneCh := make(chan struct{})
 	defer close(doneCh)
-	if err := netlink.LinkSubscribe(nlChannel, doneCh); err != nil {
-		klog.Infof("error subscring to netlink interfaces: %v", err)
-	}
-	ticker := time.NewTicker(1 * time.Minute)
+	subscription := newLinkSubscription(doneCh, subscribeLinks, newSubscribeBackoff)
+	subscription.subscribe()
+	ticker := time.NewTicker(np.publishInterval)
 	defer ticker.Stop()
+	// the first publication waits for the node to settle, the new interfaces
+	// are published once they appear through the netlink notifications
+	start := time.Now()
+	var settleCh <-chan time.Time
+	if np.publishSettleDelay > 0 {
+		settleCh = time.After(np.publishSettleDelay)
+	}
+	settled := np.publishSettleDelay == 0 && np.expectedDevices == 0
+	// the first publication always happens
+	var lastResources kubeletplugin.Resources
+	published := false
 	for {
-		ifaces, err := net.Interfaces()
-		if err != nil {
-			klog.Infof("error getting system interfaces: %v", err)
+		resources := kubeletplugin.Resources{Devices: np.discoverDevices(np.gceInterfaces.Get(ctx))}
+		klog.V(4).Infof("Found following network interfaces %#v", resources.Devices)
+		if !settled {
+			settled = np.nodeSettled(len(resources.Devices), time.Since(start))
 		}
-		resources := kubeletplugin.Resources{}
-		for _, iface := range ifaces {
-			klog.V(7).Infof("Checking iface %s", iface.Name)
-			// skip default interface
-			if iface.Name == np.ifaceGw {
-				continue
-			}
-			// only interested in interfaces that match the regex
-			if len(validation.IsDNS1123Label(iface.Name)) > 0 {
-				klog.V(2).Infof("iface %s does not pass validation", iface.Name)
-				continue
-			}
-			// skip loopback interface
-			if iface.Flags&net.FlagLoopback == net.FlagLoopback {
-				continue
-			}
-			// publish this network interface
-			device := resourceapi.Device{
-				Name: iface.Name,
-				Basic: &resourceapi.BasicDevice{
-					Attributes: make(map[resourceapi.QualifiedName]resourceapi.DeviceAttribute),
-					Capacity:   make(map[resourceapi.QualifiedName]resource.Quantity),
-				},
-			}
-			device.Basic.Attributes["name"] = resourceapi.DeviceAttribute{StringValue: &iface.Name}
-
-			link, err := netlink.LinkByName(iface.Name)
-			if err != nil {
-				klog.Infof("Error getting link by name %v", err)
-				continue
-			}
-
-			switch link := link.(type) {
-			case *netlink.Veth:
-				// TODO improve this heuristic to detect veth associated to Pods
-				// link.PeerNamespace maybe
-				if link.PeerName == "eth0" {
-					continue
-				}
-				// Skip all veth interfaces
-				continue
-			default:
-			}
-			// iface attributes
-			linkType := link.Type()
-			linkAttrs := link.Attrs()
-
-			// TODO we can get more info from the kernel
-			// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-net
-			// Ref: https://github.com/canonical/lxd/blob/main/lxd/resources/network.go
-
-			// sriov device plugin has a more detailed and better discovery
-			// https://github.com/k8snetworkplumbingwg/sriov-network-device-plugin/blob/ed1c14dd4c313c7dd9fe4730a60358fbeffbfdd4/cmd/sriovdp/manager.go#L243
-
-			if ips, err := iface.Addrs(); err == nil && len(ips) > 0 {
-				// TODO assume only one addres by now
-				ip := ips[0].String()
-				device.Basic.Attributes["ip"] = resourceapi.DeviceAttribute{StringValue: &ip}
-				mac := iface.HardwareAddr.String()
-				device.Basic.Attributes["mac"] = resourceapi.DeviceAttribute{StringValue: &mac}
-				mtu := int64(iface.MTU)
-				device.Basic.Attributes["mtu"] = resourceapi.DeviceAttribute{IntValue: &mtu}
-			}
-
-			// check if there is GCE metadata associated
-			if len(gceInterfaces) > 0 {
-				mac := iface.HardwareAddr.String()
-				// this is bounded and small number O(N) is ok
-				for _, gceIf := range gceInterfaces {
-					if gceIf.Mac == mac {
-						device.Basic.Attributes["gceNetwork"] = resourceapi.DeviceAttribute{StringValue: &gceIf.Network}
-						break
-					}
-				}
-			}
-
-			device.Basic.Attributes["encapsulation"] = resourceapi.DeviceAttribute{StringValue: &linkAttrs.EncapType}
-			operState := linkAttrs.OperState.String()
-			device.Basic.Attributes["state"] = resourceapi.DeviceAttribute{StringValue: &operState}
-			device.Basic.Attributes["alias"] = resourceapi.DeviceAttribute{StringValue: &linkAttrs.Alias}
-			device.Basic.Attributes["type"] = resourceapi.DeviceAttribute{StringValue: &linkType}
-
-			isRDMA := rdmamap.IsRDmaDeviceForNetdevice(iface.Name)
-			device.Basic.Attributes["rdma"] = resourceapi.DeviceAttribute{BoolValue: &isRDMA}
-			// from https://github.com/k8snetworkplumbingwg/sriov-network-device-plugin/blob/ed1c14dd4c313c7dd9fe4730a60358fbeffbfdd4/pkg/netdevice/netDeviceProvider.go#L99
-			isSRIOV := sriovTotalVFs(iface.Name) > 0
-			device.Basic.Attributes["sriov"] = resourceapi.DeviceAttribute{BoolValue: &isSRIOV}
-			if isSRIOV {
-				vfs := int64(sriovNumVFs(iface.Name))
-				device.Basic.Attributes["sriov_vfs"] = resourceapi.DeviceAttribute{IntValue: &vfs}
+		if settled && len(resources.Devices) > 0 {
+			// avoid redundant writes to the API server if nothing changed
+			if published && apiequality.Semantic.DeepEqual(resources, lastResources) {
+				klog.V(4).Infof("Resources did not change, skipping publishing")
+				publishTotal.Add("skipped", 1)
+			} else {
+				np.publish(ctx, resources)
+				publishTotal.Add("published", 1)
+				lastResources = resources
+				published = true
+				np.healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 			}
-			resources.Devices = append(resources.Devices, device)
-		}
-
-		klog.V(4).Infof("Found following network interfaces %#v", resources.Devices)
-		if len(resources.Devices) > 0 {
-			np.draPlugin.PublishResources(ctx, resources)
 		}
 
 		select {
 		// trigger a reconcile
-		case <-nlChannel:
+		case _, ok := <-subscription.updates:
+			// the channel is closed if the subscription fails
+			if !ok {
+				subscription.closed()
+				continue
+			}
 			// poor man rate limited
 			time.Sleep(2 * time.Second)
 			// drain the channel
-			for len(nlChannel) > 0 {
-				<-nlChannel
+			for len(subscription.updates) > 0 {
+				<-subscription.updates
+			}
+		case <-subscription.retry:
+			if !subscription.subscribe() {
+				continue
 			}
+			// the interface changes may have been missed, publish again
+		case <-settleCh:
+			settleCh = nil
+		// the devices in use changed
+		case <-np.publishCh:
 		case <-ticker.C:
+			np.refreshReservedInterfaces(ctx)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
+// nodeSettled returns true if the node is initialized and the resources can be
+// published, once the expected number of devices is discovered or the settle
+// delay passed.
+func (np *NetworkPlugin) nodeSettled(devices int, elapsed time.Duration) bool {
+	if np.expectedDevices > 0 && devices >= np.expectedDevices {
+		klog.Infof("Found %d devices of the %d expected, publishing resources", devices, np.expectedDevices)
+		return true
+	}
+	if np.publishSettleDelay > 0 && elapsed >= np.publishSettleDelay {
+		klog.Infof("Settle delay %v passed with %d devices, publishing resources", np.publishSettleDelay, devices)
+		return true
+	}
+	klog.Infof("Waiting for the node to settle before publishing resources, found %d devices", devices)
+	return false
+}
+
+// triggerPublish publishes the resources without waiting for the publish
+// interval, the capacity of the devices depends on the devices in use.
+func (np *NetworkPlugin) triggerPublish() {
+	select {
+	case np.publishCh <- struct{}{}:
+	default:
+	}
+}
+
+// refreshReservedInterfaces reads the interfaces reserved for the node from
+// the Node annotation, the current reservation is kept if it fails.
+func (np *NetworkPlugin) refreshReservedInterfaces(ctx context.Context) {
+	node, err := np.kubeClient.CoreV1().Nodes().Get(ctx, np.nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Infof("failed to get node %s reserved interfaces: %v", np.nodeName, err)
+		return
+	}
+	np.reserved.SetAnnotation(node.Annotations[np.driverName+"/"+reservedInterfacesAnnotation])
+}
+
+// newSubscribeBackoff returns the backoff to retry the netlink subscription.
+func newSubscribeBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: 1 * time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      1 * time.Minute,
+	}
+}
+
+// linkSubscription is a subscription to the link updates that is retried with
+// backoff if it fails or it is closed.
+type linkSubscription struct {
+	doneCh      <-chan struct{}
+	subscribeFn func(doneCh <-chan struct{}) (chan netlink.LinkUpdate, error)
+	newBackoff  func() wait.Backoff
+	backoff     wait.Backoff
+	// updates receives the link updates, it is nil while not subscribed
+	updates chan netlink.LinkUpdate
+	// retry fires when the subscription has to be retried
+	retry <-chan time.Time
+}
+
+func newLinkSubscription(doneCh <-chan struct{}, subscribeFn func(doneCh <-chan struct{}) (chan netlink.LinkUpdate, error), newBackoff func() wait.Backoff) *linkSubscription {
+	return &linkSubscription{
+		doneCh:      doneCh,
+		subscribeFn: subscribeFn,
+		newBackoff:  newBackoff,
+		backoff:     newBackoff(),
+	}
+}
+
+// subscribe subscribes to the link updates and returns true on success, the
+// backoff is reset. On failure the retry is scheduled.
+func (s *linkSubscription) subscribe() bool {
+	s.retry = nil
+	updates, err := s.subscribeFn(s.doneCh)
+	if err != nil {
+		klog.Infof("error subscring to netlink interfaces: %v", err)
+		s.retry = time.After(s.backoff.Step())
+		return false
+	}
+	s.updates = updates
+	s.backoff = s.newBackoff()
+	return true
+}
+
+// closed schedules the retry of the subscription once the updates channel is
+// closed.
+func (s *linkSubscription) closed() {
+	klog.Infof("netlink subscription closed, resubscribing")
+	s.updates = nil
+	s.retry = time.After(s.backoff.Step())
+}
+
+// subscribeLinks subscribes to the link updates until doneCh is closed, the
+// returned channel is closed if the subscription fails.
+func subscribeLinks(doneCh <-chan struct{}) (chan netlink.LinkUpdate, error) {
+	nlChannel := make(chan netlink.LinkUpdate)
+	err := netlink.LinkSubscribeWithOptions(nlChannel, doneCh, netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			klog.Infof("netlink subscription error: %v", err)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nlChannel, nil
+}
+
 func (np *NetworkPlugin) NodePrepareResources(ctx context.Context, request *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
 	if request == nil {
 		return nil, nil
 	}
+	defer np.track()()
 	resp := &drapb.NodePrepareResourcesResponse{
 		Claims: make(map[string]*drapb.NodePrepareResourceResponse),
 	}
@@ -468,6 +1420,9 @@ func (np *NetworkPlugin) NodePrepareResources(ctx context.Context, request *drap
 	for _, claimReq := range request.GetClaims() {
 		klog.Infof("NodePrepareResources: Claim Request %#v", claimReq)
 		devices, err := np.nodePrepareResource(ctx, claimReq)
+		if err == nil && np.disableNRI {
+			err = np.attachClaim(ctx, claimReq)
+		}
 		if err != nil {
 			resp.Claims[claimReq.UID] = &drapb.NodePrepareResourceResponse{
 				Error: err.Error(),
@@ -484,11 +1439,34 @@ func (np *NetworkPlugin) NodePrepareResources(ctx context.Context, request *drap
 			resp.Claims[claimReq.UID] = r
 		}
 	}
+	np.triggerPublish()
 	return resp, nil
 
 }
 
-func (np *NetworkPlugin) nodePrepareResource(ctx context.Context, claimReq *drapb.Claim) ([]drapb.Device, error) {
+// preparedDevices returns the devices of the driver of a prepared claim.
+func (np *NetworkPlugin) preparedDevices(allocation resourceapi.AllocationResult) []drapb.Device {
+	var devices []drapb.Device
+	for _, result := range allocation.Devices.Results {
+		if result.Driver != np.driverName {
+			continue
+		}
+		devices = append(devices, drapb.Device{
+			PoolName:   result.Pool,
+			DeviceName: result.Device,
+		})
+	}
+	return devices
+}
+
+func (np *NetworkPlugin) nodePrepareResource(ctx context.Context, claimReq *drapb.Claim) (devices []drapb.Device, err error) {
+	// kubelet retries the claims that failed or were not acknowledged, the claim
+	// was already prepared if it is in the cache.
+	if allocation, ok := np.claimAllocations.Get(types.UID(claimReq.UID)); ok {
+		klog.V(2).Infof("claim %s/%s already prepared", claimReq.Namespace, claimReq.Name)
+		return np.preparedDevices(allocation), nil
+	}
+
 	// The plugin must retrieve the claim itself to get it in the version that it understands.
 	claim, err := np.kubeClient.ResourceV1alpha3().ResourceClaims(claimReq.Namespace).Get(ctx, claimReq.Name, metav1.GetOptions{})
 	if err != nil {
@@ -497,26 +1475,151 @@ func (np *NetworkPlugin) nodePrepareResource(ctx context.Context, claimReq *drap
 	if claim.Status.Allocation == nil {
 		return nil, fmt.Errorf("claim %s/%s not allocated", claimReq.Namespace, claimReq.Name)
 	}
-	if claim.UID != types.UID(claim.UID) {
+	if claim.UID != types.UID(claimReq.UID) {
 		return nil, fmt.Errorf("claim %s/%s got replaced", claimReq.Namespace, claimReq.Name)
 	}
-	np.claimAllocations.Add(claim.UID, *claim.Status.Allocation)
+	defer np.deviceLocks.Lock(np.allocatedDevices(*claim.Status.Allocation)...)()
+	// a concurrent retry of the claim may have prepared it while waiting for
+	// the devices
+	if allocation, ok := np.claimAllocations.Get(claim.UID); ok {
+		klog.V(2).Infof("claim %s/%s already prepared", claimReq.Namespace, claimReq.Name)
+		return np.preparedDevices(allocation), nil
+	}
 
-	for _, reserved := range claim.Status.ReservedFor {
-		if reserved.Resource != "pods" || reserved.APIGroup != "" {
-			klog.Infof("claim reference unsupported for %#v", reserved)
+	// the result of the claim is counted for each of its devices
+	var preparedTypes []string
+	defer func() {
+		for _, deviceType := range preparedTypes {
+			recordDeviceResult(prepareTotal, deviceType, err)
+		}
+	}()
+
+	// the dry run applies to all the devices of the claim, it has to be known
+	// before the VFs of the partitions are created
+	dryRun := false
+	for _, result := range claim.Status.Allocation.Devices.Results {
+		if result.Driver != np.driverName {
 			continue
 		}
-		np.podAllocations.Add(reserved.UID, *claim.Status.Allocation)
+		config, err := np.deviceConfig(*claim.Status.Allocation, result.Request)
+		if err != nil {
+			return nil, fmt.Errorf("claim %s/%s: %w", claimReq.Namespace, claimReq.Name, err)
+		}
+		if config != nil && config.DryRun {
+			dryRun = true
+		}
 	}
-	var devices []drapb.Device
+
+	// the partitions are released if the claim is not prepared, otherwise
+	// the VFs created for them are never removed
+	var partitions []string
+	defer func() {
+		if err == nil || len(partitions) == 0 {
+			return
+		}
+		for _, device := range partitions {
+			np.partitions.Remove(device)
+		}
+		np.releasePartitionVFs(*claim.Status.Allocation)
+	}()
+
+	// the interfaces of the devices selected by hardware address
+	resolved := map[string]string{}
 	for _, result := range claim.Status.Allocation.Devices.Results {
-		requestName := result.Request
-		for _, config := range claim.Status.Allocation.Devices.Config {
-			if config.Opaque == nil ||
-				config.Opaque.Driver != np.driverName ||
-				len(config.Requests) > 0 && !slices.Contains(config.Requests, requestName) {
-				continue
+		// the claim can contain devices allocated by other drivers
+		if result.Driver != np.driverName {
+			continue
+		}
+		preparedTypes = append(preparedTypes, np.deviceType(result.Device))
+		if result.Pool != np.pool() {
+			return nil, fmt.Errorf("claim %s/%s device %s is allocated from pool %s, the devices of the node are in pool %s", claimReq.Namespace, claimReq.Name, result.Device, result.Pool, np.pool())
+		}
+		if np.reserved.Has(result.Device) {
+			return nil, fmt.Errorf("claim %s/%s device %s is reserved for the node", claimReq.Namespace, claimReq.Name, result.Device)
+		}
+		// only the config addressed to this driver and request applies to the device
+		config, err := np.deviceConfig(*claim.Status.Allocation, result.Request)
+		if err != nil {
+			return nil, fmt.Errorf("claim %s/%s: %w", claimReq.Namespace, claimReq.Name, err)
+		}
+		if config.isHostTarget() && !slices.Contains(np.hostTargetNamespaces, claimReq.Namespace) {
+			return nil, fmt.Errorf("claim %s/%s request %s target %q is not allowed in namespace %s", claimReq.Namespace, claimReq.Name, result.Request, targetHost, claimReq.Namespace)
+		}
+		if config != nil && len(config.PostUpExec) > 0 && !slices.Contains(np.postUpExecNamespaces, claimReq.Namespace) {
+			return nil, fmt.Errorf("claim %s/%s request %s postUpExec is not allowed in namespace %s", claimReq.Namespace, claimReq.Name, result.Request, claimReq.Namespace)
+		}
+		if config != nil && config.NetNS != "" {
+			if err := validateNetNS(config.NetNS); err != nil {
+				return nil, fmt.Errorf("claim %s/%s: %w", claimReq.Namespace, claimReq.Name, err)
+			}
+		}
+		if np.disableNRI && config.namespace("") == "" {
+			return nil, fmt.Errorf("claim %s/%s request %s does not have a netns config, it is required if NRI is disabled", claimReq.Namespace, claimReq.Name, result.Request)
+		}
+		if config.isTunnel() {
+			if err := validateTunnelLocal(config); err != nil {
+				return nil, fmt.Errorf("claim %s/%s: %w", claimReq.Namespace, claimReq.Name, err)
+			}
+		}
+		if _, ok := config.interfaceNames()[result.Request]; ok {
+			count := 0
+			for _, r := range claim.Status.Allocation.Devices.Results {
+				if r.Driver == np.driverName && r.Request == result.Request {
+					count++
+				}
+			}
+			if count > 1 {
+				return nil, fmt.Errorf("claim %s/%s request %s has an interface name but allocates %d devices", claimReq.Namespace, claimReq.Name, result.Request, count)
+			}
+		}
+		// the VFs of the partitions are created on prepare, except in dry run mode
+		linkName := result.Device
+		_, _, isPartition := parsePartition(result.Device)
+		isPartition = isPartition && np.sriovPartitions
+		// the interface may have been renamed since the device was published
+		if config.selectsHardware() {
+			if isPartition {
+				return nil, fmt.Errorf("claim %s/%s request %s selects a hardware address but device %s is a partition", claimReq.Namespace, claimReq.Name, result.Request, result.Device)
+			}
+			linkName, err = np.resolveDeviceLink(result.Device, config)
+			if err != nil {
+				return nil, fmt.Errorf("claim %s/%s request %s: %w", claimReq.Namespace, claimReq.Name, result.Request, err)
+			}
+			for device, link := range resolved {
+				if link == linkName {
+					return nil, fmt.Errorf("claim %s/%s devices %s and %s select the same interface %s", claimReq.Namespace, claimReq.Name, device, result.Device, linkName)
+				}
+			}
+			resolved[result.Device] = linkName
+		}
+		// the VFs assigned to a partition are published as regular
+		// interfaces until they are attached to the Pod
+		if partition, ok := np.partitions.Owner(linkName); ok && !isPartition {
+			return nil, fmt.Errorf("claim %s/%s device %s is the VF of the partition %s", claimReq.Namespace, claimReq.Name, result.Device, partition)
+		}
+		if isPartition && !dryRun {
+			partitions = append(partitions, result.Device)
+			linkName, err = np.preparePartition(ctx, result.Device)
+			if err != nil {
+				return nil, fmt.Errorf("claim %s/%s: %w", claimReq.Namespace, claimReq.Name, err)
+			}
+		}
+		if _, err := netlink.LinkByName(linkName); err != nil && !(isPartition && dryRun) {
+			return nil, fmt.Errorf("claim %s/%s device %s not found: %w", claimReq.Namespace, claimReq.Name, result.Device, err)
+		}
+		// the selectors are evaluated on allocation, the link may renegotiate
+		// a lower speed before the claim is prepared
+		if config != nil && config.MinSpeedMbps > 0 && !(isPartition && dryRun) {
+			if speed := linkSpeed(linkName); speed < config.MinSpeedMbps {
+				return nil, fmt.Errorf("claim %s/%s device %s speed %d Mbps is lower than the minimum %d Mbps", claimReq.Namespace, claimReq.Name, result.Device, speed, config.MinSpeedMbps)
+			}
+		}
+		// the offloads are set when the Pod sandbox is created, once the
+		// interface is in the Pod network namespace, the unsupported ones fail
+		// the claim here instead of the Pod sandbox
+		if config != nil && len(config.Offloads) > 0 && !(isPartition && dryRun) {
+			if err := ethtoolCheckFeatures(linkName, config.Offloads); err != nil {
+				return nil, fmt.Errorf("claim %s/%s device %s: %w", claimReq.Namespace, claimReq.Name, result.Device, err)
 			}
 		}
 		device := drapb.Device{
@@ -526,18 +1629,114 @@ func (np *NetworkPlugin) nodePrepareResource(ctx context.Context, claimReq *drap
 		devices = append(devices, device)
 	}
 
+	// the slaves of the bonds are validated once the interfaces of all the
+	// devices are known
+	resolvedLink := func(device string) string {
+		if link, ok := resolved[device]; ok {
+			return link
+		}
+		return np.linkName(device)
+	}
+	for _, result := range claim.Status.Allocation.Devices.Results {
+		if result.Driver != np.driverName {
+			continue
+		}
+		config, _ := np.deviceConfig(*claim.Status.Allocation, result.Request)
+		if config != nil && config.Mode == modeBond {
+			if err := np.validateBond(*claim.Status.Allocation, result.Request, config, resolvedLink); err != nil {
+				return nil, fmt.Errorf("claim %s/%s: %w", claimReq.Namespace, claimReq.Name, err)
+			}
+		}
+	}
+
+	// dry run claims are validated but the devices are never attached to the pods
+	if dryRun {
+		klog.Infof("claim %s/%s validated in dry run mode", claimReq.Namespace, claimReq.Name)
+		return devices, nil
+	}
+
+	// the devices are attached when the Pod sandbox is created, if the claim is
+	// not reserved for a Pod the devices will never be attached.
+	if !slices.ContainsFunc(claim.Status.ReservedFor, isPodReference) {
+		return nil, fmt.Errorf("claim %s/%s is not reserved for a pod, only pods can use the devices", claimReq.Namespace, claimReq.Name)
+	}
+
+	if err := np.addClaimAllocation(claim.UID, *claim.Status.Allocation); err != nil {
+		return nil, fmt.Errorf("claim %s/%s %w", claimReq.Namespace, claimReq.Name, err)
+	}
+	for device, link := range resolved {
+		klog.V(2).Infof("claim %s/%s device %s resolved to interface %s", claimReq.Namespace, claimReq.Name, device, link)
+		np.resolvedLinks.Add(device, link)
+	}
+	// the devices are attached by the NRI hooks of the Pods
+	if np.disableNRI {
+		return devices, nil
+	}
+	for _, reserved := range claim.Status.ReservedFor {
+		if !isPodReference(reserved) {
+			klog.Infof("claim reference unsupported for %#v", reserved)
+			continue
+		}
+		np.podAllocations.Add(reserved.UID, *claim.Status.Allocation)
+	}
 	return devices, nil
 }
 
+// claimSandbox returns the sandbox that holds the devices of the claim when NRI
+// is disabled, it uses the claim UID instead of the Pod UID.
+func claimSandbox(claimReq *drapb.Claim) *api.PodSandbox {
+	return &api.PodSandbox{
+		Uid:       claimReq.UID,
+		Namespace: claimReq.Namespace,
+		Name:      claimReq.Name,
+	}
+}
+
+// attachClaim attaches the devices of the claim to the network namespace of
+// the config when NRI is disabled, the devices are detached and the claim is
+// not prepared if it fails, so kubelet retries it.
+func (np *NetworkPlugin) attachClaim(ctx context.Context, claimReq *drapb.Claim) error {
+	uid := types.UID(claimReq.UID)
+	allocation, ok := np.claimAllocations.Get(uid)
+	// the claims in dry run mode are not stored
+	if !ok {
+		return nil
+	}
+	// the claim was already attached
+	if _, ok := np.podAllocations.Get(uid); ok {
+		return nil
+	}
+	np.podAllocations.Add(uid, allocation)
+	if err := np.RunPodSandbox(ctx, claimSandbox(claimReq)); err != nil {
+		if stopErr := np.StopPodSandbox(ctx, claimSandbox(claimReq)); stopErr != nil {
+			klog.Infof("error detaching the devices of claim %s/%s : %v", claimReq.Namespace, claimReq.Name, stopErr)
+		}
+		np.claimAllocations.Remove(uid)
+		return err
+	}
+	return nil
+}
+
+// isPodReference returns true if the claim consumer is a Pod.
+func isPodReference(reserved resourceapi.ResourceClaimConsumerReference) bool {
+	return reserved.Resource == "pods" && reserved.APIGroup == ""
+}
+
 func (np *NetworkPlugin) NodeUnprepareResources(ctx context.Context, request *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
 	if request == nil {
 		return nil, nil
 	}
+	defer np.track()()
 	resp := &drapb.NodeUnprepareResourcesResponse{
 		Claims: make(map[string]*drapb.NodeUnprepareResourceResponse),
 	}
 
 	for _, claimReq := range request.Claims {
+		if np.disableNRI {
+			if err := np.StopPodSandbox(ctx, claimSandbox(claimReq)); err != nil {
+				klog.Infof("error detaching the devices of claim %s/%s : %v", claimReq.Namespace, claimReq.Name, err)
+			}
+		}
 		err := np.nodeUnprepareResource(ctx, claimReq)
 		if err != nil {
 			klog.Infof("error unpreparing ressources for claim %s/%s : %v", claimReq.Namespace, claimReq.Name, err)
@@ -548,6 +1747,7 @@ func (np *NetworkPlugin) NodeUnprepareResources(ctx context.Context, request *dr
 			resp.Claims[claimReq.UID] = &drapb.NodeUnprepareResourceResponse{}
 		}
 	}
+	np.triggerPublish()
 	return resp, nil
 }
 
@@ -557,8 +1757,48 @@ func (np *NetworkPlugin) nodeUnprepareResource(ctx context.Context, claimReq *dr
 		klog.Infof("claim request does not exist %s/%s %s", claimReq.Namespace, claimReq.Name, claimReq.UID)
 		return nil
 	}
+	defer np.deviceLocks.Lock(np.allocatedDevices(allocation)...)()
+	// the VFs of the partitions are removed once the claim is released
+	defer np.releasePartitionVFs(allocation)
 	defer np.claimAllocations.Remove(types.UID(claimReq.UID))
 	klog.Infof("claim %s/%s with allocation %#v", claimReq.Namespace, claimReq.Name, allocation)
-	// TODO do unpreparing things
+	// The configuration is reverted when the Pod sandbox stops, if it is still
+	// present the Pod did not release the devices. The cleanup is best effort,
+	// the config may be partially applied or the namespace may be gone.
+	for _, result := range allocation.Devices.Results {
+		if result.Driver != np.driverName {
+			continue
+		}
+		device := np.linkName(result.Device)
+		defer np.partitions.Remove(result.Device)
+		defer np.resolvedLinks.Remove(result.Device)
+		// the config was validated on prepare
+		config, _ := np.deviceConfig(allocation, result.Request)
+		ifName := config.interfaceName(result.Request, device)
+		for uid, state := range np.deviceStates.Pop(device) {
+			klog.Infof("claim %s/%s device %s was not released by pod %s, cleaning up", claimReq.Namespace, claimReq.Name, device, uid)
+			np.ipam.Release(string(uid))
+			// the device is moved back to the host even if its config is not
+			// restored, otherwise it is stranded in the namespace
+			if err := restoreNetworkConfig(state.NetNS, ifName, state); err != nil {
+				klog.Infof("claim %s/%s failed to restore config for device %s: %v", claimReq.Namespace, claimReq.Name, device, err)
+			}
+			if config.isHostTarget() {
+				continue
+			}
+			if state.RDMADevice != "" {
+				if err := hostdevice.MoveRDMALinkOut(state.NetNS, state.RDMADevice); err != nil {
+					klog.Infof("claim %s/%s failed to move RDMA device %s out of namespace %s: %v", claimReq.Namespace, claimReq.Name, state.RDMADevice, state.NetNS, err)
+				}
+			}
+			if err := hostdevice.MoveLinkOut(state.NetNS, ifName); err != nil {
+				klog.Infof("claim %s/%s failed to move device %s out of namespace %s: %v", claimReq.Namespace, claimReq.Name, device, state.NetNS, err)
+				continue
+			}
+			np.deviceNames.Remove(device)
+		}
+	}
+	// the devices return to the host if the Pod network namespace was destroyed
+	np.deviceNames.Reconcile()
 	return nil
 }
@@ -0,0 +1,1053 @@
+package dra
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
+)
+
+// newAllocation returns an allocation of the devices by the driver.
+func newAllocation(driver string, devices ...string) resourceapi.AllocationResult {
+	allocation := resourceapi.AllocationResult{}
+	for _, device := range devices {
+		allocation.Devices.Results = append(allocation.Devices.Results, resourceapi.DeviceRequestAllocationResult{
+			Request: "req-" + device,
+			Driver:  driver,
+			Pool:    "node",
+			Device:  device,
+		})
+	}
+	return allocation
+}
+
+// newTestPlugin returns a plugin of the node "node" with a fake API server
+// that has the objects.
+func newTestPlugin(objects ...runtime.Object) *NetworkPlugin {
+	return &NetworkPlugin{
+		driverName:       "dra.net",
+		nodeName:         "node",
+		kubeClient:       fake.NewSimpleClientset(objects...),
+		podAllocations:   storage{cache: map[types.UID]resourceapi.AllocationResult{}},
+		claimAllocations: storage{cache: map[types.UID]resourceapi.AllocationResult{}},
+		deviceLocks:      deviceLocks{locks: map[string]*sync.Mutex{}},
+		deviceStates:     podDeviceStates{cache: map[types.UID]map[string]deviceState{}},
+		deviceNames:      &deviceNames{names: map[string]string{}},
+		ipam:             &ipamStore{allocations: map[string]map[string]string{}},
+		resolvedLinks:    resolvedLinks{links: map[string]string{}},
+		partitions:       vfPartitions{netdevs: map[string]string{}, created: map[string]bool{}},
+	}
+}
+
+// newClaim returns a claim with the allocation reserved for the consumers.
+func newClaim(uid types.UID, allocation resourceapi.AllocationResult, reservedFor ...resourceapi.ResourceClaimConsumerReference) *resourceapi.ResourceClaim {
+	return &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "default", UID: uid},
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation:  &allocation,
+			ReservedFor: reservedFor,
+		},
+	}
+}
+
+func TestNodePrepareResourceReplacedClaim(t *testing.T) {
+	tests := []struct {
+		name     string
+		claimUID types.UID
+		wantErr  bool
+	}{
+		{
+			name:     "same claim",
+			claimUID: "claim-uid",
+		},
+		{
+			name:     "claim replaced",
+			claimUID: "new-claim-uid",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the claim does not have devices of the driver
+			claim := newClaim(tt.claimUID, newAllocation("other.driver", "eth1"),
+				resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+			np := newTestPlugin(claim)
+			_, err := np.nodePrepareResource(context.Background(), &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "got replaced") {
+				t.Errorf("nodePrepareResource() error = %v, want the claim replaced error", err)
+			}
+		})
+	}
+}
+
+func TestAddClaimAllocation(t *testing.T) {
+	tests := []struct {
+		name        string
+		limit       int
+		allocated   [][]string
+		claim       []string
+		wantErr     bool
+		wantDevices int
+	}{
+		{
+			name:        "no limit",
+			allocated:   [][]string{{"eth1", "eth2"}},
+			claim:       []string{"eth3"},
+			wantDevices: 3,
+		},
+		{
+			name:        "within limit",
+			limit:       3,
+			allocated:   [][]string{{"eth1"}},
+			claim:       []string{"eth2", "eth3"},
+			wantDevices: 3,
+		},
+		{
+			name:        "quota exceeded",
+			limit:       2,
+			allocated:   [][]string{{"eth1"}},
+			claim:       []string{"eth2", "eth3"},
+			wantErr:     true,
+			wantDevices: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			np := &NetworkPlugin{
+				driverName:          "dra.net",
+				claimAllocations:    storage{cache: map[types.UID]resourceapi.AllocationResult{}},
+				maxAllocatedDevices: tt.limit,
+			}
+			for i, devices := range tt.allocated {
+				np.claimAllocations.Add(types.UID(fmt.Sprintf("allocated-%d", i)), newAllocation(np.driverName, devices...))
+			}
+			err := np.addClaimAllocation("claim", newAllocation(np.driverName, tt.claim...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("addClaimAllocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			devices := 0
+			for _, allocation := range np.claimAllocations.List() {
+				devices += len(np.allocatedDevices(allocation))
+			}
+			if devices != tt.wantDevices {
+				t.Errorf("allocated devices = %d, want %d", devices, tt.wantDevices)
+			}
+		})
+	}
+}
+
+func TestAddClaimAllocationConcurrent(t *testing.T) {
+	const limit = 5
+	np := &NetworkPlugin{
+		driverName:          "dra.net",
+		claimAllocations:    storage{cache: map[types.UID]resourceapi.AllocationResult{}},
+		maxAllocatedDevices: limit,
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			device := fmt.Sprintf("eth%d", i)
+			if err := np.addClaimAllocation(types.UID(device), newAllocation(np.driverName, device)); err == nil {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if added != limit {
+		t.Errorf("added %d claims, want %d", added, limit)
+	}
+	if got := len(np.claimAllocations.List()); got != limit {
+		t.Errorf("stored %d claims, want %d", got, limit)
+	}
+}
+
+func TestAttachAllRollback(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxParallel int
+		devices     []string
+		failing     string
+		// laterStep fails a step after all the devices are attached
+		laterStep    bool
+		wantErr      bool
+		wantAttached []string
+	}{
+		{
+			name:         "all attached",
+			maxParallel:  1,
+			devices:      []string{"eth1", "eth2", "eth3"},
+			wantAttached: []string{"eth1", "eth2", "eth3"},
+		},
+		{
+			name:        "one by one stops on the first error",
+			maxParallel: 1,
+			devices:     []string{"eth1", "eth2", "eth3"},
+			failing:     "eth2",
+			wantErr:     true,
+		},
+		{
+			name:        "parallel partial failure",
+			maxParallel: 4,
+			devices:     []string{"eth1", "eth2", "eth3"},
+			failing:     "eth2",
+			wantErr:     true,
+		},
+		{
+			name:        "later step fails",
+			maxParallel: 4,
+			devices:     []string{"eth1", "eth2", "eth3"},
+			laterStep:   true,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attached := map[string]bool{}
+			attach := func(a deviceAttachment) error {
+				if a.device == tt.failing {
+					return fmt.Errorf("failed to attach %s", a.device)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				attached[a.device] = true
+				return nil
+			}
+			detach := func(a deviceAttachment) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if !attached[a.device] {
+					return fmt.Errorf("device %s is not attached", a.device)
+				}
+				delete(attached, a.device)
+				return nil
+			}
+			var attachments []deviceAttachment
+			for _, device := range tt.devices {
+				attachments = append(attachments, deviceAttachment{device: device, ifName: device})
+			}
+
+			var undo rollback
+			err := attachAll(attachments, tt.maxParallel, &undo, attach, detach)
+			if err == nil && tt.laterStep {
+				err = fmt.Errorf("failed to configure the devices")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("attachAll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if rollbackErr := undo.Run(); rollbackErr != nil {
+					t.Fatalf("rollback error = %v", rollbackErr)
+				}
+			}
+			for _, device := range tt.wantAttached {
+				if !attached[device] {
+					t.Errorf("device %s is not attached", device)
+				}
+			}
+			if len(attached) != len(tt.wantAttached) {
+				t.Errorf("attached devices = %v, want %v", attached, tt.wantAttached)
+			}
+		})
+	}
+}
+
+func TestAttachAllConcurrency(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxParallel int
+		devices     int
+		want        int
+	}{
+		{
+			name:        "one by one",
+			maxParallel: 1,
+			devices:     6,
+			want:        1,
+		},
+		{
+			name:        "bounded",
+			maxParallel: 3,
+			devices:     6,
+			want:        3,
+		},
+		{
+			name:        "less devices than the bound",
+			maxParallel: 8,
+			devices:     4,
+			want:        4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			running, maxRunning := 0, 0
+			attach := func(a deviceAttachment) error {
+				mu.Lock()
+				running++
+				maxRunning = max(maxRunning, running)
+				mu.Unlock()
+				// the moves overlap long enough to reach the bound
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			}
+			detach := func(a deviceAttachment) error { return nil }
+			var attachments []deviceAttachment
+			for i := range tt.devices {
+				device := fmt.Sprintf("eth%d", i)
+				attachments = append(attachments, deviceAttachment{device: device, ifName: device})
+			}
+
+			var undo rollback
+			if err := attachAll(attachments, tt.maxParallel, &undo, attach, detach); err != nil {
+				t.Fatalf("attachAll() error = %v", err)
+			}
+			if maxRunning != tt.want {
+				t.Errorf("attachAll() attached %d devices at the same time, want %d", maxRunning, tt.want)
+			}
+			if len(undo) != tt.devices {
+				t.Errorf("attachAll() added %d rollback steps, want %d", len(undo), tt.devices)
+			}
+		})
+	}
+}
+
+func TestRollbackRun(t *testing.T) {
+	var got []int
+	var undo rollback
+	for i := range 3 {
+		undo.Add(func() error {
+			got = append(got, i)
+			if i == 1 {
+				return fmt.Errorf("step %d failed", i)
+			}
+			return nil
+		})
+	}
+	if err := undo.Run(); err == nil {
+		t.Errorf("Run() expected an error")
+	}
+	// all the steps run in reverse order even if one fails
+	if fmt.Sprint(got) != fmt.Sprint([]int{2, 1, 0}) {
+		t.Errorf("Run() order = %v, want [2 1 0]", got)
+	}
+}
+
+func TestNodePrepareResourceIdempotent(t *testing.T) {
+	// the loopback interface exists in any network namespace
+	claim := newClaim("claim-uid", newAllocation("dra.net", "lo"),
+		resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+	np := newTestPlugin(claim)
+	claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+
+	first, err := np.nodePrepareResource(context.Background(), claimReq)
+	if err != nil {
+		t.Fatalf("nodePrepareResource() error = %v", err)
+	}
+	actions := len(np.kubeClient.(*fake.Clientset).Actions())
+	// kubelet retries the claim
+	second, err := np.nodePrepareResource(context.Background(), claimReq)
+	if err != nil {
+		t.Fatalf("nodePrepareResource() retry error = %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("nodePrepareResource() retry devices = %v, want %v", second, first)
+	}
+	if got := len(np.kubeClient.(*fake.Clientset).Actions()); got != actions {
+		t.Errorf("the retry must use the prepared claim, got %d API requests", got-actions)
+	}
+	if got := len(np.claimAllocations.List()); got != 1 {
+		t.Errorf("stored %d claims, want 1", got)
+	}
+	if got := len(np.podAllocations.List()); got != 1 {
+		t.Errorf("stored %d pod allocations, want 1", got)
+	}
+}
+
+func TestNodePrepareResourceConcurrent(t *testing.T) {
+	claim := newClaim("claim-uid", newAllocation("dra.net", "lo"),
+		resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+	np := newTestPlugin(claim)
+	claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+	// the devices prepared are counted once per full prepare
+	prepared := func() int64 {
+		results, ok := prepareTotal.Get(np.deviceType("lo")).(*expvar.Map)
+		if !ok {
+			results = prepareTotal.Get(deviceTypeOther).(*expvar.Map)
+		}
+		if success, ok := results.Get("success").(*expvar.Int); ok {
+			return success.Value()
+		}
+		return 0
+	}
+	before := prepared()
+	// the retries are received while the claim is retrieved
+	np.kubeClient.(*fake.Clientset).PrependReactor("get", "resourceclaims", func(k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(50 * time.Millisecond)
+		return false, nil, nil
+	})
+
+	// kubelet retries the claim while the first prepare is still running
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = np.nodePrepareResource(context.Background(), claimReq)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("nodePrepareResource() error = %v", err)
+		}
+	}
+	if got := prepared() - before; got != 1 {
+		t.Errorf("the claim was prepared %d times, want 1", got)
+	}
+	if got := len(np.podAllocations.List()); got != 1 {
+		t.Errorf("stored %d pod allocations, want 1", got)
+	}
+}
+
+func TestDeviceLocks(t *testing.T) {
+	locks := deviceLocks{locks: map[string]*sync.Mutex{}}
+	// the operations on the same devices, in any order, are serialized and
+	// the race detector reports the unprotected accesses
+	counters := map[string]int{}
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devices := []string{"eth1", "eth2"}
+			if i%2 == 0 {
+				devices = []string{"eth2", "eth1", "eth2"}
+			}
+			defer locks.Lock(devices...)()
+			for _, device := range devices {
+				counters[device]++
+			}
+		}()
+	}
+	wg.Wait()
+	if counters["eth1"] != 50 || counters["eth2"] != 75 {
+		t.Errorf("counters = %v, want eth1 50 and eth2 75", counters)
+	}
+}
+
+func TestDeviceLocksIndependent(t *testing.T) {
+	locks := deviceLocks{locks: map[string]*sync.Mutex{}}
+	unlock := locks.Lock("eth1")
+	defer unlock()
+	// other devices can be locked while eth1 is locked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		locks.Lock("eth2")()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the lock of eth2 is blocked by the lock of eth1")
+	}
+}
+
+func TestLinkSubscriptionResubscribe(t *testing.T) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var channels []chan netlink.LinkUpdate
+	calls := 0
+	subscribe := func(<-chan struct{}) (chan netlink.LinkUpdate, error) {
+		calls++
+		// the first subscription fails
+		if calls == 1 {
+			return nil, fmt.Errorf("netlink socket error")
+		}
+		ch := make(chan netlink.LinkUpdate, 1)
+		channels = append(channels, ch)
+		return ch, nil
+	}
+	newBackoff := func() wait.Backoff {
+		return wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: math.MaxInt32, Cap: 10 * time.Millisecond}
+	}
+	waitRetry := func(s *linkSubscription) {
+		t.Helper()
+		select {
+		case <-s.retry:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the subscription was not retried")
+		}
+	}
+
+	s := newLinkSubscription(doneCh, subscribe, newBackoff)
+	if s.subscribe() {
+		t.Fatalf("subscribe() succeeded, want a failure")
+	}
+	if s.updates != nil {
+		t.Errorf("the updates channel must be nil while not subscribed")
+	}
+	waitRetry(s)
+	if !s.subscribe() {
+		t.Fatalf("subscribe() failed on retry")
+	}
+
+	// the subscription is closed, per example if the netlink socket fails
+	close(channels[0])
+	if _, ok := <-s.updates; ok {
+		t.Fatalf("expected the updates channel to be closed")
+	}
+	s.closed()
+	if s.updates != nil {
+		t.Errorf("the updates channel must be nil once closed")
+	}
+	waitRetry(s)
+	if !s.subscribe() {
+		t.Fatalf("subscribe() failed on retry")
+	}
+	if calls != 3 {
+		t.Errorf("subscribed %d times, want 3", calls)
+	}
+	channels[1] <- netlink.LinkUpdate{}
+	if _, ok := <-s.updates; !ok {
+		t.Errorf("the updates must be received after resubscribing")
+	}
+}
+
+func TestNodePrepareResourceReservedFor(t *testing.T) {
+	pod := resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"}
+	deployment := resourceapi.ResourceClaimConsumerReference{APIGroup: "apps", Resource: "deployments", Name: "deployment", UID: "deployment-uid"}
+	tests := []struct {
+		name        string
+		reservedFor []resourceapi.ResourceClaimConsumerReference
+		wantErr     bool
+		wantPods    int
+	}{
+		{
+			name:        "pod",
+			reservedFor: []resourceapi.ResourceClaimConsumerReference{pod},
+			wantPods:    1,
+		},
+		{
+			name:        "pod and other resource",
+			reservedFor: []resourceapi.ResourceClaimConsumerReference{deployment, pod},
+			wantPods:    1,
+		},
+		{
+			name:        "only other resource",
+			reservedFor: []resourceapi.ResourceClaimConsumerReference{deployment},
+			wantErr:     true,
+		},
+		{
+			name:    "not reserved",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			np := newTestPlugin(newClaim("claim-uid", newAllocation("dra.net", "lo"), tt.reservedFor...))
+			_, err := np.nodePrepareResource(context.Background(), &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// the devices that will never be attached are not prepared
+				if _, ok := np.claimAllocations.Get("claim-uid"); ok {
+					t.Errorf("the claim must not be prepared")
+				}
+			}
+			if got := len(np.podAllocations.List()); got != tt.wantPods {
+				t.Errorf("stored %d pod allocations, want %d", got, tt.wantPods)
+			}
+		})
+	}
+}
+
+func TestStopPodSandboxNetNSGone(t *testing.T) {
+	np := newTestPlugin()
+	// the network namespace of the Pod was destroyed before the sandbox is
+	// stopped, the kernel already returned the devices to the host
+	netns := filepath.Join(t.TempDir(), "netns")
+	pod := &api.PodSandbox{
+		Id:        "sandbox",
+		Name:      "pod",
+		Namespace: "default",
+		Uid:       "pod-uid",
+		Linux: &api.LinuxPodSandbox{
+			Namespaces: []*api.LinuxNamespace{{Type: "network", Path: netns}},
+		},
+	}
+	np.podAllocations.Add(types.UID(pod.Uid), newAllocation("dra.net", "eth1", "eth2"))
+	np.deviceStates.Add(types.UID(pod.Uid), "eth1", deviceState{NetNS: netns})
+	np.deviceStates.Add(types.UID(pod.Uid), "eth2", deviceState{NetNS: netns})
+
+	if err := np.StopPodSandbox(context.Background(), pod); err != nil {
+		t.Fatalf("StopPodSandbox() error = %v", err)
+	}
+	if _, ok := np.podAllocations.Get(types.UID(pod.Uid)); ok {
+		t.Errorf("the allocation of the Pod was not removed")
+	}
+	for _, device := range []string{"eth1", "eth2"} {
+		if _, ok := np.deviceStates.Get(types.UID(pod.Uid), device); ok {
+			t.Errorf("the state of the device %s was not removed", device)
+		}
+	}
+	// the devices are not locked
+	np.deviceLocks.Lock("eth1", "eth2")()
+}
+
+func TestAttachDeviceNoBringUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *NetworkConfig
+		wantUp bool
+	}{
+		{
+			name:   "without config",
+			wantUp: true,
+		},
+		{
+			name:   "brought up",
+			config: &NetworkConfig{TxQueueLen: 1000},
+			wantUp: true,
+		},
+		{
+			name:   "no bring up",
+			config: &NetworkConfig{NoBringUp: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostNS := newTestNS(t)
+			podNS := newTestNS(t)
+			addTestVeth(t, hostNS, "eth1")
+			np := newTestPlugin()
+			np.moveBackoff = wait.Backoff{Steps: 1}
+			pod := &api.PodSandbox{Name: "pod", Namespace: "default", Uid: "pod-uid"}
+			err := hostNS.Do(func(ns.NetNS) error {
+				return np.attachDevice(context.Background(), pod, "eth1", "net1", podNS.Path(), tt.config)
+			})
+			if err != nil {
+				t.Fatalf("attachDevice() error = %v", err)
+			}
+			err = podNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName("net1")
+				if err != nil {
+					return err
+				}
+				if up := link.Attrs().Flags&net.FlagUp != 0; up != tt.wantUp {
+					return fmt.Errorf("device up = %v, want %v", up, tt.wantUp)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNodePrepareResourceOtherDrivers(t *testing.T) {
+	opaque := func(driver string, parameters string, requests ...string) resourceapi.DeviceAllocationConfiguration {
+		return resourceapi.DeviceAllocationConfiguration{
+			Source:   resourceapi.AllocationConfigSourceClaim,
+			Requests: requests,
+			DeviceConfiguration: resourceapi.DeviceConfiguration{
+				Opaque: &resourceapi.OpaqueDeviceConfiguration{
+					Driver:     driver,
+					Parameters: runtime.RawExtension{Raw: []byte(parameters)},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		config  []resourceapi.DeviceAllocationConfiguration
+		wantErr bool
+	}{
+		{
+			name: "no config",
+		},
+		{
+			name: "config of other driver not valid for this driver",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("gpu.example.com", `{"ipv4":"all","sharing":{"strategy":"TimeSlicing"}}`),
+			},
+		},
+		{
+			name: "invalid config for a request of other driver",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("dra.net", `{"ipv4":["not-an-address"]}`, "req-gpu0"),
+			},
+		},
+		{
+			name: "invalid config for the request",
+			config: []resourceapi.DeviceAllocationConfiguration{
+				opaque("gpu.example.com", `{"sharing":{"strategy":"TimeSlicing"}}`),
+				opaque("dra.net", `{"ipv4":["not-an-address"]}`, "req-lo"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the claim has devices of this and other drivers
+			allocation := newAllocation("dra.net", "lo")
+			allocation.Devices.Results = append(allocation.Devices.Results, newAllocation("gpu.example.com", "gpu0").Devices.Results...)
+			allocation.Devices.Config = tt.config
+			claim := newClaim("claim-uid", allocation,
+				resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+			np := newTestPlugin(claim)
+			claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+
+			devices, err := np.nodePrepareResource(context.Background(), claimReq)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := []drapb.Device{{PoolName: "node", DeviceName: "lo"}}
+			if !reflect.DeepEqual(devices, want) {
+				t.Errorf("nodePrepareResource() devices = %v, want %v", devices, want)
+			}
+		})
+	}
+}
+
+func TestNodePrepareResourceMinSpeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		speed    string
+		minSpeed int
+		wantErr  bool
+	}{
+		{
+			name:     "speed over the minimum",
+			speed:    "100000\n",
+			minSpeed: 100000,
+		},
+		{
+			name:     "speed dropped after the allocation",
+			speed:    "25000\n",
+			minSpeed: 100000,
+			wantErr:  true,
+		},
+		{
+			name:     "speed unknown",
+			speed:    "-1\n",
+			minSpeed: 100000,
+			wantErr:  true,
+		},
+		{
+			name:  "no minimum",
+			speed: "25000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, map[string]string{"class/net/lo/speed": tt.speed})
+			allocation := newAllocation("dra.net", "lo")
+			allocation.Devices.Config = []resourceapi.DeviceAllocationConfiguration{{
+				Source: resourceapi.AllocationConfigSourceClaim,
+				DeviceConfiguration: resourceapi.DeviceConfiguration{
+					Opaque: &resourceapi.OpaqueDeviceConfiguration{
+						Driver:     "dra.net",
+						Parameters: runtime.RawExtension{Raw: []byte(fmt.Sprintf(`{"minSpeedMbps":%d}`, tt.minSpeed))},
+					},
+				},
+			}}
+			claim := newClaim("claim-uid", allocation,
+				resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+			np := newTestPlugin(claim)
+			claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+			_, err := np.nodePrepareResource(context.Background(), claimReq)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNodePrepareResourceOffloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		offloads string
+		wantErr  bool
+	}{
+		{
+			name:     "kernel feature name",
+			offloads: `{"tx-checksum-ip-generic":false}`,
+		},
+		{
+			name:     "ethtool alias",
+			offloads: `{"tso":false}`,
+		},
+		{
+			name:     "unsupported feature",
+			offloads: `{"tx-checksum-ip-generic":false,"no-such-offload":false}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocation := newAllocation("dra.net", "lo")
+			allocation.Devices.Config = []resourceapi.DeviceAllocationConfiguration{{
+				Source: resourceapi.AllocationConfigSourceClaim,
+				DeviceConfiguration: resourceapi.DeviceConfiguration{
+					Opaque: &resourceapi.OpaqueDeviceConfiguration{
+						Driver:     "dra.net",
+						Parameters: runtime.RawExtension{Raw: []byte(fmt.Sprintf(`{"offloads":%s}`, tt.offloads))},
+					},
+				},
+			}}
+			claim := newClaim("claim-uid", allocation,
+				resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+			np := newTestPlugin(claim)
+			claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+			_, err := np.nodePrepareResource(context.Background(), claimReq)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublishPoolName(t *testing.T) {
+	np := newTestPlugin()
+	np.poolName = "rack-1"
+	np.nodeUID = "node-uid"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	np.publish(ctx, kubeletplugin.Resources{Devices: []resourceapi.Device{
+		{Name: "eth1", Basic: &resourceapi.BasicDevice{}},
+	}})
+	defer np.sliceController.Stop()
+
+	var slices []resourceapi.ResourceSlice
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		list, err := np.kubeClient.ResourceV1alpha3().ResourceSlices().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		slices = list.Items
+		return len(slices) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("the resource slices were not published: %v", err)
+	}
+	for _, slice := range slices {
+		if slice.Spec.Pool.Name != "rack-1" || slice.Spec.Driver != "dra.net" || slice.Spec.NodeName != "node" {
+			t.Errorf("published slice pool %s driver %s node %s, want pool rack-1 driver dra.net node node", slice.Spec.Pool.Name, slice.Spec.Driver, slice.Spec.NodeName)
+		}
+	}
+}
+
+func TestNodePrepareResourcePool(t *testing.T) {
+	tests := []struct {
+		name     string
+		poolName string
+		pool     string
+		wantErr  bool
+	}{
+		{
+			name: "node pool",
+			pool: "node",
+		},
+		{
+			name:     "configured pool",
+			poolName: "rack-1",
+			pool:     "rack-1",
+		},
+		{
+			name:     "node pool with configured pool",
+			poolName: "rack-1",
+			pool:     "node",
+			wantErr:  true,
+		},
+		{
+			name:    "other node pool",
+			pool:    "node-2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocation := newAllocation("dra.net", "lo")
+			allocation.Devices.Results[0].Pool = tt.pool
+			claim := newClaim("claim-uid", allocation,
+				resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+			np := newTestPlugin(claim)
+			np.poolName = tt.poolName
+			claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+			devices, err := np.nodePrepareResource(context.Background(), claimReq)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(devices) != 1 || devices[0].PoolName != tt.pool) {
+				t.Errorf("nodePrepareResource() devices = %v, want the device in pool %s", devices, tt.pool)
+			}
+		})
+	}
+}
+
+func TestHostTarget(t *testing.T) {
+	hostNS := newTestNS(t)
+	podNS := newTestNS(t)
+	link := addTestVeth(t, hostNS, "eth1")
+	oldHostNetNSPath := hostNetNSPath
+	hostNetNSPath = hostNS.Path()
+	t.Cleanup(func() { hostNetNSPath = oldHostNetNSPath })
+
+	allocation := newAllocation("dra.net", "eth1")
+	allocation.Devices.Config = []resourceapi.DeviceAllocationConfiguration{{
+		Source: resourceapi.AllocationConfigSourceClaim,
+		DeviceConfiguration: resourceapi.DeviceConfiguration{
+			Opaque: &resourceapi.OpaqueDeviceConfiguration{
+				Driver:     "dra.net",
+				Parameters: runtime.RawExtension{Raw: []byte(`{"target":"host","ipv4":["192.168.1.2/24"],"routes":[{"destination":"10.0.0.0/8","gateway":"192.168.1.1"}]}`)},
+			},
+		},
+	}}
+	np := newTestPlugin()
+	np.moveBackoff = wait.Backoff{Steps: 1}
+	pod := &api.PodSandbox{
+		Name:      "agent",
+		Namespace: "kube-system",
+		Uid:       "pod-uid",
+		Linux: &api.LinuxPodSandbox{
+			Namespaces: []*api.LinuxNamespace{{Type: "network", Path: podNS.Path()}},
+		},
+	}
+	np.podAllocations.Add(types.UID(pod.Uid), allocation)
+
+	// hostConfig returns the addresses and routes of the device, that
+	// remains on the host
+	hostConfig := func() ([]string, []string) {
+		var addrs, routes []string
+		err := hostNS.Do(func(ns.NetNS) error {
+			addrList, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrList {
+				addrs = append(addrs, addr.IPNet.String())
+			}
+			routeList, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			for _, route := range routeList {
+				if route.Gw != nil {
+					routes = append(routes, route.Dst.String())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("the device is not on the host: %v", err)
+		}
+		return addrs, routes
+	}
+
+	if err := np.RunPodSandbox(context.Background(), pod); err != nil {
+		t.Fatalf("RunPodSandbox() error = %v", err)
+	}
+	addrs, routes := hostConfig()
+	if !reflect.DeepEqual(addrs, []string{"192.168.1.2/24"}) || !reflect.DeepEqual(routes, []string{"10.0.0.0/8"}) {
+		t.Errorf("host config after RunPodSandbox addresses %v routes %v, want [192.168.1.2/24] [10.0.0.0/8]", addrs, routes)
+	}
+	err := podNS.Do(func(ns.NetNS) error {
+		if _, err := netlink.LinkByName("eth1"); err == nil {
+			return fmt.Errorf("the device was moved to the Pod")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := np.StopPodSandbox(context.Background(), pod); err != nil {
+		t.Fatalf("StopPodSandbox() error = %v", err)
+	}
+	if addrs, routes := hostConfig(); len(addrs) > 0 || len(routes) > 0 {
+		t.Errorf("host config after StopPodSandbox addresses %v routes %v, want none", addrs, routes)
+	}
+}
+
+func TestNodePrepareResourceHostTarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		wantErr    bool
+	}{
+		{
+			name:    "no namespace allowed",
+			wantErr: true,
+		},
+		{
+			name:       "namespace allowed",
+			namespaces: []string{"kube-system", "default"},
+		},
+		{
+			name:       "other namespace allowed",
+			namespaces: []string{"kube-system"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocation := newAllocation("dra.net", "lo")
+			allocation.Devices.Config = []resourceapi.DeviceAllocationConfiguration{{
+				Source: resourceapi.AllocationConfigSourceClaim,
+				DeviceConfiguration: resourceapi.DeviceConfiguration{
+					Opaque: &resourceapi.OpaqueDeviceConfiguration{
+						Driver:     "dra.net",
+						Parameters: runtime.RawExtension{Raw: []byte(`{"target":"host","ipv4":["192.168.1.2/24"]}`)},
+					},
+				},
+			}}
+			claim := newClaim("claim-uid", allocation,
+				resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+			np := newTestPlugin(claim)
+			np.hostTargetNamespaces = tt.namespaces
+			claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+			if _, err := np.nodePrepareResource(context.Background(), claimReq); (err != nil) != tt.wantErr {
+				t.Errorf("nodePrepareResource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// postUpExecTimeout is the maximum time the post up command can run.
+const postUpExecTimeout = 10 * time.Second
+
+// postUpExecRule is the subset of a command that can be executed inside the
+// Pod network namespace. The commands run as root in the driver, so the
+// arguments that read files or reach other network namespaces are denied.
+type postUpExecRule struct {
+	// options are the global options allowed before the subcommand
+	options []string
+	// subcommands are the objects or the operations allowed as the first
+	// argument after the options
+	subcommands []string
+	// denied are the arguments not allowed anywhere, the commands accept the
+	// abbreviations of the keywords so their prefixes are denied too
+	denied []string
+}
+
+// postUpExecAllowlist are the binaries that can be executed inside the Pod
+// network namespace and the arguments they accept, they only can modify the
+// network configuration of the namespace.
+var postUpExecAllowlist = map[string]postUpExecRule{
+	"ip": {
+		options:     []string{"-4", "-6"},
+		subcommands: []string{"link", "address", "addr", "route", "rule", "neighbor", "neighbour", "neigh"},
+		denied:      []string{"netns", "link-netns", "link-netnsid", "netnsid", "exec"},
+	},
+	"tc": {
+		subcommands: []string{"qdisc", "class", "filter"},
+		denied:      []string{"bpf", "ebpf", "object-file", "object-pinned", "obj", "exec"},
+	},
+	"bridge": {
+		subcommands: []string{"link", "fdb", "vlan", "mdb"},
+		denied:      []string{"netns"},
+	},
+	"ethtool": {
+		subcommands: []string{"-K", "--features", "--offload", "-G", "--set-ring", "-L", "--set-channels", "-C", "--coalesce", "-A", "--pause", "-s", "--change"},
+	},
+}
+
+// validatePostUpExec checks the command and its arguments are in the
+// allowlist, the command is looked up in the driver PATH so it can not be a
+// path.
+func validatePostUpExec(command []string) error {
+	if len(command) == 0 {
+		return nil
+	}
+	rule, ok := postUpExecAllowlist[command[0]]
+	if !ok {
+		commands := make([]string, 0, len(postUpExecAllowlist))
+		for name := range postUpExecAllowlist {
+			commands = append(commands, name)
+		}
+		sort.Strings(commands)
+		return fmt.Errorf("postUpExec command %q not allowed, only %s are supported", command[0], strings.Join(commands, ", "))
+	}
+	args := command[1:]
+	for len(args) > 0 && slices.Contains(rule.options, args[0]) {
+		args = args[1:]
+	}
+	if len(args) == 0 || !slices.Contains(rule.subcommands, args[0]) {
+		return fmt.Errorf("postUpExec %s arguments %q not allowed, the first argument must be one of %s", command[0], strings.Join(command[1:], " "), strings.Join(slices.Concat(rule.options, rule.subcommands), ", "))
+	}
+	for _, arg := range args[1:] {
+		for _, denied := range rule.denied {
+			if len(arg) >= 2 && strings.HasPrefix(denied, arg) {
+				return fmt.Errorf("postUpExec %s argument %q not allowed", command[0], arg)
+			}
+		}
+	}
+	return nil
+}
+
+// runPostUpExec runs the command in the current network namespace, the IFNAME
+// token in the arguments is replaced by the interface name. The command output
+// is returned in the error if it fails.
+func runPostUpExec(ifName string, command []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postUpExecTimeout)
+	defer cancel()
+
+	args := make([]string, 0, len(command)-1)
+	for _, arg := range command[1:] {
+		args = append(args, strings.ReplaceAll(arg, ifNameToken, ifName))
+	}
+	out, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("postUpExec %q failed: %w, output: %s", strings.Join(command, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package dra
+
+import (
+	"testing"
+)
+
+func TestValidatePostUpExec(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "ip route",
+			command: []string{"ip", "route", "add", "10.0.0.0/8", "dev", "IFNAME"},
+		},
+		{
+			name:    "ip with family option",
+			command: []string{"ip", "-6", "route", "add", "fd00::/64", "dev", "IFNAME"},
+		},
+		{
+			name:    "tc qdisc",
+			command: []string{"tc", "qdisc", "add", "dev", "IFNAME", "root", "fq"},
+		},
+		{
+			name:    "ethtool offloads",
+			command: []string{"ethtool", "-K", "IFNAME", "gro", "off"},
+		},
+		{
+			name:    "bridge vlan",
+			command: []string{"bridge", "vlan", "add", "dev", "IFNAME", "vid", "100"},
+		},
+		{
+			name:    "command not allowed",
+			command: []string{"sh", "-c", "id"},
+			wantErr: true,
+		},
+		{
+			name:    "command path",
+			command: []string{"/sbin/ip", "link"},
+			wantErr: true,
+		},
+		{
+			name:    "ip netns exec",
+			command: []string{"ip", "netns", "exec", "host", "sh"},
+			wantErr: true,
+		},
+		{
+			name:    "ip batch file",
+			command: []string{"ip", "-batch", "/etc/commands"},
+			wantErr: true,
+		},
+		{
+			name:    "ip netns option",
+			command: []string{"ip", "-n", "host", "link", "set", "eth0", "down"},
+			wantErr: true,
+		},
+		{
+			name:    "ip link move to other namespace",
+			command: []string{"ip", "link", "set", "IFNAME", "netns", "1"},
+			wantErr: true,
+		},
+		{
+			name:    "ip link move to other namespace abbreviated",
+			command: []string{"ip", "link", "set", "IFNAME", "netn", "1"},
+			wantErr: true,
+		},
+		{
+			name:    "tc bpf object",
+			command: []string{"tc", "filter", "add", "dev", "IFNAME", "ingress", "bpf", "obj", "/tmp/prog.o"},
+			wantErr: true,
+		},
+		{
+			name:    "tc batch file",
+			command: []string{"tc", "-batch", "/etc/commands"},
+			wantErr: true,
+		},
+		{
+			name:    "ethtool eeprom",
+			command: []string{"ethtool", "-E", "IFNAME", "magic", "0x1", "offset", "0", "value", "0"},
+			wantErr: true,
+		},
+		{
+			name:    "ethtool flash",
+			command: []string{"ethtool", "--flash", "IFNAME", "firmware.bin"},
+			wantErr: true,
+		},
+		{
+			name:    "no subcommand",
+			command: []string{"ip", "-4"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePostUpExec(tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePostUpExec(%q) error = %v, wantErr %v", tt.command, err, tt.wantErr)
+			}
+		})
+	}
+}
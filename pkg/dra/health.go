@@ -0,0 +1,44 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"k8s.io/klog/v2"
+)
+
+// startHealthServer serves the gRPC health checking and reflection services on
+// the unix socket until the context is cancelled. The kubelet plugin library
+// creates the DRA server and only registers the DRA and registration services
+// on it, the interceptors it accepts are not called for unknown services, so
+// the health service is exposed on its own socket next to the plugin socket.
+func startHealthServer(ctx context.Context, socketPath string, healthServer *health.Server) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove socket %s: %w", socketPath, err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	go func() {
+		<-ctx.Done()
+		healthServer.Shutdown()
+		server.Stop()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			klog.Infof("health server failed: %v", err)
+		}
+	}()
+	return nil
+}
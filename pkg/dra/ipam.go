@@ -0,0 +1,234 @@
+package dra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// ipamHostLocal allocates the addresses from a range of a subnet local to the
+// node, like the CNI host-local IPAM plugin.
+const ipamHostLocal = "host-local"
+
+// IPAMConfig allocates an address to the interface instead of configuring it
+// statically.
+//
+//	{"ipam":{"type":"host-local","subnet":"10.10.0.0/24","rangeStart":"10.10.0.10","rangeEnd":"10.10.0.100"}}
+type IPAMConfig struct {
+	// Type is the IPAM type, only host-local is supported.
+	Type string `json:"type"`
+	// Subnet in CIDR format the addresses are allocated from.
+	Subnet string `json:"subnet"`
+	// RangeStart is the first address to allocate, the first address of the
+	// subnet if not set.
+	RangeStart string `json:"rangeStart,omitempty"`
+	// RangeEnd is the last address to allocate, the last address of the
+	// subnet if not set.
+	RangeEnd string `json:"rangeEnd,omitempty"`
+	// Gateway is the address of the subnet gateway, it is not allocated.
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Validate checks the subnet and the range are valid.
+func (c *IPAMConfig) Validate() error {
+	if c.Type != ipamHostLocal {
+		return fmt.Errorf("unknown ipam type %q, only %q is supported", c.Type, ipamHostLocal)
+	}
+	_, subnet, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid ipam subnet %q: %w", c.Subnet, err)
+	}
+	for _, address := range []string{c.RangeStart, c.RangeEnd, c.Gateway} {
+		if address == "" {
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil || !subnet.Contains(ip) {
+			return fmt.Errorf("ipam address %q is not in the subnet %s", address, c.Subnet)
+		}
+	}
+	first, last := c.ipRange(subnet)
+	if first.Cmp(last) > 0 {
+		return fmt.Errorf("invalid ipam range %s-%s", c.RangeStart, c.RangeEnd)
+	}
+	return nil
+}
+
+// ipRange returns the first and last addresses of the range as integers, the
+// network and broadcast addresses of IPv4 subnets are excluded.
+func (c *IPAMConfig) ipRange(subnet *net.IPNet) (*big.Int, *big.Int) {
+	first := ipToInt(subnet.IP)
+	last := new(big.Int).Or(first, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(maskHostBits(subnet))), big.NewInt(1)))
+	if subnet.IP.To4() != nil && maskHostBits(subnet) > 1 {
+		first.Add(first, big.NewInt(1))
+		last.Sub(last, big.NewInt(1))
+	}
+	if ip := net.ParseIP(c.RangeStart); ip != nil {
+		first = ipToInt(ip)
+	}
+	if ip := net.ParseIP(c.RangeEnd); ip != nil {
+		last = ipToInt(ip)
+	}
+	return first, last
+}
+
+func maskHostBits(subnet *net.IPNet) int {
+	ones, bits := subnet.Mask.Size()
+	return bits - ones
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func intToIP(i *big.Int, ipv4 bool) net.IP {
+	size := net.IPv6len
+	if ipv4 {
+		size = net.IPv4len
+	}
+	return net.IP(i.FillBytes(make([]byte, size)))
+}
+
+// ipamStore records persistently the addresses allocated per subnet, so the
+// allocations survive the driver restarts. The owner of an address is the Pod
+// UID and the interface name.
+type ipamStore struct {
+	mu   sync.Mutex
+	path string
+	// allocations maps the subnet to the allocated addresses and their owner
+	allocations map[string]map[string]string
+}
+
+// loadIPAMStore reads the allocations recorded in the file path.
+func loadIPAMStore(path string) (*ipamStore, error) {
+	s := &ipamStore{path: path, allocations: map[string]map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s.allocations); err != nil {
+		return s, fmt.Errorf("failed to parse ipam file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Allocate returns the address in CIDR format allocated to the owner, it
+// allocates the first free address of the range if the owner has none.
+func (s *ipamStore) Allocate(config *IPAMConfig, owner string) (string, error) {
+	_, subnet, err := net.ParseCIDR(config.Subnet)
+	if err != nil {
+		return "", err
+	}
+	prefix, _ := subnet.Mask.Size()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allocated, ok := s.allocations[subnet.String()]
+	if !ok {
+		allocated = map[string]string{}
+		s.allocations[subnet.String()] = allocated
+	}
+	// the Pod sandbox creation may be retried
+	for ip, o := range allocated {
+		if o == owner {
+			return fmt.Sprintf("%s/%d", ip, prefix), nil
+		}
+	}
+	ipv4 := subnet.IP.To4() != nil
+	first, last := config.ipRange(subnet)
+	for i := first; i.Cmp(last) <= 0; i.Add(i, big.NewInt(1)) {
+		ip := intToIP(i, ipv4).String()
+		if _, ok := allocated[ip]; ok || ip == net.ParseIP(config.Gateway).String() {
+			continue
+		}
+		allocated[ip] = owner
+		if err := s.save(); err != nil {
+			delete(allocated, ip)
+			return "", err
+		}
+		return fmt.Sprintf("%s/%d", ip, prefix), nil
+	}
+	return "", fmt.Errorf("no free addresses in the ipam range of subnet %s", config.Subnet)
+}
+
+// Release frees the addresses allocated to the Pod.
+func (s *ipamStore) Release(podUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	released := false
+	for subnet, allocated := range s.allocations {
+		for ip, owner := range allocated {
+			if strings.HasPrefix(owner, podUID+"/") {
+				klog.V(2).Infof("releasing address %s of %s", ip, owner)
+				delete(allocated, ip)
+				released = true
+			}
+		}
+		if len(allocated) == 0 {
+			delete(s.allocations, subnet)
+		}
+	}
+	if !released {
+		return
+	}
+	if err := s.save(); err != nil {
+		klog.Infof("failed to save the ipam allocations: %v", err)
+	}
+}
+
+// save writes the allocations to a temporary file and renames it, so the file
+// is not corrupted if the driver crashes while writing.
+func (s *ipamStore) save() error {
+	data, err := json.Marshal(s.allocations)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// ipamConfig returns the configuration with the address allocated by the IPAM
+// to the interface of the Pod added, or the same configuration if it does not
+// use IPAM.
+func (np *NetworkPlugin) ipamConfig(podUID string, ifName string, config *NetworkConfig) (*NetworkConfig, error) {
+	if config == nil || config.IPAM == nil {
+		return config, nil
+	}
+	address, err := np.ipam.Allocate(config.IPAM, podUID+"/"+ifName)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("ipam allocated address %s to %s of pod %s", address, ifName, podUID)
+	withAddress := *config
+	if strings.Contains(address, ":") {
+		withAddress.IPv6 = append(slices.Clone(config.IPv6), address)
+	} else {
+		withAddress.IPv4 = append(slices.Clone(config.IPv4), address)
+	}
+	return &withAddress, nil
+}
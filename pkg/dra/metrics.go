@@ -0,0 +1,131 @@
+package dra
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+)
+
+// Metrics are exported using expvar on /debug/vars.
+var (
+	// publishTotal counts the resources publishing cycles by result,
+	// "published" if the resources were sent to the API server or "skipped"
+	// if they did not change since the last publication.
+	publishTotal = expvar.NewMap("network_driver_publish_total")
+	// prepareTotal counts the devices of the claims prepared by device type
+	// and result, "success" or "error".
+	prepareTotal = newDeviceTypeMap("network_driver_prepare_total")
+	// moveTotal counts the devices moved into the Pod network namespace by
+	// device type and result, "success" or "error".
+	moveTotal = newDeviceTypeMap("network_driver_move_total")
+	// networkDevices is the number of published devices that are not
+	// allocated by cloud network, updated on each discovery.
+	networkDevices = expvar.NewMap("network_driver_network_devices")
+)
+
+// The device types of the metrics, the set is bounded to keep the cardinality
+// of the metrics low, the types not known are reported as "other".
+const (
+	deviceTypePhysical = "physical"
+	deviceTypeVF       = "vf"
+	deviceTypeMacvlan  = "macvlan"
+	deviceTypeVlan     = "vlan"
+	deviceTypeRDMA     = "rdma"
+	deviceTypeTunnel   = "tunnel"
+	deviceTypeOther    = "other"
+)
+
+var deviceTypes = []string{
+	deviceTypePhysical,
+	deviceTypeVF,
+	deviceTypeMacvlan,
+	deviceTypeVlan,
+	deviceTypeRDMA,
+	deviceTypeTunnel,
+	deviceTypeOther,
+}
+
+// newDeviceTypeMap returns a metric with a map of results for each device
+// type, so the metrics are exported with all the types even if they are zero.
+func newDeviceTypeMap(name string) *expvar.Map {
+	m := expvar.NewMap(name)
+	for _, deviceType := range deviceTypes {
+		results := new(expvar.Map).Init()
+		results.Add("success", 0)
+		results.Add("error", 0)
+		m.Set(deviceType, results)
+	}
+	return m
+}
+
+// recordNetworkDevices sets the number of devices that are not allocated on
+// each cloud network, the networks without devices are removed.
+func recordNetworkDevices(devices []resourceapi.Device, allocatedLinks map[string]bool) {
+	available := map[string]int64{}
+	for _, device := range devices {
+		attr, ok := device.Basic.Attributes["cloud_network"]
+		if !ok || attr.StringValue == nil {
+			continue
+		}
+		if !allocatedLinks[device.Name] {
+			available[*attr.StringValue]++
+		} else if _, ok := available[*attr.StringValue]; !ok {
+			available[*attr.StringValue] = 0
+		}
+	}
+	networkDevices.Init()
+	for network, count := range available {
+		value := new(expvar.Int)
+		value.Set(count)
+		networkDevices.Set(network, value)
+	}
+}
+
+// recordDeviceResult counts the result of an operation on a device type.
+func recordDeviceResult(m *expvar.Map, deviceType string, err error) {
+	results, ok := m.Get(deviceType).(*expvar.Map)
+	if !ok {
+		results = m.Get(deviceTypeOther).(*expvar.Map)
+	}
+	if err != nil {
+		results.Add("error", 1)
+	} else {
+		results.Add("success", 1)
+	}
+}
+
+// linkDeviceType returns the device type of the metrics for the interface, it
+// must be called while the interface is in the host network namespace.
+func linkDeviceType(name string) string {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return deviceTypeOther
+	}
+	switch link.(type) {
+	case *netlink.Macvlan:
+		return deviceTypeMacvlan
+	case *netlink.Vlan:
+		return deviceTypeVlan
+	case *netlink.Gretun, *netlink.Iptun, *netlink.Vxlan:
+		return deviceTypeTunnel
+	case *netlink.Device:
+		// the virtual functions have a link to their physical function
+		if _, err := os.Stat(filepath.Join(sysfsnet, name, "device", "physfn")); err == nil {
+			return deviceTypeVF
+		}
+		return deviceTypePhysical
+	}
+	return deviceTypeOther
+}
+
+// deviceType returns the device type of the metrics for an allocated device,
+// the partitions are virtual functions even if they are not created yet.
+func (np *NetworkPlugin) deviceType(device string) string {
+	if _, _, ok := parsePartition(device); ok && np.sriovPartitions {
+		return deviceTypeVF
+	}
+	return linkDeviceType(np.linkName(device))
+}
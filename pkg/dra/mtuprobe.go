@@ -0,0 +1,177 @@
+package dra
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// mtuProbeAttempts is the number of probes sent to each gateway, the probe
+	// is retried if the reply is lost.
+	mtuProbeAttempts = 3
+	// mtuProbeTimeout is the time to wait for the reply of each probe.
+	mtuProbeTimeout = 1 * time.Second
+	// https://www.iana.org/assignments/icmp-parameters
+	icmpEchoReply       = 0
+	icmpDestUnreachable = 3
+	icmpFragNeeded      = 4
+	icmpEchoRequest     = 8
+	// https://www.iana.org/assignments/icmpv6-parameters
+	icmpv6PacketTooBig  = 2
+	icmpv6EchoRequest   = 128
+	icmpv6EchoReply     = 129
+	ipv4HeaderLen       = 20
+	ipv6HeaderLen       = 40
+	icmpHeaderLen       = 8
+	icmpProbeIdentifier = 0x6b6e
+)
+
+// errFragmentationNeeded is returned if the probe does not fit the path MTU.
+var errFragmentationNeeded = errors.New("fragmentation needed")
+
+// verifyMTU sends an ICMP echo request of the size of the interface MTU, that
+// can not be fragmented, to the gateways of the routes of the configuration
+// inside the network namespace nsPath. It fails if a gateway does not reply,
+// so the fabric does not forward the jumbo frames.
+func verifyMTU(nsPath string, ifName string, config *NetworkConfig) error {
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer containerNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %s: %w", ifName, err)
+		}
+		mtu := link.Attrs().MTU
+		probed := map[string]bool{}
+		for _, route := range config.Routes {
+			for _, gateway := range route.gateways() {
+				if probed[gateway] {
+					continue
+				}
+				probed[gateway] = true
+				gw := net.ParseIP(gateway)
+				if err := probeMTU(gw, mtu); err != nil {
+					return fmt.Errorf("MTU %d of %s verification to gateway %s failed: %w", mtu, ifName, gw.String(), err)
+				}
+				klog.V(2).Infof("MTU %d of %s verified to gateway %s", mtu, ifName, gw.String())
+			}
+		}
+		return nil
+	})
+}
+
+// probeMTU sends an echo request that fills the mtu to the destination, with
+// fragmentation disabled, and waits for the reply.
+func probeMTU(dst net.IP, mtu int) error {
+	network, request, reply, level, opt, value := "ip4:icmp", icmpEchoRequest, icmpEchoReply, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO
+	size := mtu - ipv4HeaderLen - icmpHeaderLen
+	if dst.To4() == nil {
+		network, request, reply, level, opt, value = "ip6:ipv6-icmp", icmpv6EchoRequest, icmpv6EchoReply, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1
+		size = mtu - ipv6HeaderLen - icmpHeaderLen
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid MTU %d", mtu)
+	}
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rawConn, err := conn.(*net.IPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to disable fragmentation: %w", sockErr)
+	}
+
+	for seq := 1; seq <= mtuProbeAttempts; seq++ {
+		msg := make([]byte, icmpHeaderLen+size)
+		msg[0] = byte(request)
+		binary.BigEndian.PutUint16(msg[4:], icmpProbeIdentifier)
+		binary.BigEndian.PutUint16(msg[6:], uint16(seq))
+		// the kernel computes the checksum of the ICMPv6 messages
+		if dst.To4() != nil {
+			binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+		}
+		if _, err := conn.WriteTo(msg, &net.IPAddr{IP: dst}); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				return errFragmentationNeeded
+			}
+			return err
+		}
+		err := waitEchoReply(conn, reply, seq)
+		if err == nil || errors.Is(err, errFragmentationNeeded) {
+			return err
+		}
+		klog.V(2).Infof("MTU probe %d to %s failed: %v", seq, dst.String(), err)
+	}
+	return fmt.Errorf("no reply to %d probes of %d bytes", mtuProbeAttempts, mtu)
+}
+
+// waitEchoReply reads the ICMP messages until the echo reply of the probe seq
+// or an error reporting the packet is too big are received.
+func waitEchoReply(conn net.PacketConn, reply int, seq int) error {
+	if err := conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout)); err != nil {
+		return err
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return fmt.Errorf("timeout waiting for the reply")
+			}
+			return err
+		}
+		if n < icmpHeaderLen {
+			continue
+		}
+		msgType, code := int(buf[0]), int(buf[1])
+		switch {
+		case msgType == reply:
+			if binary.BigEndian.Uint16(buf[4:]) == icmpProbeIdentifier && int(binary.BigEndian.Uint16(buf[6:])) == seq {
+				return nil
+			}
+		case reply == icmpEchoReply && msgType == icmpDestUnreachable && code == icmpFragNeeded:
+			return fmt.Errorf("%w, path MTU %d", errFragmentationNeeded, binary.BigEndian.Uint16(buf[6:]))
+		case reply == icmpv6EchoReply && msgType == icmpv6PacketTooBig:
+			return fmt.Errorf("%w, path MTU %d", errFragmentationNeeded, binary.BigEndian.Uint32(buf[4:]))
+		}
+	}
+}
+
+// icmpChecksum returns the internet checksum of the message.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
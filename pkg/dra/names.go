@@ -0,0 +1,236 @@
+package dra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aojea/kubernetes-network-driver/pkg/hostdevice"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// deviceNames records persistently the host name of the devices attached to
+// the Pods. MoveLinkOut restores the host name from the interface alias, but if
+// the Pod network namespace is destroyed the kernel returns the interface to the
+// host with the name it had in the Pod, or a kernel assigned name if it is in
+// use. The devices are identified by their permanent MAC or PCI address, that
+// do not change when the interfaces are renamed.
+type deviceNames struct {
+	mu   sync.Mutex
+	path string
+	// names maps the hardware identifier to the host name
+	names map[string]string
+}
+
+// loadDeviceNames reads the names recorded in the file path, the file does not
+// exist if no devices were attached.
+func loadDeviceNames(path string) (*deviceNames, error) {
+	d := &deviceNames{path: path, names: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal(data, &d.names); err != nil {
+		return d, fmt.Errorf("failed to parse device names file %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// Add records the host name of the device before moving it to a Pod.
+func (d *deviceNames) Add(name string) {
+	id := hardwareID(name)
+	if id == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.names[id] = name
+	if err := d.save(); err != nil {
+		klog.Infof("failed to record the host name of device %s: %v", name, err)
+	}
+}
+
+// Remove forgets the host name of the device once it is back on the host.
+func (d *deviceNames) Remove(name string) {
+	id := hardwareID(name)
+	if id == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.names[id]; !ok {
+		return
+	}
+	delete(d.names, id)
+	if err := d.save(); err != nil {
+		klog.Infof("failed to remove the host name of device %s: %v", name, err)
+	}
+}
+
+// Reconcile renames the recorded devices that are on the host with a different
+// name to their original host name. The devices that are not recorded but kept
+// the temporary name of a move are renamed to the name in their alias.
+func (d *deviceNames) Reconcile() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	links, err := netlink.LinkList()
+	if err != nil {
+		klog.Infof("failed to list the interfaces to restore the device names: %v", err)
+		return
+	}
+	for _, link := range links {
+		current := link.Attrs().Name
+		id := hardwareID(current)
+		name, recorded := d.restoreName(id, current)
+		if !recorded {
+			if hostdevice.IsTempName(current) {
+				restoreTempName(link)
+			}
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if _, err := netlink.LinkByName(name); err == nil {
+			klog.Infof("can not restore device %s name to %s, the name is in use", current, name)
+			continue
+		}
+		if err := renameLink(link, name); err != nil {
+			klog.Infof("failed to restore device %s name to %s: %v", current, name, err)
+			continue
+		}
+		klog.Infof("restored device %s name to %s", current, name)
+		delete(d.names, id)
+	}
+	if err := d.save(); err != nil {
+		klog.Infof("failed to save the device names: %v", err)
+	}
+}
+
+// restoreName returns the host name to restore to the device with the hardware
+// identifier id, that is on the host with the name current, and if the device
+// is recorded. The name is empty if the device is back with its host name, and
+// it is forgotten. It must be called with the lock held.
+func (d *deviceNames) restoreName(id string, current string) (string, bool) {
+	name, ok := d.names[id]
+	if id == "" || !ok {
+		return "", false
+	}
+	// the device is back on the host with the right name
+	if current == name {
+		delete(d.names, id)
+		return "", true
+	}
+	return name, true
+}
+
+// Restore waits until the device is returned to the host after its network
+// namespace was destroyed and restores its host name. The kernel returns the
+// devices asynchronously, it fails if the device is not restored before the
+// timeout, the name is restored anyway when the driver starts.
+func (d *deviceNames) Restore(name string, timeout time.Duration) error {
+	err := wait.PollUntilContextTimeout(context.Background(), 100*time.Millisecond, timeout, true, func(context.Context) (bool, error) {
+		d.Reconcile()
+		return !d.Has(name), nil
+	})
+	if err != nil {
+		return fmt.Errorf("device %s was not restored: %w", name, err)
+	}
+	return nil
+}
+
+// Has returns true if the host name of the device is recorded, so the device
+// is not back on the host with its name.
+func (d *deviceNames) Has(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, recorded := range d.names {
+		if recorded == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreTempName renames the device with a temporary name to the name in its
+// alias, that MoveLinkIn sets to the host name of the device.
+func restoreTempName(link netlink.Link) {
+	current := link.Attrs().Name
+	name := link.Attrs().Alias
+	if name == "" {
+		klog.Infof("device %s has a temporary name and no alias, can not restore its name", current)
+		return
+	}
+	if _, err := netlink.LinkByName(name); err == nil {
+		klog.Infof("can not restore device %s name to %s, the name is in use", current, name)
+		return
+	}
+	if err := renameLink(link, name); err != nil {
+		klog.Infof("failed to restore device %s name to %s: %v", current, name, err)
+		return
+	}
+	klog.Infof("restored device %s name to %s", current, name)
+}
+
+// save writes the names to a temporary file and renames it, so the file is
+// not corrupted if the driver crashes while writing.
+func (d *deviceNames) save() error {
+	data, err := json.Marshal(d.names)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
+
+// hardwareID returns an identifier of the device that does not change when
+// the interface is renamed, the permanent MAC address or the PCI address. It
+// returns an empty string for virtual devices.
+func hardwareID(name string) string {
+	if permAddr, err := ethtoolPermAddr(name); err == nil {
+		return permAddr.String()
+	}
+	if address, err := getPCIAddress(name); err == nil && address != "" {
+		return address
+	}
+	return ""
+}
+
+// renameLink renames the link, setting it down during the rename if it is up.
+func renameLink(link netlink.Link, name string) error {
+	up := link.Attrs().Flags&net.FlagUp != 0
+	if up {
+		if err := netlink.LinkSetDown(link); err != nil {
+			return err
+		}
+	}
+	if err := netlink.LinkSetName(link, name); err != nil {
+		return err
+	}
+	if up {
+		return netlink.LinkSetUp(link)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package dra
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aojea/kubernetes-network-driver/pkg/hostdevice"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDeviceNamesRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device-names.json")
+	d, err := loadDeviceNames(path)
+	if err != nil {
+		t.Fatalf("loadDeviceNames() without file error = %v", err)
+	}
+	// the devices eth1 and eth2 are attached to Pods
+	d.names["00:11:22:33:44:55"] = "eth1"
+	d.names["0000:3b:00.1"] = "eth2"
+	if err := d.save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	// the driver restarts after the network namespaces of the Pods were
+	// destroyed, the kernel returned the devices without their alias
+	d, err = loadDeviceNames(path)
+	if err != nil {
+		t.Fatalf("loadDeviceNames() error = %v", err)
+	}
+	tests := []struct {
+		name         string
+		id           string
+		current      string
+		want         string
+		wantRecorded bool
+	}{
+		{
+			name:         "returned with the Pod name",
+			id:           "00:11:22:33:44:55",
+			current:      "net1",
+			want:         "eth1",
+			wantRecorded: true,
+		},
+		{
+			name:         "returned with a kernel name",
+			id:           "0000:3b:00.1",
+			current:      "eth7",
+			want:         "eth2",
+			wantRecorded: true,
+		},
+		{
+			name:    "not recorded",
+			id:      "00:11:22:33:44:66",
+			current: "eth3",
+		},
+		{
+			name:    "virtual device",
+			current: "dummy0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, recorded := d.restoreName(tt.id, tt.current)
+			if got != tt.want || recorded != tt.wantRecorded {
+				t.Errorf("restoreName(%q, %q) = %q, %v, want %q, %v", tt.id, tt.current, got, recorded, tt.want, tt.wantRecorded)
+			}
+		})
+	}
+
+	// the device renamed is back with its host name and it is forgotten
+	if got, recorded := d.restoreName("00:11:22:33:44:55", "eth1"); got != "" || !recorded {
+		t.Errorf("restoreName() = %q, %v, want the device back with its name", got, recorded)
+	}
+	if d.Has("eth1") {
+		t.Errorf("the device eth1 is back on the host, it must be forgotten")
+	}
+	if !d.Has("eth2") {
+		t.Errorf("the device eth2 is not restored yet, it must be recorded")
+	}
+}
+
+func TestReconcileTempNames(t *testing.T) {
+	netns := newTestNS(t)
+	d, err := loadDeviceNames(filepath.Join(t.TempDir(), "device-names.json"))
+	if err != nil {
+		t.Fatalf("loadDeviceNames() error = %v", err)
+	}
+	// the driver crashed while moving the devices, they kept the temporary
+	// name and the alias with their host name
+	links := []struct {
+		name  string
+		alias string
+		want  string
+	}{
+		{name: hostdevice.DefaultTempNamePrefix + "10", alias: "eth1", want: "eth1"},
+		// the temporary names of other plugins are not changed
+		{name: "temp_11", alias: "eth2", want: "temp_11"},
+		// the host name is not known
+		{name: hostdevice.DefaultTempNamePrefix + "12", want: hostdevice.DefaultTempNamePrefix + "12"},
+		// the host name is in use by other device
+		{name: hostdevice.DefaultTempNamePrefix + "13", alias: "eth4", want: hostdevice.DefaultTempNamePrefix + "13"},
+		{name: "eth4", want: "eth4"},
+	}
+	err = netns.Do(func(ns.NetNS) error {
+		for _, l := range links {
+			if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: l.name}}); err != nil {
+				return err
+			}
+			if l.alias == "" {
+				continue
+			}
+			link, err := netlink.LinkByName(l.name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetAlias(link, l.alias); err != nil {
+				return err
+			}
+		}
+		d.Reconcile()
+		for _, l := range links {
+			if _, err := netlink.LinkByName(l.want); err != nil {
+				return fmt.Errorf("device %s not found with name %s: %w", l.name, l.want, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
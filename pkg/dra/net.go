@@ -2,28 +2,71 @@ package dra
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"unsafe"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 )
 
-const (
+// the sysfs directories are variables so the tests can use a fake sysfs layout
+var (
 	// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-net
-	sysfsnet     = "/sys/class/net/"
+	sysfsnet = "/sys/class/net/"
+	// https://www.kernel.org/doc/Documentation/ABI/stable/sysfs-class-infiniband
+	sysfsinfiniband = "/sys/class/infiniband/"
+)
+
+const (
 	sysfsdevices = "/sys/devices/"
+
+	// https://github.com/torvalds/linux/blob/master/include/uapi/linux/ethtool.h
+	ethGstringLen  = 32
+	ethSSFeatures  = 4
+	ethtoolHdrSize = 8
+	maxAddrLen     = 32
 )
 
+// getDefaultGwIf returns the interface of the first route with a gateway, the
+// IPv4 routes are preferred and the IPv6 routes are used on IPv6 only nodes.
 func getDefaultGwIf() (string, error) {
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
-	if err != nil {
-		return "", err
+	return defaultGatewayLink(func(family int) ([]netlink.Route, error) {
+		return netlink.RouteList(nil, family)
+	})
+}
+
+// defaultGatewayLink returns the interface of the first route with a gateway
+// of the routes of each family obtained with routeList, in the order of
+// getDefaultGwIf.
+func defaultGatewayLink(routeList func(family int) ([]netlink.Route, error)) (string, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := routeList(family)
+		if err != nil {
+			return "", err
+		}
+		if name := gatewayRouteLink(routes); name != "" {
+			return name, nil
+		}
 	}
+	return "", fmt.Errorf("not routes found")
+}
 
+// gatewayRouteLink returns the interface of the first route with a gateway.
+func gatewayRouteLink(routes []netlink.Route) string {
 	for _, r := range routes {
 		// no multipath
 		if len(r.MultiPath) == 0 {
@@ -35,7 +78,7 @@ func getDefaultGwIf() (string, error) {
 				log.Printf("Failed to get interface link for route %v : %v", r, err)
 				continue
 			}
-			return intfLink.Attrs().Name, nil
+			return intfLink.Attrs().Name
 		}
 
 		// multipath, use the first valid entry
@@ -44,15 +87,40 @@ func getDefaultGwIf() (string, error) {
 			if nh.Gw == nil {
 				continue
 			}
-			intfLink, err := netlink.LinkByIndex(r.LinkIndex)
+			intfLink, err := netlink.LinkByIndex(nh.LinkIndex)
 			if err != nil {
 				log.Printf("Failed to get interface link for route %v : %v", r, err)
 				continue
 			}
-			return intfLink.Attrs().Name, nil
+			return intfLink.Attrs().Name
 		}
 	}
-	return "", fmt.Errorf("not routes found")
+	return ""
+}
+
+// defaultRouteLinks returns the indexes of the links with a default route on
+// the main routing table, for all the IP families.
+func defaultRouteLinks() (map[int]bool, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	links := map[int]bool{}
+	for _, r := range routes {
+		if r.Dst != nil && !r.Dst.IP.IsUnspecified() {
+			continue
+		}
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		links[r.LinkIndex] = true
+		for _, nh := range r.MultiPath {
+			links[nh.LinkIndex] = true
+		}
+	}
+	return links, nil
 }
 
 func sriovTotalVFs(name string) int {
@@ -86,3 +154,550 @@ func sriovNumVFs(name string) int {
 	}
 	return t
 }
+
+// infinibandNodeGUID returns the node GUID of the InfiniBand device.
+func infinibandNodeGUID(rdmaDev string) (string, error) {
+	guid, err := os.ReadFile(filepath.Join(sysfsinfiniband, rdmaDev, "node_guid"))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(guid)), nil
+}
+
+// rdmaPort returns the port of the RDMA device used by the interface.
+func rdmaPort(name string) int {
+	// dev_port is zero based and the InfiniBand ports start at 1
+	port := 1
+	if devPort, err := os.ReadFile(filepath.Join(sysfsnet, name, "dev_port")); err == nil {
+		if p, err := strconv.Atoi(string(bytes.TrimSpace(devPort))); err == nil {
+			port = p + 1
+		}
+	}
+	return port
+}
+
+// rdmaFreeGIDs returns the number of free entries of the GID table of the RDMA
+// port used by the interface. Each RDMA connection manager address consumes a
+// GID entry, RoCE devices use an entry for each IP address of the interface.
+func rdmaFreeGIDs(name string, rdmaDev string) (int, error) {
+	gidsPath := filepath.Join(sysfsinfiniband, rdmaDev, "ports", strconv.Itoa(rdmaPort(name)), "gids")
+	entries, err := os.ReadDir(gidsPath)
+	if err != nil {
+		return 0, err
+	}
+	free := 0
+	for _, entry := range entries {
+		// the unused entries are the zero GID, the kernel fails to read the
+		// unused entries of the RoCE devices
+		value, err := os.ReadFile(filepath.Join(gidsPath, entry.Name()))
+		if err != nil {
+			free++
+			continue
+		}
+		if gid := net.ParseIP(string(bytes.TrimSpace(value))); gid == nil || gid.IsUnspecified() {
+			free++
+		}
+	}
+	return free, nil
+}
+
+// rdmaResourceLimits returns the maximum number of queue pairs and completion
+// queues of the RDMA device, indexed by the name of their capacity. The limits
+// are only returned if the driver of the device reports them.
+func rdmaResourceLimits(rdmaDev string) map[string]int64 {
+	limits := map[string]int64{}
+	for capacity, attribute := range map[string]string{"rdma_qps": "max_qp", "rdma_cqs": "max_cq"} {
+		value, err := os.ReadFile(filepath.Join(sysfsinfiniband, rdmaDev, attribute))
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(string(bytes.TrimSpace(value)), 0, 64)
+		if err != nil || limit <= 0 {
+			continue
+		}
+		limits[capacity] = limit
+	}
+	return limits
+}
+
+// infinibandPKeys returns the partition keys of the InfiniBand port used by
+// the interface, the unused entries of the pkeys table are zero.
+func infinibandPKeys(name string, rdmaDev string) ([]string, error) {
+	pkeysPath := filepath.Join(sysfsinfiniband, rdmaDev, "ports", strconv.Itoa(rdmaPort(name)), "pkeys")
+	entries, err := os.ReadDir(pkeysPath)
+	if err != nil {
+		return nil, err
+	}
+	var pkeys []string
+	for _, entry := range entries {
+		value, err := os.ReadFile(filepath.Join(pkeysPath, entry.Name()))
+		if err != nil {
+			continue
+		}
+		pkey := string(bytes.TrimSpace(value))
+		if pkey == "" || pkey == "0x0000" || slices.Contains(pkeys, pkey) {
+			continue
+		}
+		pkeys = append(pkeys, pkey)
+	}
+	sort.Strings(pkeys)
+	return pkeys, nil
+}
+
+// isCarrierUp returns true if the interface has physical link.
+// The kernel returns EINVAL when reading the carrier of an interface that is
+// administratively down, in that case there is no carrier.
+func isCarrierUp(name string) bool {
+	carrierPath := filepath.Join(sysfsnet, name, "carrier")
+	carrierBytes, err := os.ReadFile(carrierPath)
+	if err != nil {
+		if !errors.Is(err, unix.EINVAL) {
+			klog.V(7).Infof("error trying to get carrier for device %s: %v", name, err)
+		}
+		return false
+	}
+	return string(bytes.TrimSpace(carrierBytes)) == "1"
+}
+
+// linkMTURange returns the minimum and maximum MTU supported by the link, the
+// values are zero if the driver does not report them. The netlink library does
+// not expose these attributes, so the link is requested directly.
+func linkMTURange(index int) (uint32, uint32, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(msgs) == 0 {
+		return 0, 0, fmt.Errorf("link %d not found", index)
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][unix.SizeofIfInfomsg:])
+	if err != nil {
+		return 0, 0, err
+	}
+	var minMTU, maxMTU uint32
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.IFLA_MIN_MTU:
+			minMTU = nl.NativeEndian().Uint32(attr.Value[:4])
+		case unix.IFLA_MAX_MTU:
+			maxMTU = nl.NativeEndian().Uint32(attr.Value[:4])
+		}
+	}
+	return minMTU, maxMTU, nil
+}
+
+// linkSpeed returns the speed of the interface in Mbps, or 0 if it is unknown.
+// Virtual interfaces and interfaces without carrier do not report the speed.
+func linkSpeed(name string) int {
+	speedPath := filepath.Join(sysfsnet, name, "speed")
+	speedBytes, err := os.ReadFile(speedPath)
+	if err != nil {
+		klog.V(7).Infof("error trying to get speed for device %s: %v", name, err)
+		return 0
+	}
+	speed, err := strconv.Atoi(string(bytes.TrimSpace(speedBytes)))
+	if err != nil || speed < 0 {
+		return 0
+	}
+	return speed
+}
+
+// getPCIAddress returns the PCI address of the device backing the interface.
+func getPCIAddress(name string) (string, error) {
+	devicePath, err := pciDevicePath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(devicePath), nil
+}
+
+// pciDevicePath returns the sysfs path of the PCI device backing the interface,
+// the virtio devices are children of the PCI device.
+func pciDevicePath(name string) (string, error) {
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(sysfsnet, name, "device"))
+	if err != nil {
+		return "", err
+	}
+	for _, path := range []string{devicePath, filepath.Dir(devicePath)} {
+		subsystem, err := filepath.EvalSymlinks(filepath.Join(path, "subsystem"))
+		if err == nil && filepath.Base(subsystem) == "pci" {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("interface %s is not a PCI device", name)
+}
+
+// pciIDs returns the PCI vendor and device identifiers of the interface, in
+// hexadecimal format, per example 0x15b3 and 0x101e.
+func pciIDs(name string) (string, string, error) {
+	devicePath, err := pciDevicePath(name)
+	if err != nil {
+		return "", "", err
+	}
+	vendor, err := os.ReadFile(filepath.Join(devicePath, "vendor"))
+	if err != nil {
+		return "", "", err
+	}
+	device, err := os.ReadFile(filepath.Join(devicePath, "device"))
+	if err != nil {
+		return "", "", err
+	}
+	return string(bytes.TrimSpace(vendor)), string(bytes.TrimSpace(device)), nil
+}
+
+// pciVendorNames are the names of the common network devices vendors.
+// https://pci-ids.ucw.cz/read/PC/
+var pciVendorNames = map[string]string{
+	"0x1077": "QLogic",
+	"0x10ec": "Realtek",
+	"0x14e4": "Broadcom",
+	"0x15ad": "VMware",
+	"0x15b3": "Mellanox",
+	"0x1924": "Solarflare",
+	"0x19ee": "Netronome",
+	"0x1ae0": "Google",
+	"0x1af4": "Red Hat",
+	"0x1d0f": "Amazon",
+	"0x1dd8": "Pensando",
+	"0x8086": "Intel",
+}
+
+// sriovVFInfo returns the PCI address of the physical function and the index of
+// the virtual function for the interface. The VF is correlated by PCI address
+// walking the PF virtfn<N> links, so it does not depend on the netdev name.
+func sriovVFInfo(name string) (string, int, error) {
+	vfAddress, err := getPCIAddress(name)
+	if err != nil {
+		return "", 0, err
+	}
+	pfPath, err := filepath.EvalSymlinks(filepath.Join(sysfsnet, name, "device", "physfn"))
+	if err != nil {
+		return "", 0, err
+	}
+	virtfns, err := filepath.Glob(filepath.Join(pfPath, "virtfn*"))
+	if err != nil {
+		return "", 0, err
+	}
+	for _, virtfn := range virtfns {
+		virtfnPath, err := filepath.EvalSymlinks(virtfn)
+		if err != nil {
+			continue
+		}
+		if filepath.Base(virtfnPath) != vfAddress {
+			continue
+		}
+		vfID, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(virtfn), "virtfn"))
+		if err != nil {
+			return "", 0, err
+		}
+		return filepath.Base(pfPath), vfID, nil
+	}
+	return "", 0, fmt.Errorf("virtual function %s not found on physical function %s", vfAddress, filepath.Base(pfPath))
+}
+
+// devlinkEswitchMode returns the eswitch mode, legacy or switchdev, of the
+// devlink instance of the PCI device of the interface. It fails for the
+// devices without a devlink instance or without an eswitch.
+func devlinkEswitchMode(name string) (string, error) {
+	pciAddress, err := getPCIAddress(name)
+	if err != nil {
+		return "", err
+	}
+	dev, err := netlink.DevLinkGetDeviceByName("pci", pciAddress)
+	if err != nil {
+		return "", err
+	}
+	// the eswitch attributes are empty if the device does not support them
+	mode := dev.Attrs.Eswitch.Mode
+	if mode == "" || mode == "unknown" {
+		return "", fmt.Errorf("device %s does not have an eswitch", pciAddress)
+	}
+	return mode, nil
+}
+
+// physPortName returns the physical port name of the interface, only the
+// switchdev devices report it, per example, p0 for the uplink and pf0vf1 for
+// the representor of the VF 1 on the PF 0.
+func physPortName(name string) string {
+	portName, err := os.ReadFile(filepath.Join(sysfsnet, name, "phys_port_name"))
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(portName))
+}
+
+// physSwitchID returns the identifier of the switch the interface belongs to,
+// it is shared by the uplink and the representors of an eswitch.
+func physSwitchID(name string) string {
+	switchID, err := os.ReadFile(filepath.Join(sysfsnet, name, "phys_switch_id"))
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(switchID))
+}
+
+// representorPortRegex matches the phys_port_name of the VF representors.
+var representorPortRegex = regexp.MustCompile(`^(?:c\d+)?pf(\d+)vf(\d+)$`)
+
+// representorVF returns the PCI address of the VF represented by the interface.
+// The uplink is the interface on the same switch with port name p<pf>.
+func representorVF(name string) (string, error) {
+	match := representorPortRegex.FindStringSubmatch(physPortName(name))
+	if match == nil {
+		return "", fmt.Errorf("interface %s is not a VF representor", name)
+	}
+	switchID := physSwitchID(name)
+	entries, err := os.ReadDir(sysfsnet)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		uplink := entry.Name()
+		if physPortName(uplink) != "p"+match[1] || physSwitchID(uplink) != switchID {
+			continue
+		}
+		vfPath, err := filepath.EvalSymlinks(filepath.Join(sysfsnet, uplink, "device", "virtfn"+match[2]))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Base(vfPath), nil
+	}
+	return "", fmt.Errorf("uplink for representor %s not found", name)
+}
+
+// ifreqData is the ifreq structure with a pointer in the union, as used by the
+// SIOCETHTOOL ioctl.
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data uintptr
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+// ethtoolIoctl executes the ethtool command in data against the interface.
+func ethtoolIoctl(name string, data []byte) (uintptr, error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return 0, fmt.Errorf("interface name %s too long", name)
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	ifr := ifreqData{data: uintptr(unsafe.Pointer(&data[0]))}
+	copy(ifr.name[:], name)
+	r, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// ethtoolDriverInfo returns the driver information of the interface.
+func ethtoolDriverInfo(name string) (*unix.EthtoolDrvinfo, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	return unix.IoctlGetEthtoolDrvinfo(fd, name)
+}
+
+// hwTimestamping are the timestamping capabilities required for PTP hardware
+// timestamping: generate transmit and receive timestamps and report them.
+const hwTimestamping = unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+
+// ethtoolTimestampInfo returns if the interface supports hardware timestamping
+// and the index of its PTP hardware clock, -1 if it does not have one.
+func ethtoolTimestampInfo(name string) (bool, int, error) {
+	// struct ethtool_ts_info
+	tsInfo := make([]byte, 44)
+	binary.NativeEndian.PutUint32(tsInfo[0:], unix.ETHTOOL_GET_TS_INFO)
+	if _, err := ethtoolIoctl(name, tsInfo); err != nil {
+		return false, -1, err
+	}
+	capabilities := binary.NativeEndian.Uint32(tsInfo[4:])
+	phcIndex := int32(binary.NativeEndian.Uint32(tsInfo[8:]))
+	return capabilities&hwTimestamping == hwTimestamping, int(phcIndex), nil
+}
+
+// normalizeMAC returns the MAC address in the canonical lowercase and colon
+// separated format, the metadata servers may use uppercase hexadecimal digits.
+func normalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return strings.ToLower(mac)
+	}
+	return hw.String()
+}
+
+// ethtoolPermAddr returns the permanent hardware address of the interface, it
+// may differ from the current address if it was changed by software.
+func ethtoolPermAddr(name string) (net.HardwareAddr, error) {
+	// struct ethtool_perm_addr
+	permAddr := make([]byte, ethtoolHdrSize+maxAddrLen)
+	binary.NativeEndian.PutUint32(permAddr[0:], unix.ETHTOOL_GPERMADDR)
+	binary.NativeEndian.PutUint32(permAddr[4:], maxAddrLen)
+	if _, err := ethtoolIoctl(name, permAddr); err != nil {
+		return nil, err
+	}
+	size := binary.NativeEndian.Uint32(permAddr[4:])
+	if size == 0 || size > maxAddrLen {
+		return nil, fmt.Errorf("interface %s does not have a permanent address", name)
+	}
+	addr := net.HardwareAddr(permAddr[ethtoolHdrSize : ethtoolHdrSize+size])
+	// devices without a permanent address report all zeros
+	if bytes.Count(addr, []byte{0}) == len(addr) {
+		return nil, fmt.Errorf("interface %s does not have a permanent address", name)
+	}
+	return addr, nil
+}
+
+// ethtoolFeatureAliases maps the offload names used by the ethtool command to
+// the kernel feature names.
+var ethtoolFeatureAliases = map[string][]string{
+	"rx":     {"rx-checksum"},
+	"tx":     {"tx-checksum-ipv4", "tx-checksum-ip-generic", "tx-checksum-ipv6", "tx-checksum-fcoe-crc", "tx-checksum-sctp"},
+	"sg":     {"tx-scatter-gather"},
+	"tso":    {"tx-tcp-segmentation", "tx-tcp-ecn-segmentation", "tx-tcp-mangleid-segmentation", "tx-tcp6-segmentation"},
+	"gso":    {"tx-generic-segmentation"},
+	"gro":    {"rx-gro"},
+	"lro":    {"rx-lro"},
+	"rxvlan": {"rx-vlan-hw-parse"},
+	"txvlan": {"tx-vlan-hw-insert"},
+	"ntuple": {"rx-ntuple-filter"},
+	"rxhash": {"rx-hashing"},
+}
+
+// ethtoolFeatureNames returns the names of the features supported by the
+// kernel for the interface, the position is the feature bit.
+func ethtoolFeatureNames(name string) ([]string, error) {
+	// struct ethtool_sset_info
+	ssetInfo := make([]byte, ethtoolHdrSize+8+4)
+	binary.NativeEndian.PutUint32(ssetInfo[0:], unix.ETHTOOL_GSSET_INFO)
+	binary.NativeEndian.PutUint64(ssetInfo[8:], 1<<ethSSFeatures)
+	if _, err := ethtoolIoctl(name, ssetInfo); err != nil {
+		return nil, fmt.Errorf("failed to get features count: %w", err)
+	}
+	count := binary.NativeEndian.Uint32(ssetInfo[16:])
+
+	// struct ethtool_gstrings
+	gstrings := make([]byte, 12+count*ethGstringLen)
+	binary.NativeEndian.PutUint32(gstrings[0:], unix.ETHTOOL_GSTRINGS)
+	binary.NativeEndian.PutUint32(gstrings[4:], ethSSFeatures)
+	binary.NativeEndian.PutUint32(gstrings[8:], count)
+	if _, err := ethtoolIoctl(name, gstrings); err != nil {
+		return nil, fmt.Errorf("failed to get features names: %w", err)
+	}
+	names := make([]string, count)
+	for i := range names {
+		b := gstrings[12+i*ethGstringLen : 12+(i+1)*ethGstringLen]
+		names[i] = string(bytes.TrimRight(b, "\x00"))
+	}
+	return names, nil
+}
+
+// ethtoolKernelFeatures maps the requested features, by kernel name or alias,
+// to the kernel names of the features of the interface.
+func ethtoolKernelFeatures(name string, index map[string]int, features map[string]bool) (map[string]bool, error) {
+	requested := map[string]bool{}
+	var unsupported []string
+	for feature, enable := range features {
+		kernelNames, ok := ethtoolFeatureAliases[feature]
+		if !ok {
+			kernelNames = []string{feature}
+		}
+		found := false
+		for _, n := range kernelNames {
+			if _, ok := index[n]; ok {
+				requested[n] = enable
+				found = true
+			}
+		}
+		if !found {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return nil, fmt.Errorf("unsupported features %v on interface %s", unsupported, name)
+	}
+	return requested, nil
+}
+
+// ethtoolCheckFeatures returns an error if the interface does not have some of
+// the features, without changing them.
+func ethtoolCheckFeatures(name string, features map[string]bool) error {
+	names, err := ethtoolFeatureNames(name)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(names))
+	for i, n := range names {
+		index[n] = i
+	}
+	_, err = ethtoolKernelFeatures(name, index, features)
+	return err
+}
+
+// ethtoolSetFeatures enables or disables the features of the interface, it
+// accepts kernel feature names and ethtool aliases. It returns the previous
+// state of the modified features using the kernel feature names.
+func ethtoolSetFeatures(name string, features map[string]bool) (map[string]bool, error) {
+	names, err := ethtoolFeatureNames(name)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(names))
+	for i, n := range names {
+		index[n] = i
+	}
+	requested, err := ethtoolKernelFeatures(name, index, features)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := (len(names) + 31) / 32
+	// struct ethtool_gfeatures
+	gfeatures := make([]byte, ethtoolHdrSize+blocks*16)
+	binary.NativeEndian.PutUint32(gfeatures[0:], unix.ETHTOOL_GFEATURES)
+	binary.NativeEndian.PutUint32(gfeatures[4:], uint32(blocks))
+	if _, err := ethtoolIoctl(name, gfeatures); err != nil {
+		return nil, fmt.Errorf("failed to get features: %w", err)
+	}
+	previous := map[string]bool{}
+	for n := range requested {
+		i := index[n]
+		active := binary.NativeEndian.Uint32(gfeatures[ethtoolHdrSize+(i/32)*16+8:])
+		previous[n] = active&(1<<(i%32)) != 0
+	}
+
+	// struct ethtool_sfeatures
+	sfeatures := make([]byte, ethtoolHdrSize+blocks*8)
+	binary.NativeEndian.PutUint32(sfeatures[0:], unix.ETHTOOL_SFEATURES)
+	binary.NativeEndian.PutUint32(sfeatures[4:], uint32(blocks))
+	for n, enable := range requested {
+		i := index[n]
+		offset := ethtoolHdrSize + (i/32)*8
+		bit := uint32(1) << (i % 32)
+		valid := binary.NativeEndian.Uint32(sfeatures[offset:])
+		binary.NativeEndian.PutUint32(sfeatures[offset:], valid|bit)
+		if enable {
+			req := binary.NativeEndian.Uint32(sfeatures[offset+4:])
+			binary.NativeEndian.PutUint32(sfeatures[offset+4:], req|bit)
+		}
+	}
+	r, err := ethtoolIoctl(name, sfeatures)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set features: %w", err)
+	}
+	if r&unix.ETHTOOL_F_UNSUPPORTED != 0 {
+		return previous, fmt.Errorf("some of the features %v can not be changed on interface %s", features, name)
+	}
+	return previous, nil
+}
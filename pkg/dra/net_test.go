@@ -0,0 +1,190 @@
+package dra
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeSysfs points the sysfs directories to a temporary directory with the
+// files, relative to the sysfs root, and restores them when the test ends.
+func fakeSysfs(t *testing.T, files map[string]string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldNet, oldInfiniband := sysfsnet, sysfsinfiniband
+	sysfsnet = filepath.Join(root, "class", "net")
+	sysfsinfiniband = filepath.Join(root, "class", "infiniband")
+	t.Cleanup(func() {
+		sysfsnet, sysfsinfiniband = oldNet, oldInfiniband
+	})
+}
+
+func TestRDMAResourceLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]int64
+	}{
+		{
+			name: "queue pairs and completion queues",
+			files: map[string]string{
+				"class/infiniband/mlx5_0/max_qp": "262144\n",
+				"class/infiniband/mlx5_0/max_cq": "16777216\n",
+			},
+			want: map[string]int64{"rdma_qps": 262144, "rdma_cqs": 16777216},
+		},
+		{
+			name: "only queue pairs",
+			files: map[string]string{
+				"class/infiniband/mlx5_0/max_qp": "0x40000\n",
+			},
+			want: map[string]int64{"rdma_qps": 262144},
+		},
+		{
+			name: "invalid values",
+			files: map[string]string{
+				"class/infiniband/mlx5_0/max_qp": "unknown\n",
+				"class/infiniband/mlx5_0/max_cq": "0\n",
+			},
+			want: map[string]int64{},
+		},
+		{
+			name: "not reported by the driver",
+			files: map[string]string{
+				"class/infiniband/mlx5_0/node_guid": "0000:0000:0000:0000\n",
+			},
+			want: map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, tt.files)
+			if got := rdmaResourceLimits("mlx5_0"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rdmaResourceLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRDMAFreeGIDs(t *testing.T) {
+	fakeSysfs(t, map[string]string{
+		"class/net/eth1/dev_port":                "1\n",
+		"class/infiniband/mlx5_0/ports/2/gids/0": "fe80:0000:0000:0000:0000:00ff:fe00:0001\n",
+		"class/infiniband/mlx5_0/ports/2/gids/1": "0000:0000:0000:0000:0000:ffff:c0a8:0102\n",
+		"class/infiniband/mlx5_0/ports/2/gids/2": "0000:0000:0000:0000:0000:0000:0000:0000\n",
+		"class/infiniband/mlx5_0/ports/2/gids/3": "0000:0000:0000:0000:0000:0000:0000:0000\n",
+		"class/infiniband/mlx5_0/ports/1/gids/0": "fe80:0000:0000:0000:0000:00ff:fe00:0002\n",
+	})
+	// dev_port 1 uses the port 2 of the RDMA device
+	gids, err := rdmaFreeGIDs("eth1", "mlx5_0")
+	if err != nil {
+		t.Fatalf("rdmaFreeGIDs() error = %v", err)
+	}
+	if gids != 2 {
+		t.Errorf("rdmaFreeGIDs() = %d, want 2", gids)
+	}
+	if _, err := rdmaFreeGIDs("eth1", "mlx5_1"); err == nil {
+		t.Errorf("rdmaFreeGIDs() expected an error for a device without GID table")
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{mac: "42:01:c0:a8:01:02", want: "42:01:c0:a8:01:02"},
+		{mac: "42:01:C0:A8:01:02", want: "42:01:c0:a8:01:02"},
+		{mac: "42-01-C0-a8-01-02", want: "42:01:c0:a8:01:02"},
+		{mac: "4201.C0A8.0102", want: "42:01:c0:a8:01:02"},
+		{mac: "NOT-A-MAC", want: "not-a-mac"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mac, func(t *testing.T) {
+			if got := normalizeMAC(tt.mac); got != tt.want {
+				t.Errorf("normalizeMAC(%q) = %q, want %q", tt.mac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultGatewayLink(t *testing.T) {
+	// the loopback interface has the index 1 in any network namespace
+	v4Default := netlink.Route{LinkIndex: 1, Gw: net.ParseIP("192.168.1.1")}
+	v6Default := netlink.Route{LinkIndex: 1, Gw: net.ParseIP("fd00::1")}
+	v4Connected := netlink.Route{LinkIndex: 1, Dst: &net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.CIDRMask(24, 32)}}
+	tests := []struct {
+		name         string
+		routes       map[int][]netlink.Route
+		want         string
+		wantErr      bool
+		wantFamilies []int
+	}{
+		{
+			name:         "IPv4 default",
+			routes:       map[int][]netlink.Route{netlink.FAMILY_V4: {v4Connected, v4Default}},
+			want:         "lo",
+			wantFamilies: []int{netlink.FAMILY_V4},
+		},
+		{
+			name:         "IPv6 only",
+			routes:       map[int][]netlink.Route{netlink.FAMILY_V4: {v4Connected}, netlink.FAMILY_V6: {v6Default}},
+			want:         "lo",
+			wantFamilies: []int{netlink.FAMILY_V4, netlink.FAMILY_V6},
+		},
+		{
+			name:         "dual-stack",
+			routes:       map[int][]netlink.Route{netlink.FAMILY_V4: {v4Default}, netlink.FAMILY_V6: {v6Default}},
+			want:         "lo",
+			wantFamilies: []int{netlink.FAMILY_V4},
+		},
+		{
+			name:         "no gateway",
+			routes:       map[int][]netlink.Route{netlink.FAMILY_V4: {v4Connected}},
+			wantErr:      true,
+			wantFamilies: []int{netlink.FAMILY_V4, netlink.FAMILY_V6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var families []int
+			got, err := defaultGatewayLink(func(family int) ([]netlink.Route, error) {
+				families = append(families, family)
+				return tt.routes[family], nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("defaultGatewayLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("defaultGatewayLink() = %q, want %q", got, tt.want)
+			}
+			// the IPv6 routes are only listed without IPv4 gateway
+			if !reflect.DeepEqual(families, tt.wantFamilies) {
+				t.Errorf("defaultGatewayLink() listed the families %v, want %v", families, tt.wantFamilies)
+			}
+		})
+	}
+}
+
+func TestDefaultGatewayLinkError(t *testing.T) {
+	_, err := defaultGatewayLink(func(family int) ([]netlink.Route, error) {
+		return nil, fmt.Errorf("netlink error")
+	})
+	if err == nil {
+		t.Errorf("defaultGatewayLink() expected an error")
+	}
+}
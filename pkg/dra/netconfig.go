@@ -0,0 +1,481 @@
+package dra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// dadTimeout is the maximum time to wait for the IPv6 duplicate address
+	// detection to complete.
+	dadTimeout = 5 * time.Second
+	// netnsReleaseTimeout is the maximum time to wait for the kernel to return
+	// the devices to the host once the network namespace is destroyed.
+	netnsReleaseTimeout = 5 * time.Second
+)
+
+// deviceState keeps the original values of the settings modified inside the
+// Pod network namespace, so they can be restored on teardown.
+type deviceState struct {
+	// NetNS is the path of the network namespace the config was applied to.
+	NetNS     string
+	Sysctls   map[string]string
+	Offloads  map[string]bool
+	Addresses []netlink.Addr
+	DHCPv6    *dhcpv6Lease
+	Routes    []netlink.Route
+	Rules     []netlink.Rule
+	Neighbors []netlink.Neigh
+	Qdiscs    []netlink.Qdisc
+	// Promisc and AllMulti are true if the flags were off and the driver
+	// enabled them.
+	Promisc  bool
+	AllMulti bool
+	// TxQueueLen is the original transmit queue length, nil if the driver did
+	// not change it.
+	TxQueueLen *int
+	// RDMADevice is the RDMA device moved with the interface, it can not be
+	// obtained from the interface once it is in the Pod network namespace.
+	RDMADevice string
+}
+
+// applyNetworkConfig applies the configuration to the interface ifName inside
+// the network namespace nsPath and returns the state to restore on teardown.
+func applyNetworkConfig(nsPath string, ifName string, config *NetworkConfig) (deviceState, error) {
+	state := deviceState{NetNS: nsPath}
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return state, err
+	}
+	defer containerNs.Close()
+
+	err = containerNs.Do(func(_ ns.NetNS) error {
+		if err := applySysctls(ifName, config, &state); err != nil {
+			return err
+		}
+		if config.SLAAC {
+			slaacSysctls := &NetworkConfig{Sysctls: map[string]string{
+				"net.ipv6.conf." + ifNameToken + ".accept_ra": "1",
+				"net.ipv6.conf." + ifNameToken + ".autoconf":  "1",
+			}}
+			if err := applySysctls(ifName, slaacSysctls, &state); err != nil {
+				return err
+			}
+		}
+		if len(config.Offloads) > 0 {
+			orig, err := ethtoolSetFeatures(ifName, config.Offloads)
+			state.Offloads = orig
+			if err != nil {
+				return fmt.Errorf("failed to set offloads on %s: %w", ifName, err)
+			}
+		}
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %s: %w", ifName, err)
+		}
+		if err := applyLinkFlags(link, config, &state); err != nil {
+			return err
+		}
+		if err := applyTxQueueLen(link, config, &state); err != nil {
+			return err
+		}
+		if err := applyAddresses(link, config, &state); err != nil {
+			return err
+		}
+		if config.DHCPv6 {
+			lease, err := dhcpv6Acquire(link)
+			if err != nil {
+				return fmt.Errorf("failed to obtain DHCPv6 lease on %s: %w", ifName, err)
+			}
+			state.DHCPv6 = lease
+			addr := &netlink.Addr{
+				IPNet:       &net.IPNet{IP: lease.Address, Mask: net.CIDRMask(128, 128)},
+				PreferedLft: int(lease.Preferred),
+				ValidLft:    int(lease.Valid),
+			}
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return fmt.Errorf("failed to add DHCPv6 address %s to %s: %w", addr.String(), ifName, err)
+			}
+			state.Addresses = append(state.Addresses, *addr)
+		}
+		if err := applyBandwidth(link, config, &state); err != nil {
+			return err
+		}
+		if err := applyNeighbors(link, config, &state); err != nil {
+			return err
+		}
+		if err := applyRoutes(link, config, &state); err != nil {
+			return err
+		}
+		if err := applyRules(config, &state); err != nil {
+			return err
+		}
+		// the command is executed from the thread locked in the namespace, so
+		// the child process inherits the Pod network namespace
+		if len(config.PostUpExec) > 0 {
+			return runPostUpExec(ifName, config.PostUpExec)
+		}
+		return nil
+	})
+	return state, err
+}
+
+// waitForCarrier polls the operational state of the interface ifName inside
+// the network namespace nsPath until it is up, it fails if the interface does
+// not get carrier before the timeout or the context is cancelled.
+func waitForCarrier(ctx context.Context, nsPath string, ifName string, timeout time.Duration) error {
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer containerNs.Close()
+
+	err = wait.PollUntilContextTimeout(ctx, 250*time.Millisecond, timeout, true, func(context.Context) (bool, error) {
+		up := false
+		err := containerNs.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				return fmt.Errorf("failed to find %s: %w", ifName, err)
+			}
+			up = linkOperUp(link)
+			return nil
+		})
+		return up, err
+	})
+	if err != nil {
+		return fmt.Errorf("interface %s is not operationally up after %v: %w", ifName, timeout, err)
+	}
+	return nil
+}
+
+// isNetNSGone returns true if the error is caused by the network namespace
+// being already destroyed.
+func isNetNSGone(err error) bool {
+	var notExist ns.NSPathNotExistErr
+	return errors.As(err, &notExist)
+}
+
+// validateNetNS checks the path exists and it is a network namespace.
+func validateNetNS(nsPath string) error {
+	netns, err := ns.GetNS(nsPath)
+	if err != nil {
+		return fmt.Errorf("invalid network namespace %s: %w", nsPath, err)
+	}
+	return netns.Close()
+}
+
+// sysctlKey replaces the IFNAME token of the dotted sysctl key with the
+// interface name. The dots of the name are written as slashes, per example
+// net.ipv4.conf.eth0/100.rp_filter for the VLAN interface eth0.100, the
+// sysctl package swaps them back to build the /proc/sys path.
+func sysctlKey(key string, ifName string) string {
+	return strings.ReplaceAll(key, ifNameToken, strings.ReplaceAll(ifName, ".", "/"))
+}
+
+func applySysctls(ifName string, config *NetworkConfig, state *deviceState) error {
+	for key, value := range config.Sysctls {
+		key = sysctlKey(key, ifName)
+		orig, err := sysctl.Sysctl(key)
+		if err != nil {
+			return fmt.Errorf("failed to get sysctl %s: %w", key, err)
+		}
+		if _, err := sysctl.Sysctl(key, value); err != nil {
+			return fmt.Errorf("failed to set sysctl %s to %s: %w", key, value, err)
+		}
+		if state.Sysctls == nil {
+			state.Sysctls = map[string]string{}
+		}
+		state.Sysctls[key] = orig
+	}
+	return nil
+}
+
+// applyLinkFlags enables the promiscuous and all multicast modes, the modes
+// already enabled are not recorded so they are kept on teardown.
+func applyLinkFlags(link netlink.Link, config *NetworkConfig, state *deviceState) error {
+	linkAttrs := link.Attrs()
+	if config.Promisc && linkAttrs.Promisc == 0 {
+		// the Pod receives all the traffic on the link, not only its own
+		klog.Infof("enabling promiscuous mode on %s", linkAttrs.Name)
+		if err := netlink.SetPromiscOn(link); err != nil {
+			return fmt.Errorf("failed to enable promiscuous mode on %s: %w", linkAttrs.Name, err)
+		}
+		state.Promisc = true
+	}
+	if config.AllMulti && linkAttrs.RawFlags&unix.IFF_ALLMULTI == 0 {
+		if err := netlink.LinkSetAllmulticastOn(link); err != nil {
+			return fmt.Errorf("failed to enable all multicast mode on %s: %w", linkAttrs.Name, err)
+		}
+		state.AllMulti = true
+	}
+	return nil
+}
+
+// applyTxQueueLen sets the transmit queue length and records the original.
+func applyTxQueueLen(link netlink.Link, config *NetworkConfig, state *deviceState) error {
+	linkAttrs := link.Attrs()
+	if config.TxQueueLen == 0 || config.TxQueueLen == linkAttrs.TxQLen {
+		return nil
+	}
+	if err := netlink.LinkSetTxQLen(link, config.TxQueueLen); err != nil {
+		return fmt.Errorf("failed to set txqueuelen %d on %s: %w", config.TxQueueLen, linkAttrs.Name, err)
+	}
+	orig := linkAttrs.TxQLen
+	state.TxQueueLen = &orig
+	return nil
+}
+
+// linkOperUp returns true if the operational state of the link is up, the
+// virtual interfaces without carrier detection report unknown state.
+func linkOperUp(link netlink.Link) bool {
+	attrs := link.Attrs()
+	return attrs.OperState == netlink.OperUp ||
+		(attrs.OperState == netlink.OperUnknown && attrs.RawFlags&unix.IFF_LOWER_UP != 0)
+}
+
+func applyAddresses(link netlink.Link, config *NetworkConfig, state *deviceState) error {
+	ipv6 := false
+	// the secondary addresses are added last, so the kernel uses the previous
+	// address of the same subnet as primary
+	for _, address := range slices.Concat(config.IPv4, config.IPv6, config.SecondaryIPs) {
+		addr, err := netlink.ParseAddr(address)
+		if err != nil {
+			return fmt.Errorf("invalid address %s: %w", address, err)
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("failed to add address %s to %s: %w", address, link.Attrs().Name, err)
+		}
+		state.Addresses = append(state.Addresses, *addr)
+		if addr.IP.To4() == nil {
+			ipv6 = true
+		}
+	}
+	if ipv6 {
+		return waitForDAD(link, dadTimeout)
+	}
+	return nil
+}
+
+// waitForDAD waits until the IPv6 addresses of the link are no longer
+// tentative, it fails if the duplicate address detection fails.
+func waitForDAD(link netlink.Link, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses on %s: %w", link.Attrs().Name, err)
+		}
+		tentative := false
+		for _, addr := range addrs {
+			if addr.Flags&unix.IFA_F_DADFAILED != 0 {
+				return fmt.Errorf("duplicate address %s detected on %s", addr.IPNet.String(), link.Attrs().Name)
+			}
+			if addr.Flags&unix.IFA_F_TENTATIVE != 0 {
+				tentative = true
+			}
+		}
+		if !tentative {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for duplicate address detection on %s", link.Attrs().Name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func applyRoutes(link netlink.Link, config *NetworkConfig, state *deviceState) error {
+	family := config.defaultRouteFamily()
+	for _, r := range config.Routes {
+		if family != "" && r.isDefault() && r.family() != family {
+			klog.V(2).Infof("skipping default route via %v on %s, the default route family is %s", r.gateways(), link.Attrs().Name, family)
+			continue
+		}
+		route := netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Table:     config.RoutingTable,
+			Scope:     netlink.SCOPE_UNIVERSE,
+		}
+		if r.Destination != "" {
+			_, route.Dst, _ = net.ParseCIDR(r.Destination)
+		}
+		switch {
+		case r.Gateway != "":
+			route.Gw = net.ParseIP(r.Gateway)
+		case len(r.Gateways) > 0:
+			// the next hops of the ECMP route carry the interface
+			route.LinkIndex = 0
+			for _, gateway := range r.Gateways {
+				gw := net.ParseIP(gateway)
+				if err := checkNextHop(link, gw); err != nil {
+					return err
+				}
+				route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{LinkIndex: link.Attrs().Index, Gw: gw})
+			}
+		default:
+			route.Scope = netlink.SCOPE_LINK
+		}
+		if err := netlink.RouteAdd(&route); err != nil {
+			return fmt.Errorf("failed to add route %s: %w", route.String(), err)
+		}
+		state.Routes = append(state.Routes, route)
+	}
+	return nil
+}
+
+// checkNextHop checks the gateway is directly reachable through the link.
+func checkNextHop(link netlink.Link, gw net.IP) error {
+	routes, err := netlink.RouteGet(gw)
+	if err != nil {
+		return fmt.Errorf("gateway %s is not reachable: %w", gw.String(), err)
+	}
+	for _, route := range routes {
+		if route.LinkIndex == link.Attrs().Index && route.Gw == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("gateway %s is not directly reachable through %s", gw.String(), link.Attrs().Name)
+}
+
+// applyNeighbors adds the static neighbor entries, the interface must support
+// neighbor discovery.
+func applyNeighbors(link netlink.Link, config *NetworkConfig, state *deviceState) error {
+	if len(config.Neighbors) > 0 && link.Attrs().Flags&net.FlagPointToPoint != 0 {
+		return fmt.Errorf("interface %s does not support neighbor entries", link.Attrs().Name)
+	}
+	for _, n := range config.Neighbors {
+		ip := net.ParseIP(n.IP)
+		mac, _ := net.ParseMAC(n.MAC)
+		neigh := netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       ipFamily(ip),
+			State:        netlink.NUD_PERMANENT,
+			IP:           ip,
+			HardwareAddr: mac,
+		}
+		if err := netlink.NeighAdd(&neigh); err != nil {
+			return fmt.Errorf("failed to add neighbor %s on %s: %w", neigh.String(), link.Attrs().Name, err)
+		}
+		state.Neighbors = append(state.Neighbors, neigh)
+	}
+	return nil
+}
+
+func applyRules(config *NetworkConfig, state *deviceState) error {
+	for _, r := range config.Rules {
+		rule := netlink.NewRule()
+		rule.Table = r.Table
+		if r.Priority > 0 {
+			rule.Priority = r.Priority
+		}
+		if r.Source != "" {
+			_, rule.Src, _ = net.ParseCIDR(r.Source)
+			rule.Family = ipFamily(rule.Src.IP)
+		}
+		if r.Destination != "" {
+			_, rule.Dst, _ = net.ParseCIDR(r.Destination)
+			rule.Family = ipFamily(rule.Dst.IP)
+		}
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add rule %s: %w", rule.String(), err)
+		}
+		state.Rules = append(state.Rules, *rule)
+	}
+	return nil
+}
+
+// restoreNetworkConfig reverts, on a best effort basis, the changes recorded
+// in the state inside the network namespace nsPath.
+func restoreNetworkConfig(nsPath string, ifName string, state deviceState) error {
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer containerNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		for _, rule := range state.Rules {
+			if err := netlink.RuleDel(&rule); err != nil {
+				klog.Infof("failed to delete rule %s: %v", rule.String(), err)
+			}
+		}
+		for _, route := range state.Routes {
+			if err := netlink.RouteDel(&route); err != nil {
+				klog.Infof("failed to delete route %s: %v", route.String(), err)
+			}
+		}
+		for _, neigh := range state.Neighbors {
+			if err := netlink.NeighDel(&neigh); err != nil {
+				klog.Infof("failed to delete neighbor %s: %v", neigh.String(), err)
+			}
+		}
+		// the filters and classes are deleted with the qdisc
+		for _, qdisc := range state.Qdiscs {
+			if err := netlink.QdiscDel(qdisc); err != nil {
+				klog.Infof("failed to delete qdisc %s: %v", qdisc.Type(), err)
+			}
+		}
+		if len(state.Addresses) > 0 || state.DHCPv6 != nil || state.Promisc || state.AllMulti || state.TxQueueLen != nil {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				klog.Infof("failed to find %s: %v", ifName, err)
+			} else {
+				if state.Promisc {
+					if err := netlink.SetPromiscOff(link); err != nil {
+						klog.Infof("failed to disable promiscuous mode on %s: %v", ifName, err)
+					}
+				}
+				if state.AllMulti {
+					if err := netlink.LinkSetAllmulticastOff(link); err != nil {
+						klog.Infof("failed to disable all multicast mode on %s: %v", ifName, err)
+					}
+				}
+				if state.TxQueueLen != nil {
+					if err := netlink.LinkSetTxQLen(link, *state.TxQueueLen); err != nil {
+						klog.Infof("failed to restore txqueuelen %d on %s: %v", *state.TxQueueLen, ifName, err)
+					}
+				}
+				if state.DHCPv6 != nil {
+					if err := dhcpv6ReleaseLease(link, state.DHCPv6); err != nil {
+						klog.Infof("failed to release DHCPv6 lease %s: %v", state.DHCPv6.Address.String(), err)
+					}
+				}
+				for _, addr := range state.Addresses {
+					if err := netlink.AddrDel(link, &addr); err != nil {
+						klog.Infof("failed to delete address %s: %v", addr.String(), err)
+					}
+				}
+			}
+		}
+		for key, value := range state.Sysctls {
+			if _, err := sysctl.Sysctl(key, value); err != nil {
+				klog.Infof("failed to restore sysctl %s to %s: %v", key, value, err)
+			}
+		}
+		if len(state.Offloads) > 0 {
+			if _, err := ethtoolSetFeatures(ifName, state.Offloads); err != nil {
+				klog.Infof("failed to restore offloads on %s: %v", ifName, err)
+			}
+		}
+		return nil
+	})
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
@@ -0,0 +1,385 @@
+package dra
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/aojea/kubernetes-network-driver/pkg/hostdevice"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newTestNS returns a new network namespace that is closed when the test
+// ends, the test is skipped if it can not create network namespaces. Its path
+// is a file descriptor of the test process, so it is gone once it is closed.
+func newTestNS(t *testing.T) ns.NetNS {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+	var netns ns.NetNS
+	var holder ns.NetNS
+	err := func() error {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		orig, err := ns.GetCurrentNS()
+		if err != nil {
+			return err
+		}
+		defer orig.Close()
+		defer orig.Set()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return err
+		}
+		if holder, err = ns.GetCurrentNS(); err != nil {
+			return err
+		}
+		netns, err = ns.GetNS(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), holder.Fd()))
+		return err
+	}()
+	if err != nil {
+		t.Skipf("failed to create a network namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Close()
+		holder.Close()
+	})
+	return netns
+}
+
+// addTestVeth creates the veth pair name and name-p, up, in the network
+// namespace and returns the first interface.
+func addTestVeth(t *testing.T, netns ns.NetNS, name string) netlink.Link {
+	t.Helper()
+	var link netlink.Link
+	err := netns.Do(func(ns.NetNS) error {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-p"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		peer, err := netlink.LinkByName(name + "-p")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(peer); err != nil {
+			return err
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		t.Fatalf("failed to create veth %s: %v", name, err)
+	}
+	return link
+}
+
+func TestSysctlKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		ifName string
+		want   string
+	}{
+		{
+			name:   "interface name",
+			key:    "net.ipv6.conf.IFNAME.disable_ipv6",
+			ifName: "eth1",
+			want:   "net.ipv6.conf.eth1.disable_ipv6",
+		},
+		{
+			name:   "VLAN interface name with a dot",
+			key:    "net.ipv4.conf.IFNAME.rp_filter",
+			ifName: "eth0.100",
+			want:   "net.ipv4.conf.eth0/100.rp_filter",
+		},
+		{
+			name:   "without token",
+			key:    "net.ipv4.ip_forward",
+			ifName: "eth0.100",
+			want:   "net.ipv4.ip_forward",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sysctlKey(tt.key, tt.ifName); got != tt.want {
+				t.Errorf("sysctlKey(%q, %q) = %q, want %q", tt.key, tt.ifName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRoutesMultipath(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    RouteConfig
+		wantHops []string
+		wantErr  bool
+	}{
+		{
+			name:     "ECMP route",
+			route:    RouteConfig{Destination: "10.0.0.0/8", Gateways: []string{"192.168.1.1", "192.168.1.3"}},
+			wantHops: []string{"192.168.1.1", "192.168.1.3"},
+		},
+		{
+			name:     "ECMP default route",
+			route:    RouteConfig{Destination: "0.0.0.0/0", Gateways: []string{"192.168.1.1", "192.168.1.3", "192.168.1.4"}},
+			wantHops: []string{"192.168.1.1", "192.168.1.3", "192.168.1.4"},
+		},
+		{
+			name:    "next hop not directly reachable",
+			route:   RouteConfig{Destination: "10.0.0.0/8", Gateways: []string{"192.168.1.1", "172.16.0.1"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			netns := newTestNS(t)
+			link := addTestVeth(t, netns, "eth1")
+			config := &NetworkConfig{Routes: []RouteConfig{tt.route}}
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			err := netns.Do(func(ns.NetNS) error {
+				addr, _ := netlink.ParseAddr("192.168.1.2/24")
+				if err := netlink.AddrAdd(link, addr); err != nil {
+					return err
+				}
+				state := deviceState{}
+				if err := applyRoutes(link, config, &state); err != nil {
+					return err
+				}
+				if len(state.Routes) != 1 {
+					return fmt.Errorf("recorded %d routes, want 1", len(state.Routes))
+				}
+				var hops []string
+				for _, hop := range state.Routes[0].MultiPath {
+					if hop.LinkIndex != link.Attrs().Index {
+						return fmt.Errorf("next hop %s on link index %d, want %d", hop.Gw, hop.LinkIndex, link.Attrs().Index)
+					}
+					hops = append(hops, hop.Gw.String())
+				}
+				if !reflect.DeepEqual(hops, tt.wantHops) {
+					return fmt.Errorf("next hops = %v, want %v", hops, tt.wantHops)
+				}
+				// the route is installed with all the next hops
+				routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+				if err != nil {
+					return err
+				}
+				for _, route := range routes {
+					if len(route.MultiPath) == len(tt.wantHops) {
+						return nil
+					}
+				}
+				return fmt.Errorf("installed routes = %v, want a route with %d next hops", routes, len(tt.wantHops))
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("applyRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsNetNSGone(t *testing.T) {
+	netns := newTestNS(t)
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{
+			name: "namespace destroyed",
+			path: filepath.Join(t.TempDir(), "netns"),
+			want: true,
+		},
+		{
+			name: "device not in the namespace",
+			path: netns.Path(),
+		},
+		{
+			name: "not a network namespace",
+			path: t.TempDir(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hostdevice.MoveLinkOut(tt.path, "eth1")
+			if err == nil {
+				t.Fatalf("MoveLinkOut() succeeded, expected an error")
+			}
+			if got := isNetNSGone(err); got != tt.want {
+				t.Errorf("isNetNSGone(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkConfigRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		config NetworkConfig
+	}{
+		{
+			name:   "IPv4 addresses",
+			config: NetworkConfig{IPv4: []string{"192.168.1.2/24", "10.0.0.2/8"}},
+		},
+		{
+			name: "dual stack addresses",
+			config: NetworkConfig{
+				IPv4: []string{"192.168.1.2/24"},
+				IPv6: []string{"fd00:1::2/64", "fd00:2::2/64"},
+			},
+		},
+		{
+			name: "secondary addresses",
+			config: NetworkConfig{
+				IPv4:         []string{"192.168.1.2/24"},
+				SecondaryIPs: []string{"192.168.1.3/24", "192.168.1.4/24"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			netns := newTestNS(t)
+			link := addTestVeth(t, netns, "eth1")
+			if err := tt.config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			want := slices.Concat(tt.config.IPv4, tt.config.IPv6, tt.config.SecondaryIPs)
+			// addresses returns the global addresses of the link
+			addresses := func() []string {
+				var got []string
+				err := netns.Do(func(ns.NetNS) error {
+					addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+					if err != nil {
+						return err
+					}
+					for _, addr := range addrs {
+						if addr.IP.IsGlobalUnicast() {
+							got = append(got, addr.IPNet.String())
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("failed to list the addresses: %v", err)
+				}
+				slices.Sort(got)
+				return got
+			}
+
+			state, err := applyNetworkConfig(netns.Path(), "eth1", &tt.config)
+			if err != nil {
+				t.Fatalf("applyNetworkConfig() error = %v", err)
+			}
+			if len(state.Addresses) != len(want) {
+				t.Errorf("recorded %d addresses, want %d", len(state.Addresses), len(want))
+			}
+			slices.Sort(want)
+			if got := addresses(); !reflect.DeepEqual(got, want) {
+				t.Errorf("addresses after apply = %v, want %v", got, want)
+			}
+
+			if err := restoreNetworkConfig(netns.Path(), "eth1", state); err != nil {
+				t.Fatalf("restoreNetworkConfig() error = %v", err)
+			}
+			if got := addresses(); len(got) > 0 {
+				t.Errorf("addresses after restore = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestTxQueueLen(t *testing.T) {
+	tests := []struct {
+		name       string
+		txQueueLen int
+		want       int
+		wantState  bool
+		wantErr    bool
+	}{
+		{
+			name:       "increased",
+			txQueueLen: 10000,
+			want:       10000,
+			wantState:  true,
+		},
+		{
+			name:       "current value",
+			txQueueLen: 1000,
+			want:       1000,
+		},
+		{
+			name: "not set",
+			want: 1000,
+		},
+		{
+			name:       "negative",
+			txQueueLen: -1,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &NetworkConfig{TxQueueLen: tt.txQueueLen}
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			netns := newTestNS(t)
+			link := addTestVeth(t, netns, "eth1")
+			// the veth interfaces are created without queue
+			err := netns.Do(func(ns.NetNS) error {
+				return netlink.LinkSetTxQLen(link, 1000)
+			})
+			if err != nil {
+				t.Fatalf("failed to set the txqueuelen: %v", err)
+			}
+			// txQueueLen returns the transmit queue length of the interface
+			txQueueLen := func() int {
+				var qlen int
+				err := netns.Do(func(ns.NetNS) error {
+					link, err := netlink.LinkByName("eth1")
+					if err != nil {
+						return err
+					}
+					qlen = link.Attrs().TxQLen
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("failed to get the interface: %v", err)
+				}
+				return qlen
+			}
+			orig := txQueueLen()
+
+			state, err := applyNetworkConfig(netns.Path(), "eth1", config)
+			if err != nil {
+				t.Fatalf("applyNetworkConfig() error = %v", err)
+			}
+			if got := txQueueLen(); got != tt.want {
+				t.Errorf("txqueuelen after apply = %d, want %d", got, tt.want)
+			}
+			if (state.TxQueueLen != nil) != tt.wantState {
+				t.Errorf("original txqueuelen recorded = %v, want %v", state.TxQueueLen != nil, tt.wantState)
+			}
+
+			if err := restoreNetworkConfig(netns.Path(), "eth1", state); err != nil {
+				t.Fatalf("restoreNetworkConfig() error = %v", err)
+			}
+			if got := txQueueLen(); got != orig {
+				t.Errorf("txqueuelen after restore = %d, want %d", got, orig)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package dra
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// reservedInterfacesAnnotation is the Node annotation, prefixed by the driver
+// name, with the comma separated list of the interfaces reserved for the node.
+const reservedInterfacesAnnotation = "reserved-interfaces"
+
+// reservedInterfaces are the interfaces owned by the node, per example the
+// storage or management interfaces, that are never published nor allocated
+// even if they pass the other filters. They are the union of the interfaces
+// configured on the driver and the ones in the Node annotation, that is
+// refreshed periodically.
+type reservedInterfaces struct {
+	mu        sync.RWMutex
+	static    []string
+	annotated []string
+}
+
+// Has returns true if the interface is reserved for the node.
+func (r *reservedInterfaces) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Contains(r.static, name) || slices.Contains(r.annotated, name)
+}
+
+// SetAnnotation replaces the interfaces reserved by the Node annotation.
+func (r *reservedInterfaces) SetAnnotation(value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	r.annotated = names
+}
@@ -0,0 +1,104 @@
+package dra
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
+)
+
+func TestReservedInterfaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		static     []string
+		annotation string
+		want       map[string]bool
+	}{
+		{
+			name: "nothing reserved",
+			want: map[string]bool{"eth1": false},
+		},
+		{
+			name:   "reserved by flag",
+			static: []string{"eth1"},
+			want:   map[string]bool{"eth1": true, "eth2": false},
+		},
+		{
+			name:       "reserved by annotation",
+			annotation: " eth2, ,eth3,",
+			want:       map[string]bool{"eth1": false, "eth2": true, "eth3": true, "": false},
+		},
+		{
+			name:       "reserved by flag and annotation",
+			static:     []string{"eth1"},
+			annotation: "eth2",
+			want:       map[string]bool{"eth1": true, "eth2": true, "eth3": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			np := newTestPlugin()
+			np.reserved.static = tt.static
+			np.reserved.SetAnnotation(tt.annotation)
+			for name, want := range tt.want {
+				if got := np.reserved.Has(name); got != want {
+					t.Errorf("Has(%q) = %v, want %v", name, got, want)
+				}
+				if want {
+					if _, reason := np.interfaceSkipReason(fakeInterface(name), nil); reason != "reserved" {
+						t.Errorf("interfaceSkipReason(%q) = %q, want reserved", name, reason)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshReservedInterfaces(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node",
+		Annotations: map[string]string{"dra.net/" + reservedInterfacesAnnotation: "eth1,eth2"},
+	}}
+	np := newTestPlugin(node)
+	np.refreshReservedInterfaces(context.Background())
+	if !np.reserved.Has("eth1") || !np.reserved.Has("eth2") {
+		t.Fatalf("the interfaces of the annotation are not reserved")
+	}
+
+	// the annotation is updated
+	node.Annotations["dra.net/"+reservedInterfacesAnnotation] = "eth2"
+	if _, err := np.kubeClient.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update the node: %v", err)
+	}
+	np.refreshReservedInterfaces(context.Background())
+	if np.reserved.Has("eth1") || !np.reserved.Has("eth2") {
+		t.Errorf("the reservation was not refreshed")
+	}
+
+	// the reservation is kept if the node can not be obtained
+	if err := np.kubeClient.CoreV1().Nodes().Delete(context.Background(), "node", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete the node: %v", err)
+	}
+	np.refreshReservedInterfaces(context.Background())
+	if !np.reserved.Has("eth2") {
+		t.Errorf("the reservation was lost when the node was not found")
+	}
+}
+
+func TestNodePrepareResourceReserved(t *testing.T) {
+	claim := newClaim("claim-uid", newAllocation("dra.net", "lo"),
+		resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+	np := newTestPlugin(claim)
+	// the interface was reserved after the claim was allocated
+	np.reserved.SetAnnotation("lo")
+	claimReq := &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"}
+	if _, err := np.nodePrepareResource(context.Background(), claimReq); err == nil {
+		t.Fatalf("nodePrepareResource() succeeded, expected the reserved device to be rejected")
+	}
+	if got := len(np.podAllocations.List()); got != 0 {
+		t.Errorf("stored %d pod allocations, want 0", got)
+	}
+}
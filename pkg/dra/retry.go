@@ -0,0 +1,49 @@
+package dra
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// transientErrors are the errno values that can be returned by the kernel
+// when the device is temporarily unavailable, per example, if the device
+// is being configured at the same time by systemd-networkd.
+var transientErrors = []unix.Errno{
+	unix.EBUSY,
+	unix.EAGAIN,
+	unix.EINTR,
+}
+
+func isTransientError(err error) bool {
+	for _, errno := range transientErrors {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryOnTransientError executes fn with exponential backoff until it succeeds,
+// it returns an error that is not transient or the backoff steps are exhausted.
+func retryOnTransientError(ctx context.Context, backoff wait.Backoff, fn func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(context.Context) (bool, error) {
+		lastErr = fn()
+		if lastErr == nil {
+			return true, nil
+		}
+		if !isTransientError(lastErr) {
+			return false, lastErr
+		}
+		klog.V(2).Infof("transient error, retrying: %v", lastErr)
+		return false, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
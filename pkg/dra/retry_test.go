@@ -0,0 +1,70 @@
+package dra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestRetryOnTransientError(t *testing.T) {
+	errPermanent := errors.New("permanent error")
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "success",
+			wantCalls: 1,
+		},
+		{
+			name:      "two transient errors then success",
+			errs:      []error{unix.EBUSY, fmt.Errorf("wrapped: %w", unix.EAGAIN)},
+			wantCalls: 3,
+		},
+		{
+			name:      "retries exhausted",
+			errs:      []error{unix.EBUSY, unix.EBUSY, unix.EBUSY, unix.EBUSY, unix.EBUSY},
+			wantErr:   unix.EBUSY,
+			wantCalls: 3,
+		},
+		{
+			name:      "permanent error is not retried",
+			errs:      []error{errPermanent, unix.EBUSY},
+			wantErr:   errPermanent,
+			wantCalls: 1,
+		},
+		{
+			name:      "permanent error after a transient error",
+			errs:      []error{unix.EINTR, errPermanent},
+			wantErr:   errPermanent,
+			wantCalls: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+			calls := 0
+			op := func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			}
+			err := retryOnTransientError(context.Background(), backoff, op)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("retryOnTransientError() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("retryOnTransientError() called the operation %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package dra
+
+import (
+	"errors"
+)
+
+// rollback records the actions that undo the steps done to attach a device to
+// a Pod, so a failure in a later step leaves the device as it was.
+type rollback []func() error
+
+// Add records the action that undoes the last step.
+func (r *rollback) Add(undo func() error) {
+	*r = append(*r, undo)
+}
+
+// Run runs the actions in the reverse order of the steps, all of them run even
+// if some fail, and returns the errors joined.
+func (r rollback) Run() error {
+	var errs []error
+	for i := len(r) - 1; i >= 0; i-- {
+		if err := r[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
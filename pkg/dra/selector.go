@@ -0,0 +1,188 @@
+package dra
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+)
+
+// pciAddressRegex matches the PCI addresses in the sysfs format,
+// <domain>:<bus>:<device>.<function>.
+var pciAddressRegex = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+// resolvedLinks stores the host interface of the devices selected by hardware
+// address in the config, the interface may have been renamed since the device
+// was published.
+type resolvedLinks struct {
+	mu    sync.RWMutex
+	links map[string]string
+}
+
+func (r *resolvedLinks) Add(device string, link string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.links[device] = link
+}
+
+func (r *resolvedLinks) Get(device string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	link, ok := r.links[device]
+	return link, ok
+}
+
+func (r *resolvedLinks) Remove(device string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.links, device)
+}
+
+// publishedDevices stores the devices of the last publication by name, the
+// allocation results only reference the devices by name.
+type publishedDevices struct {
+	mu      sync.RWMutex
+	devices map[string]resourceapi.Device
+}
+
+// Set replaces the published devices.
+func (p *publishedDevices) Set(devices []resourceapi.Device) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices = make(map[string]resourceapi.Device, len(devices))
+	for _, device := range devices {
+		p.devices[device.Name] = device
+	}
+}
+
+func (p *publishedDevices) Get(name string) (resourceapi.Device, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	device, ok := p.devices[name]
+	return device, ok
+}
+
+// linkIdentity is the hardware identity of a host interface.
+type linkIdentity struct {
+	Name string
+	// MAC is the permanent MAC address, or the current one if the interface
+	// does not have a permanent address
+	MAC string
+	PCI string
+	// UID is the uid attribute of the interface device
+	UID string
+}
+
+// newLinkIdentity returns the hardware identity of the interface.
+func newLinkIdentity(iface net.Interface) linkIdentity {
+	identity := linkIdentity{
+		Name: iface.Name,
+		MAC:  iface.HardwareAddr.String(),
+		UID:  deviceUID(iface.Name),
+	}
+	if permAddr, err := ethtoolPermAddr(iface.Name); err == nil {
+		identity.MAC = permAddr.String()
+	}
+	if address, err := getPCIAddress(iface.Name); err == nil {
+		identity.PCI = address
+	}
+	return identity
+}
+
+// matchLinks returns the interfaces with the MAC address and the PCI address,
+// the ones that are empty are not matched. The permanent MAC address is
+// matched, the VLANs and bonds share the current address of their parent.
+func matchLinks(identities []linkIdentity, macAddress string, pciAddress string) []linkIdentity {
+	var matches []linkIdentity
+	for _, identity := range identities {
+		if macAddress != "" && identity.MAC != normalizeMAC(macAddress) {
+			continue
+		}
+		if pciAddress != "" && identity.PCI != strings.ToLower(pciAddress) {
+			continue
+		}
+		matches = append(matches, identity)
+	}
+	return matches
+}
+
+// resolveDeviceLink returns the name of the host interface of the device
+// selected by the hardware addresses of the config. It fails if no interface
+// or more than one interface matches, or if the interface can not be
+// allocated as the device.
+func (np *NetworkPlugin) resolveDeviceLink(device string, config *NetworkConfig) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to list the interfaces: %w", err)
+	}
+	var identities []linkIdentity
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == net.FlagLoopback {
+			continue
+		}
+		identities = append(identities, newLinkIdentity(iface))
+	}
+	matches := matchLinks(identities, config.MACAddress, config.PCIAddress)
+
+	var selectors []string
+	if config.MACAddress != "" {
+		selectors = append(selectors, "MAC address "+config.MACAddress)
+	}
+	if config.PCIAddress != "" {
+		selectors = append(selectors, "PCI address "+config.PCIAddress)
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no interface with %s", strings.Join(selectors, " and "))
+	case 1:
+	default:
+		names := make([]string, 0, len(matches))
+		for _, match := range matches {
+			names = append(names, match.Name)
+		}
+		return "", fmt.Errorf("multiple interfaces with %s: %v", strings.Join(selectors, " and "), names)
+	}
+
+	// the interface must pass the same filters as the published interfaces
+	routeLinks, err := defaultRouteLinks()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the default routes: %w", err)
+	}
+	iface, err := net.InterfaceByName(matches[0].Name)
+	if err != nil {
+		return "", err
+	}
+	_, reason := np.interfaceSkipReason(*iface, routeLinks)
+	if err := np.checkSelectedLink(device, matches[0], reason); err != nil {
+		return "", err
+	}
+	return matches[0].Name, nil
+}
+
+// checkSelectedLink checks the interface selected by hardware address is the
+// hardware of the allocated device, that it is not filtered by the discovery,
+// per example the gateway interface, and that it is not allocated to another
+// claim.
+func (np *NetworkPlugin) checkSelectedLink(device string, identity linkIdentity, skipReason string) error {
+	published, ok := np.published.Get(device)
+	if !ok || published.Basic == nil {
+		return fmt.Errorf("device %s is not published by the driver", device)
+	}
+	var uid string
+	if attr, ok := published.Basic.Attributes["uid"]; ok && attr.StringValue != nil {
+		uid = *attr.StringValue
+	}
+	if uid == "" || uid != identity.UID {
+		return fmt.Errorf("interface %s is not the hardware of device %s", identity.Name, device)
+	}
+	if skipReason != "" {
+		return fmt.Errorf("interface %s can not be allocated: %s", identity.Name, skipReason)
+	}
+	if np.allocatedLinks()[identity.Name] {
+		return fmt.Errorf("interface %s is already allocated", identity.Name)
+	}
+	return nil
+}
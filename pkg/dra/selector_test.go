@@ -0,0 +1,159 @@
+package dra
+
+import (
+	"strings"
+	"testing"
+
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMatchLinks(t *testing.T) {
+	identities := []linkIdentity{
+		{Name: "eth1", MAC: "42:01:c0:a8:04:02", PCI: "0000:3b:00.0"},
+		{Name: "eth2", MAC: "42:01:c0:a8:04:03", PCI: "0000:3b:00.1"},
+		// the ports of a multiport device share the PCI function
+		{Name: "ib0", MAC: "42:01:c0:a8:04:04", PCI: "0000:5e:00.0"},
+		{Name: "ib1", MAC: "42:01:c0:a8:04:05", PCI: "0000:5e:00.0"},
+	}
+	tests := []struct {
+		name       string
+		macAddress string
+		pciAddress string
+		want       []string
+	}{
+		{
+			name:       "by MAC",
+			macAddress: "42:01:c0:a8:04:03",
+			want:       []string{"eth2"},
+		},
+		{
+			name:       "by MAC uppercase",
+			macAddress: "42:01:C0:A8:04:03",
+			want:       []string{"eth2"},
+		},
+		{
+			name:       "by PCI",
+			pciAddress: "0000:3B:00.0",
+			want:       []string{"eth1"},
+		},
+		{
+			name:       "by MAC and PCI",
+			macAddress: "42:01:c0:a8:04:05",
+			pciAddress: "0000:5e:00.0",
+			want:       []string{"ib1"},
+		},
+		{
+			name:       "MAC and PCI of different interfaces",
+			macAddress: "42:01:c0:a8:04:02",
+			pciAddress: "0000:3b:00.1",
+		},
+		{
+			name:       "no match",
+			macAddress: "42:01:c0:a8:04:99",
+		},
+		{
+			name:       "multiple matches",
+			pciAddress: "0000:5e:00.0",
+			want:       []string{"ib0", "ib1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, match := range matchLinks(identities, tt.macAddress, tt.pciAddress) {
+				got = append(got, match.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("matchLinks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSelectedLink(t *testing.T) {
+	uid := "0123456789abcdef"
+	np := &NetworkPlugin{
+		driverName:       "dra.net",
+		claimAllocations: storage{cache: map[types.UID]resourceapi.AllocationResult{}},
+		resolvedLinks:    resolvedLinks{links: map[string]string{}},
+	}
+	np.published.Set([]resourceapi.Device{
+		{
+			Name: "eth1",
+			Basic: &resourceapi.BasicDevice{
+				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+					"uid": {StringValue: &uid},
+				},
+			},
+		},
+	})
+	// the interface eth3 is allocated to another claim
+	np.claimAllocations.Add("other", resourceapi.AllocationResult{
+		Devices: resourceapi.DeviceAllocationResult{
+			Results: []resourceapi.DeviceRequestAllocationResult{
+				{Driver: "dra.net", Device: "eth3"},
+			},
+		},
+	})
+
+	tests := []struct {
+		name       string
+		device     string
+		identity   linkIdentity
+		skipReason string
+		wantErr    string
+	}{
+		{
+			name:     "renamed interface",
+			device:   "eth1",
+			identity: linkIdentity{Name: "eth9", UID: uid},
+		},
+		{
+			name:     "device not published",
+			device:   "eth2",
+			identity: linkIdentity{Name: "eth2", UID: uid},
+			wantErr:  "is not published",
+		},
+		{
+			name:     "other hardware",
+			device:   "eth1",
+			identity: linkIdentity{Name: "eth0", UID: "fedcba9876543210"},
+			wantErr:  "is not the hardware of device",
+		},
+		{
+			name:       "gateway interface",
+			device:     "eth1",
+			identity:   linkIdentity{Name: "eth0", UID: uid},
+			skipReason: "gateway",
+			wantErr:    "can not be allocated: gateway",
+		},
+		{
+			name:       "enslaved interface",
+			device:     "eth1",
+			identity:   linkIdentity{Name: "eth9", UID: uid},
+			skipReason: "enslaved",
+			wantErr:    "can not be allocated: enslaved",
+		},
+		{
+			name:     "allocated to another claim",
+			device:   "eth1",
+			identity: linkIdentity{Name: "eth3", UID: uid},
+			wantErr:  "is already allocated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := np.checkSelectedLink(tt.device, tt.identity, tt.skipReason)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkSelectedLink() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkSelectedLink() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package dra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// vfCreationTimeout is the maximum time to wait for the VF netdev to appear
+// once the VFs are created.
+const vfCreationTimeout = 10 * time.Second
+
+// partitionRegex matches the names of the VF partitions, <pf>-vf<index>.
+var partitionRegex = regexp.MustCompile(`^(.+)-vf([0-9]+)$`)
+
+// vfPartitions stores the netdev of the VF assigned to each partition device,
+// the VF is not visible in the host sysfs once it is moved to the Pod.
+type vfPartitions struct {
+	mu sync.RWMutex
+	// path is the file where the partitions are recorded, so the VFs created
+	// before a restart of the driver are removed once they are released
+	path    string
+	netdevs map[string]string
+	// numVFsMu serializes the creation and the removal of the VFs
+	numVFsMu sync.Mutex
+	// created are the PFs whose VFs were created by the driver
+	created map[string]bool
+}
+
+// partitionsState is the content of the partitions file.
+type partitionsState struct {
+	// Netdevs maps the partition devices to the netdev of their VF.
+	Netdevs map[string]string `json:"netdevs,omitempty"`
+	// Created are the PFs whose VFs were created by the driver.
+	Created []string `json:"created,omitempty"`
+}
+
+// load reads the partitions recorded in the file path, the file does not exist
+// if the driver never created VFs.
+func (p *vfPartitions) load(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state partitionsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse partitions file %s: %w", path, err)
+	}
+	for device, netdev := range state.Netdevs {
+		p.netdevs[device] = netdev
+	}
+	for _, pf := range state.Created {
+		p.created[pf] = true
+	}
+	return nil
+}
+
+// SetCreated records the VFs of the PF were created by the driver.
+func (p *vfPartitions) SetCreated(pf string, created bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if created {
+		p.created[pf] = true
+	} else {
+		delete(p.created, pf)
+	}
+	if err := p.save(); err != nil {
+		klog.Infof("failed to record the VFs created on %s: %v", pf, err)
+	}
+}
+
+// save writes the partitions to the file, it must be called with the lock
+// held. The partitions are not recorded if there is no file.
+func (p *vfPartitions) save() error {
+	if p.path == "" {
+		return nil
+	}
+	state := partitionsState{Netdevs: p.netdevs}
+	for pf := range p.created {
+		state.Created = append(state.Created, pf)
+	}
+	sort.Strings(state.Created)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// Created returns true if the VFs of the PF were created by the driver.
+func (p *vfPartitions) Created(pf string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.created[pf]
+}
+
+// CreatedPFs returns the PFs whose VFs were created by the driver.
+func (p *vfPartitions) CreatedPFs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pfs := make([]string, 0, len(p.created))
+	for pf := range p.created {
+		pfs = append(pfs, pf)
+	}
+	return pfs
+}
+
+func (p *vfPartitions) Add(device string, netdev string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.netdevs[device] = netdev
+	if err := p.save(); err != nil {
+		klog.Infof("failed to record the VF partition %s: %v", device, err)
+	}
+}
+
+func (p *vfPartitions) Get(device string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	netdev, ok := p.netdevs[device]
+	return netdev, ok
+}
+
+func (p *vfPartitions) Remove(device string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.netdevs[device]; !ok {
+		return
+	}
+	delete(p.netdevs, device)
+	if err := p.save(); err != nil {
+		klog.Infof("failed to forget the VF partition %s: %v", device, err)
+	}
+}
+
+// Owner returns the partition device the VF netdev is assigned to.
+func (p *vfPartitions) Owner(netdev string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for device, assigned := range p.netdevs {
+		if assigned == netdev {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+// Devices returns the partition devices that have a VF assigned.
+func (p *vfPartitions) Devices() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	devices := make([]string, 0, len(p.netdevs))
+	for device := range p.netdevs {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// partitionName returns the name of the device of the VF index of the PF.
+func partitionName(pf string, vf int) string {
+	return pf + "-vf" + strconv.Itoa(vf)
+}
+
+// parsePartition returns the PF and the VF index of a partition device name,
+// the interfaces that exist on the host are not partitions.
+func parsePartition(device string) (string, int, bool) {
+	match := partitionRegex.FindStringSubmatch(device)
+	if match == nil {
+		return "", 0, false
+	}
+	if _, err := netlink.LinkByName(device); err == nil {
+		return "", 0, false
+	}
+	vf, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return match[1], vf, true
+}
+
+// partitionDevices returns the devices for the VFs of the PF when none is
+// created yet. The kernel only creates the VFs all at once, so once they exist
+// they are published as regular interfaces and the PF has no partitions.
+func partitionDevices(pf string) []resourceapi.Device {
+	if sriovNumVFs(pf) > 0 {
+		return nil
+	}
+	var devices []resourceapi.Device
+	for vf := range sriovTotalVFs(pf) {
+		name := partitionName(pf, vf)
+		vfID := int64(vf)
+		partition := true
+		devices = append(devices, resourceapi.Device{
+			Name: name,
+			Basic: &resourceapi.BasicDevice{
+				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+					"name":            {StringValue: &name},
+					"pf_name":         {StringValue: &pf},
+					"vf_id":           {IntValue: &vfID},
+					"sriov_partition": {BoolValue: &partition},
+				},
+			},
+		})
+	}
+	return devices
+}
+
+// vfNetdev returns the name of the netdev of the VF index of the PF.
+func vfNetdev(pf string, vf int) (string, error) {
+	netPath := filepath.Join(sysfsnet, pf, "device", "virtfn"+strconv.Itoa(vf), "net")
+	entries, err := os.ReadDir(netPath)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("VF %d of %s does not have a netdev", vf, pf)
+	}
+	return entries[0].Name(), nil
+}
+
+// createVFs creates all the VFs supported by the PF, the kernel only allows to
+// change the number of VFs when there are none, so they can not be created one
+// by one without removing the VFs in use.
+func createVFs(pf string) error {
+	total := sriovTotalVFs(pf)
+	numVfsPath := filepath.Join(sysfsnet, pf, "device", "sriov_numvfs")
+	if err := os.WriteFile(numVfsPath, []byte(strconv.Itoa(total)), 0644); err != nil {
+		return fmt.Errorf("failed to create %d VFs on %s: %w", total, pf, err)
+	}
+	klog.Infof("created %d VFs on %s", total, pf)
+	return nil
+}
+
+// preparePartition creates the VFs of the PF if needed and assigns the netdev
+// of the VF to the partition device, it fails if the VF is in use by another
+// claim.
+func (np *NetworkPlugin) preparePartition(ctx context.Context, device string) (string, error) {
+	pf, vf, ok := parsePartition(device)
+	if !ok {
+		return "", fmt.Errorf("device %s is not a VF partition", device)
+	}
+	if total := sriovTotalVFs(pf); vf >= total {
+		return "", fmt.Errorf("VF %d of %s does not exist, the PF supports %d VFs", vf, pf, total)
+	}
+	np.partitions.numVFsMu.Lock()
+	if num := sriovNumVFs(pf); num == 0 {
+		if err := createVFs(pf); err != nil {
+			np.partitions.numVFsMu.Unlock()
+			return "", err
+		}
+		np.partitions.SetCreated(pf, true)
+	} else if vf >= num {
+		np.partitions.numVFsMu.Unlock()
+		return "", fmt.Errorf("VF %d of %s is not available, the PF has %d VFs configured", vf, pf, num)
+	}
+	np.partitions.numVFsMu.Unlock()
+	var netdev string
+	err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, vfCreationTimeout, true, func(context.Context) (bool, error) {
+		var err error
+		netdev, err = vfNetdev(pf, vf)
+		return err == nil, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("VF %d of %s netdev not found: %w", vf, pf, err)
+	}
+	for _, allocation := range np.claimAllocations.List() {
+		for _, allocated := range np.allocatedDevices(allocation) {
+			if np.linkName(allocated) == netdev {
+				return "", fmt.Errorf("VF %d of %s is in use by device %s", vf, pf, allocated)
+			}
+		}
+	}
+	np.partitions.Add(device, netdev)
+	klog.Infof("VF partition %s assigned to interface %s", device, netdev)
+	return netdev, nil
+}
+
+// restorePartitions rebuilds the partitions recorded before the driver
+// restarted. The claims prepared with partitions are restored, so their VFs are
+// not published as available and are released when the claims are unprepared.
+// The partitions of the claims that do not exist anymore are forgotten, as the
+// PFs whose VFs were removed while the driver was down. It must run before the
+// resources are published.
+func (np *NetworkPlugin) restorePartitions(ctx context.Context) error {
+	for _, pf := range np.partitions.CreatedPFs() {
+		if sriovNumVFs(pf) == 0 {
+			np.partitions.SetCreated(pf, false)
+		}
+	}
+	devices := np.partitions.Devices()
+	if len(devices) == 0 {
+		return nil
+	}
+	claims, err := np.kubeClient.ResourceV1alpha3().ResourceClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list the resource claims: %w", err)
+	}
+	prepared := map[string]bool{}
+	for _, claim := range claims.Items {
+		// only the claims reserved for a Pod are prepared
+		if claim.Status.Allocation == nil || !slices.ContainsFunc(claim.Status.ReservedFor, isPodReference) {
+			continue
+		}
+		restored := false
+		for _, result := range claim.Status.Allocation.Devices.Results {
+			if result.Driver == np.driverName && result.Pool == np.pool() && slices.Contains(devices, result.Device) {
+				prepared[result.Device] = true
+				restored = true
+			}
+		}
+		if restored {
+			klog.Infof("restored the VF partitions of claim %s/%s", claim.Namespace, claim.Name)
+			np.claimAllocations.Add(claim.UID, *claim.Status.Allocation)
+		}
+	}
+	for _, device := range devices {
+		if !prepared[device] {
+			klog.Infof("forgetting the VF partition %s, its claim does not exist", device)
+			np.partitions.Remove(device)
+		}
+	}
+	return nil
+}
+
+// releasePartitionVFs removes the VFs created by the driver for the partitions
+// of the allocation once none of the VFs of the PF is in use, by this or other
+// claims, unless the VFs are kept provisioned for reuse. It must be called
+// once the claim is released.
+func (np *NetworkPlugin) releasePartitionVFs(allocation resourceapi.AllocationResult) {
+	if np.sriovKeepVFs {
+		return
+	}
+	np.partitions.numVFsMu.Lock()
+	defer np.partitions.numVFsMu.Unlock()
+	allocatedLinks := np.allocatedLinks()
+	for _, result := range allocation.Devices.Results {
+		if result.Driver != np.driverName {
+			continue
+		}
+		match := partitionRegex.FindStringSubmatch(result.Device)
+		if match == nil || !np.partitions.Created(match[1]) {
+			continue
+		}
+		pf := match[1]
+		// the VFs attached to the Pods are not visible on the host
+		if available, total := availableVFs(pf, allocatedLinks), sriovTotalVFs(pf); available < total {
+			klog.V(2).Infof("keeping the VFs of %s, %d of %d VFs are in use", pf, total-available, total)
+			continue
+		}
+		numVfsPath := filepath.Join(sysfsnet, pf, "device", "sriov_numvfs")
+		if err := os.WriteFile(numVfsPath, []byte("0"), 0644); err != nil {
+			klog.Infof("failed to remove the VFs of %s: %v", pf, err)
+			continue
+		}
+		np.partitions.SetCreated(pf, false)
+		klog.Infof("removed the VFs of %s, none of them is in use", pf)
+	}
+}
+
+// linkName returns the name of the interface of the device, the netdev of the
+// VF for the partitions or the interface resolved by hardware address.
+func (np *NetworkPlugin) linkName(device string) string {
+	if netdev, ok := np.partitions.Get(device); ok {
+		return netdev
+	}
+	if link, ok := np.resolvedLinks.Get(device); ok {
+		return link
+	}
+	return device
+}
+
+// allocatedLinks returns the interfaces of the devices of the prepared claims.
+func (np *NetworkPlugin) allocatedLinks() map[string]bool {
+	links := map[string]bool{}
+	for _, allocation := range np.claimAllocations.List() {
+		for _, allocated := range np.allocatedDevices(allocation) {
+			links[np.linkName(allocated)] = true
+		}
+	}
+	return links
+}
+
+// addVFCapacity publishes the total VFs of the PF as its vfs capacity, and the
+// VFs that are not in use in the sriov_available_vfs attribute, so the claims
+// can select the PFs with free VFs. The VFs in use are obtained on each
+// publication from sysfs and the allocated links.
+func addVFCapacity(device resourceapi.Device, pf string, allocatedLinks map[string]bool) {
+	total := sriovTotalVFs(pf)
+	if total == 0 {
+		return
+	}
+	device.Basic.Capacity["vfs"] = *resource.NewQuantity(int64(total), resource.DecimalSI)
+	available := int64(availableVFs(pf, allocatedLinks))
+	device.Basic.Attributes["sriov_available_vfs"] = resourceapi.DeviceAttribute{IntValue: &available}
+}
+
+// availableVFs returns the number of VFs of the PF that are not in use, the
+// VFs that are not created yet are available. The VFs attached to the Pods do
+// not have a netdev in the host network namespace, and the VFs of the prepared
+// claims that are not attached yet are obtained from the allocated links.
+func availableVFs(pf string, allocatedLinks map[string]bool) int {
+	used := 0
+	for vf := 0; vf < sriovNumVFs(pf); vf++ {
+		netdev, err := vfNetdev(pf, vf)
+		if err != nil || allocatedLinks[netdev] {
+			used++
+		}
+	}
+	return max(sriovTotalVFs(pf)-used, 0)
+}
@@ -0,0 +1,306 @@
+package dra
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	resourceapi "k8s.io/api/resource/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha4"
+)
+
+func newVFPartitions() *vfPartitions {
+	return &vfPartitions{netdevs: map[string]string{}, created: map[string]bool{}}
+}
+
+func TestVFPartitionsRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partitions.json")
+	p := newVFPartitions()
+	if err := p.load(path); err != nil {
+		t.Fatalf("load() without file error = %v", err)
+	}
+	p.SetCreated("eth1", true)
+	p.SetCreated("eth2", true)
+	p.SetCreated("eth1", false)
+
+	// the driver restarts
+	restored := newVFPartitions()
+	if err := restored.load(path); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if restored.Created("eth1") {
+		t.Errorf("the VFs of eth1 were removed, they must not be restored")
+	}
+	if !restored.Created("eth2") {
+		t.Errorf("the VFs of eth2 were created by the driver, they must be restored")
+	}
+}
+
+func TestVFPartitionsLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partitions.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := newVFPartitions()
+	if err := p.load(path); err == nil {
+		t.Errorf("load() expected an error for an invalid file")
+	}
+}
+
+func TestRestorePartitions(t *testing.T) {
+	driver := "dra.net"
+	allocation := newAllocation(driver, "eth9-vf1")
+	prepared := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "prepared", Namespace: "default", UID: "prepared-uid"},
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation:  &allocation,
+			ReservedFor: []resourceapi.ResourceClaimConsumerReference{{Resource: "pods", Name: "pod", UID: "pod-uid"}},
+		},
+	}
+	np := &NetworkPlugin{
+		driverName:       driver,
+		nodeName:         "node",
+		kubeClient:       fake.NewSimpleClientset(prepared),
+		claimAllocations: storage{cache: map[types.UID]resourceapi.AllocationResult{}},
+		partitions:       vfPartitions{netdevs: map[string]string{}, created: map[string]bool{}},
+	}
+	np.partitions.Add("eth9-vf1", "eth9v1")
+	// the claim of the partition was deleted while the driver was down
+	np.partitions.Add("eth9-vf2", "eth9v2")
+	// the PF does not have VFs
+	np.partitions.SetCreated("eth9", true)
+
+	if err := np.restorePartitions(context.Background()); err != nil {
+		t.Fatalf("restorePartitions() error = %v", err)
+	}
+	if _, ok := np.claimAllocations.Get(prepared.UID); !ok {
+		t.Errorf("the claim with a partition must be restored")
+	}
+	if netdev, ok := np.partitions.Get("eth9-vf1"); !ok || netdev != "eth9v1" {
+		t.Errorf("partition eth9-vf1 = %q, want eth9v1", netdev)
+	}
+	if _, ok := np.partitions.Get("eth9-vf2"); ok {
+		t.Errorf("the partition of a deleted claim must be forgotten")
+	}
+	if np.partitions.Created("eth9") {
+		t.Errorf("the PF without VFs must be forgotten")
+	}
+}
+
+func TestPartitionDevices(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "PF without VFs",
+			files: map[string]string{
+				"class/net/ens9f0/device/sriov_totalvfs": "4\n",
+				"class/net/ens9f0/device/sriov_numvfs":   "0\n",
+			},
+			want: []string{"ens9f0-vf0", "ens9f0-vf1", "ens9f0-vf2", "ens9f0-vf3"},
+		},
+		{
+			name: "PF with some VFs",
+			files: map[string]string{
+				"class/net/ens9f0/device/sriov_totalvfs": "4\n",
+				"class/net/ens9f0/device/sriov_numvfs":   "2\n",
+			},
+		},
+		{
+			name: "PF with all the VFs",
+			files: map[string]string{
+				"class/net/ens9f0/device/sriov_totalvfs": "4\n",
+				"class/net/ens9f0/device/sriov_numvfs":   "4\n",
+			},
+		},
+		{
+			name: "not SR-IOV capable",
+			files: map[string]string{
+				"class/net/ens9f0/mtu": "1500\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, tt.files)
+			var got []string
+			for _, device := range partitionDevices("ens9f0") {
+				got = append(got, device.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("partitionDevices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddVFCapacity(t *testing.T) {
+	files := map[string]string{
+		"class/net/ens9f0/device/sriov_totalvfs": "4\n",
+		"class/net/ens9f0/device/sriov_numvfs":   "3\n",
+		// the VF 2 is attached to a Pod, its netdev is not on the host
+		"class/net/ens9f0/device/virtfn0/net/ens9f0v0/ifindex": "10\n",
+		"class/net/ens9f0/device/virtfn1/net/ens9f0v1/ifindex": "11\n",
+	}
+	tests := []struct {
+		name           string
+		files          map[string]string
+		allocatedLinks map[string]bool
+		wantTotal      int64
+		wantAvailable  int64
+	}{
+		{
+			name:          "VF attached to a Pod",
+			files:         files,
+			wantTotal:     4,
+			wantAvailable: 3,
+		},
+		{
+			name:           "VF of a prepared claim",
+			files:          files,
+			allocatedLinks: map[string]bool{"ens9f0v1": true},
+			wantTotal:      4,
+			wantAvailable:  2,
+		},
+		{
+			name: "VFs not created",
+			files: map[string]string{
+				"class/net/ens9f0/device/sriov_totalvfs": "4\n",
+				"class/net/ens9f0/device/sriov_numvfs":   "0\n",
+			},
+			wantTotal:     4,
+			wantAvailable: 4,
+		},
+		{
+			name: "not SR-IOV capable",
+			files: map[string]string{
+				"class/net/ens9f0/mtu": "1500\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSysfs(t, tt.files)
+			device := resourceapi.Device{Name: "ens9f0", Basic: &resourceapi.BasicDevice{
+				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{},
+				Capacity:   map[resourceapi.QualifiedName]resource.Quantity{},
+			}}
+			addVFCapacity(device, "ens9f0", tt.allocatedLinks)
+			total, ok := device.Basic.Capacity["vfs"]
+			if ok != (tt.wantTotal > 0) {
+				t.Fatalf("vfs capacity published = %v, want %v", ok, tt.wantTotal > 0)
+			}
+			if got := total.Value(); got != tt.wantTotal {
+				t.Errorf("vfs capacity = %d, want %d", got, tt.wantTotal)
+			}
+			available := device.Basic.Attributes["sriov_available_vfs"].IntValue
+			if tt.wantTotal == 0 {
+				if available != nil {
+					t.Errorf("sriov_available_vfs attribute = %d, want it omitted", *available)
+				}
+				return
+			}
+			if available == nil || *available != tt.wantAvailable {
+				t.Errorf("sriov_available_vfs attribute = %v, want %d", available, tt.wantAvailable)
+			}
+		})
+	}
+}
+
+func TestNodePrepareResourcePartitionVF(t *testing.T) {
+	// the loopback interface plays the VF netdev assigned to a partition
+	claim := newClaim("claim-uid", newAllocation("dra.net", "lo"),
+		resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"})
+	np := newTestPlugin(claim)
+	np.partitions.Add("ens9f0-vf0", "lo")
+
+	_, err := np.nodePrepareResource(context.Background(), &drapb.Claim{Namespace: "default", Name: "claim", UID: "claim-uid"})
+	if err == nil || !strings.Contains(err.Error(), "partition ens9f0-vf0") {
+		t.Fatalf("nodePrepareResource() error = %v, want the VF of the partition rejected", err)
+	}
+	if _, ok := np.claimAllocations.Get("claim-uid"); ok {
+		t.Errorf("the claim must not be prepared")
+	}
+	// the VF is not published as a regular interface either
+	if _, reason := np.interfaceSkipReason(fakeInterface("lo"), nil); reason != "partition" {
+		t.Errorf("interfaceSkipReason() = %q, want partition", reason)
+	}
+}
+
+func TestPartitionsSharedPF(t *testing.T) {
+	fakeSysfs(t, map[string]string{
+		"class/net/ens9f0/device/sriov_totalvfs":           "2\n",
+		"class/net/ens9f0/device/sriov_numvfs":             "0\n",
+		"class/net/ens9f0/device/virtfn0/net/ens9f0v0/mtu": "1500\n",
+		"class/net/ens9f0/device/virtfn1/net/ens9f0v1/mtu": "1500\n",
+	})
+	// the veths play the VF netdevs in the host network namespace
+	hostNS := newTestNS(t)
+	addTestVeth(t, hostNS, "ens9f0v0")
+	addTestVeth(t, hostNS, "ens9f0v1")
+	pod := resourceapi.ResourceClaimConsumerReference{Resource: "pods", Name: "pod", UID: "pod-uid"}
+	claim1 := newClaim("claim-1", newAllocation("dra.net", "ens9f0-vf0"), pod)
+	claim1.Name = "claim-1"
+	claim2 := newClaim("claim-2", newAllocation("dra.net", "ens9f0-vf1"), pod)
+	claim2.Name = "claim-2"
+	np := newTestPlugin(claim1, claim2)
+	np.sriovPartitions = true
+	numVFs := func() string {
+		data, err := os.ReadFile(filepath.Join(sysfsnet, "ens9f0", "device", "sriov_numvfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	err := hostNS.Do(func(ns.NetNS) error {
+		ctx := context.Background()
+		for _, claim := range []*resourceapi.ResourceClaim{claim1, claim2} {
+			if _, err := np.nodePrepareResource(ctx, &drapb.Claim{Namespace: claim.Namespace, Name: claim.Name, UID: string(claim.UID)}); err != nil {
+				return fmt.Errorf("nodePrepareResource(%s) error = %w", claim.Name, err)
+			}
+		}
+		if got := numVFs(); got != "2" {
+			t.Errorf("sriov_numvfs = %s after prepare, want the VFs created", got)
+		}
+		if netdev, _ := np.partitions.Get("ens9f0-vf1"); netdev != "ens9f0v1" {
+			t.Errorf("partition ens9f0-vf1 = %q, want ens9f0v1", netdev)
+		}
+
+		if err := np.nodeUnprepareResource(ctx, &drapb.Claim{Namespace: "default", Name: "claim-1", UID: "claim-1"}); err != nil {
+			return fmt.Errorf("nodeUnprepareResource(claim-1) error = %w", err)
+		}
+		// the VF of the other claim is still in use
+		if got := numVFs(); got != "2" {
+			t.Errorf("sriov_numvfs = %s with a claim of the PF prepared, want the VFs kept", got)
+		}
+		if !np.partitions.Created("ens9f0") {
+			t.Errorf("the VFs of ens9f0 must be recorded while in use")
+		}
+
+		if err := np.nodeUnprepareResource(ctx, &drapb.Claim{Namespace: "default", Name: "claim-2", UID: "claim-2"}); err != nil {
+			return fmt.Errorf("nodeUnprepareResource(claim-2) error = %w", err)
+		}
+		if got := numVFs(); got != "0" {
+			t.Errorf("sriov_numvfs = %s once the last claim is released, want 0", got)
+		}
+		if np.partitions.Created("ens9f0") {
+			t.Errorf("the removed VFs of ens9f0 must be forgotten")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,73 @@
+package dra
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/nri/pkg/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// networkStatusAnnotation is the Pod annotation, prefixed by the driver name,
+// with the interfaces attached to the Pod and the addresses assigned by the
+// driver. The ResourceClaim status does not have a field for the device
+// configuration, so the claim is annotated instead if NRI is disabled.
+const networkStatusAnnotation = "network-status"
+
+// interfaceStatus is the interface attached to the Pod.
+//
+//	[{"device":"eth1","interface":"net1","addresses":["192.168.1.2/24"]}]
+type interfaceStatus struct {
+	// Device is the name of the allocated device.
+	Device string `json:"device"`
+	// Interface is the name of the interface inside the Pod.
+	Interface string `json:"interface"`
+	// Addresses assigned by the driver in CIDR format, static, obtained from
+	// the IPAM or by DHCPv6.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// newInterfaceStatus returns the status of the interface with the addresses
+// recorded in its state.
+func newInterfaceStatus(device string, ifName string, state deviceState) interfaceStatus {
+	status := interfaceStatus{Device: device, Interface: ifName}
+	for _, addr := range state.Addresses {
+		status.Addresses = append(status.Addresses, addr.IPNet.String())
+	}
+	return status
+}
+
+// publishNetworkStatus annotates the Pod with the status of its interfaces, or
+// the claim if NRI is disabled. It is best effort, the Pod does not fail if
+// the annotation can not be set.
+func (np *NetworkPlugin) publishNetworkStatus(ctx context.Context, pod *api.PodSandbox, statuses []interfaceStatus) {
+	if len(statuses) == 0 {
+		return
+	}
+	value, err := json.Marshal(statuses)
+	if err != nil {
+		klog.Infof("failed to encode the network status of %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{np.driverName + "/" + networkStatusAnnotation: string(value)},
+		},
+	})
+	if err != nil {
+		klog.Infof("failed to encode the network status of %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	if np.disableNRI {
+		_, err = np.kubeClient.ResourceV1alpha3().ResourceClaims(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = np.kubeClient.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		klog.Infof("failed to publish the network status %s of %s/%s: %v", value, pod.Namespace, pod.Name, err)
+		return
+	}
+	klog.V(2).Infof("published the network status of %s/%s: %s", pod.Namespace, pod.Name, value)
+}
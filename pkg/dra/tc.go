@@ -0,0 +1,81 @@
+package dra
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// applyBandwidth limits the traffic of the link, the egress traffic is shaped
+// with an htb qdisc and the ingress traffic is policed, since it is not
+// possible to queue the traffic received.
+func applyBandwidth(link netlink.Link, config *NetworkConfig, state *deviceState) error {
+	linkAttrs := link.Attrs()
+	if config.EgressMbps > 0 {
+		qdisc := netlink.NewHtb(netlink.QdiscAttrs{
+			LinkIndex: linkAttrs.Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		})
+		qdisc.Defcls = 1
+		if err := netlink.QdiscAdd(qdisc); err != nil {
+			return qdiscError("htb", linkAttrs.Name, err)
+		}
+		state.Qdiscs = append(state.Qdiscs, qdisc)
+		rate := uint64(config.EgressMbps) * 1000 * 1000
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: linkAttrs.Index,
+			Parent:    qdisc.Handle,
+			Handle:    netlink.MakeHandle(1, 1),
+		}, netlink.HtbClassAttrs{
+			Rate: rate,
+			Ceil: rate,
+		})
+		if err := netlink.ClassAdd(class); err != nil {
+			return fmt.Errorf("failed to add htb class on %s: %w", linkAttrs.Name, err)
+		}
+	}
+	if config.IngressMbps > 0 {
+		qdisc := &netlink.Ingress{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: linkAttrs.Index,
+				Handle:    netlink.MakeHandle(0xffff, 0),
+				Parent:    netlink.HANDLE_INGRESS,
+			},
+		}
+		if err := netlink.QdiscAdd(qdisc); err != nil {
+			return qdiscError("ingress", linkAttrs.Name, err)
+		}
+		state.Qdiscs = append(state.Qdiscs, qdisc)
+		police := netlink.NewPoliceAction()
+		police.Rate = uint32(uint64(config.IngressMbps) * 1000 * 1000 / 8)
+		// allow bursts of 10ms of traffic, and at least a couple of packets
+		police.Burst = max(police.Rate/100, uint32(2*linkAttrs.MTU))
+		police.ExceedAction = netlink.TC_POLICE_SHOT
+		filter := &netlink.MatchAll{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: linkAttrs.Index,
+				Parent:    qdisc.Handle,
+				Priority:  1,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Actions: []netlink.Action{police},
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add ingress police filter on %s: %w", linkAttrs.Name, err)
+		}
+	}
+	return nil
+}
+
+// qdiscError returns the error adding a qdisc, the kernel returns ENOENT if
+// the qdisc is not available, typically because the module is not loaded.
+func qdiscError(kind string, ifName string, err error) error {
+	if errors.Is(err, unix.ENOENT) {
+		klog.Warningf("qdisc %s not available, check the kernel module sch_%s is loaded", kind, kind)
+	}
+	return fmt.Errorf("failed to add %s qdisc on %s: %w", kind, ifName, err)
+}
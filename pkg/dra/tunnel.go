@@ -0,0 +1,181 @@
+package dra
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// isTunnel returns true if the configuration creates a tunnel over the
+// allocated device instead of attaching the device to the Pod.
+func (c *NetworkConfig) isTunnel() bool {
+	return c != nil && (c.Mode == modeGRE || c.Mode == modeIPIP || c.Mode == modeVXLAN)
+}
+
+// tunnelName returns the name of the tunnel inside the Pod network namespace.
+func (c *NetworkConfig) tunnelName() string {
+	if c.TunnelName != "" {
+		return c.TunnelName
+	}
+	return defaultTunnelName
+}
+
+// validateTunnel checks the tunnel endpoints, both must be of the same IP family
+// and IPIP only supports IPv4. VXLAN tunnels can use a multicast group instead
+// of a remote address.
+func (c *NetworkConfig) validateTunnel() error {
+	if c.Mode == modeVXLAN {
+		if c.VNI < 0 || c.VNI > maxVNI {
+			return fmt.Errorf("invalid vni %d, must be between 0 and %d", c.VNI, maxVNI)
+		}
+		if c.Key != 0 {
+			return fmt.Errorf("key is only supported in mode %q", modeGRE)
+		}
+		if c.Dev != "" && len(c.Dev) > unix.IFNAMSIZ-1 {
+			return fmt.Errorf("invalid dev %q", c.Dev)
+		}
+		if c.Group != "" {
+			if c.Remote != "" {
+				return fmt.Errorf("group and remote are mutually exclusive")
+			}
+			group := net.ParseIP(c.Group)
+			if group == nil || !group.IsMulticast() {
+				return fmt.Errorf("invalid vxlan group %q, must be a multicast address", c.Group)
+			}
+			return nil
+		}
+	} else if c.VNI != 0 || c.Group != "" || c.Dev != "" {
+		return fmt.Errorf("vni, group and dev require mode %q", modeVXLAN)
+	}
+	remote := net.ParseIP(c.Remote)
+	if remote == nil {
+		return fmt.Errorf("invalid tunnel remote address %q", c.Remote)
+	}
+	if c.Local != "" {
+		local := net.ParseIP(c.Local)
+		if local == nil {
+			return fmt.Errorf("invalid tunnel local address %q", c.Local)
+		}
+		if (local.To4() == nil) != (remote.To4() == nil) {
+			return fmt.Errorf("tunnel local address %s and remote address %s are of different IP families", c.Local, c.Remote)
+		}
+	}
+	if c.Mode == modeIPIP {
+		if remote.To4() == nil {
+			return fmt.Errorf("mode %q requires IPv4 addresses", modeIPIP)
+		}
+		if c.Key != 0 {
+			return fmt.Errorf("key is only supported in mode %q", modeGRE)
+		}
+	}
+	return nil
+}
+
+// validateTunnelLocal checks the local address of the tunnel is an address of
+// the node and the underlay device exists, otherwise the encapsulated traffic
+// can not be sent.
+func validateTunnelLocal(config *NetworkConfig) error {
+	if config.Dev != "" {
+		if _, err := netlink.LinkByName(config.Dev); err != nil {
+			return fmt.Errorf("vxlan dev %s not found: %w", config.Dev, err)
+		}
+	}
+	if config.Local == "" {
+		return nil
+	}
+	local := net.ParseIP(config.Local)
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list the node addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(local) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tunnel local address %s is not an address of the node", config.Local)
+}
+
+// tunnelHostName returns the name used to create the tunnel on the host before
+// moving it to the Pod, it has to be unique per Pod and tunnel.
+func tunnelHostName(podUID string, name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(podUID + "/" + name))
+	return fmt.Sprintf("tun%08x", h.Sum32())
+}
+
+// createTunnel creates the tunnel on the host over the underlay interface, so
+// the encapsulated traffic uses the host network once the tunnel is moved to
+// the Pod.
+func createTunnel(hostName string, underlay string, config *NetworkConfig) error {
+	if config.Dev != "" {
+		underlay = config.Dev
+	}
+	link, err := netlink.LinkByName(underlay)
+	if err != nil {
+		return fmt.Errorf("failed to find tunnel underlay %s: %w", underlay, err)
+	}
+	attrs := netlink.LinkAttrs{Name: hostName}
+	var tunnel netlink.Link
+	switch config.Mode {
+	case modeGRE:
+		tunnel = &netlink.Gretun{
+			LinkAttrs: attrs,
+			Link:      uint32(link.Attrs().Index),
+			Local:     net.ParseIP(config.Local),
+			Remote:    net.ParseIP(config.Remote),
+			IKey:      config.Key,
+			OKey:      config.Key,
+			PMtuDisc:  1,
+		}
+	case modeIPIP:
+		tunnel = &netlink.Iptun{
+			LinkAttrs: attrs,
+			Link:      uint32(link.Attrs().Index),
+			Local:     net.ParseIP(config.Local),
+			Remote:    net.ParseIP(config.Remote),
+			PMtuDisc:  1,
+		}
+	case modeVXLAN:
+		group := net.ParseIP(config.Group)
+		if group == nil {
+			group = net.ParseIP(config.Remote)
+		}
+		tunnel = &netlink.Vxlan{
+			LinkAttrs:    attrs,
+			VxlanId:      config.VNI,
+			VtepDevIndex: link.Attrs().Index,
+			SrcAddr:      net.ParseIP(config.Local),
+			Group:        group,
+			Port:         vxlanPort,
+			Learning:     true,
+		}
+	default:
+		return fmt.Errorf("unknown tunnel mode %q", config.Mode)
+	}
+	if err := netlink.LinkAdd(tunnel); err != nil {
+		return fmt.Errorf("failed to create %s tunnel over %s: %w", config.Mode, underlay, err)
+	}
+	return nil
+}
+
+// deleteLink deletes the virtual interface name inside the network namespace nsPath.
+func deleteLink(nsPath string, name string) error {
+	containerNs, err := ns.GetNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer containerNs.Close()
+
+	return containerNs.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find %s: %w", name, err)
+		}
+		return netlink.LinkDel(link)
+	})
+}
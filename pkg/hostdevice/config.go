@@ -0,0 +1,69 @@
+package hostdevice
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// linkConfig is the IP configuration of a link, it is lost when the link is
+// set down or moved to another network namespace.
+type linkConfig struct {
+	addrs  []netlink.Addr
+	routes []netlink.Route
+}
+
+// getLinkConfig returns the addresses and routes of the link. The IPv6 link
+// local addresses and the routes added by the kernel are omitted, since they
+// are created again when the link is configured in the new namespace.
+func getLinkConfig(link netlink.Link) (*linkConfig, error) {
+	config := &linkConfig{}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of %q: %w", link.Attrs().Name, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		// the label must have the interface name as prefix, and it changes
+		addr.Label = ""
+		config.addrs = append(config.addrs, addr)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the routes of %q: %w", link.Attrs().Name, err)
+	}
+	for _, route := range routes {
+		if route.Protocol == unix.RTPROT_KERNEL || len(route.MultiPath) > 0 {
+			continue
+		}
+		config.routes = append(config.routes, route)
+	}
+	return config, nil
+}
+
+// restoreAddrs adds the addresses to the link, the dynamic addresses keep
+// their remaining lifetimes.
+func (c *linkConfig) restoreAddrs(link netlink.Link) error {
+	for _, addr := range c.addrs {
+		addr.LinkIndex = link.Attrs().Index
+		if err := netlink.AddrReplace(link, &addr); err != nil {
+			return fmt.Errorf("failed to restore address %s on %q: %w", addr.IPNet, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// restoreRoutes adds the routes to the link, the routes with a gateway
+// require the link to be up.
+func (c *linkConfig) restoreRoutes(link netlink.Link) error {
+	for _, route := range c.routes {
+		route.LinkIndex = link.Attrs().Index
+		if err := netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to restore route %s on %q: %w", route.String(), link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
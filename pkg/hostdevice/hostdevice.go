@@ -3,33 +3,108 @@ package hostdevice
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
 )
 
 // Based on existing host-device CNI plugin
 // https://github.com/containernetworking/plugins/blob/main/plugins/main/host-device/host-device.go
 
+// DefaultTempNamePrefix is the prefix of the temporary names of the devices,
+// it identifies the devices being moved by the driver. The prefix and the
+// interface index must fit in the 15 characters of the interface names.
+const DefaultTempNamePrefix = "knd_"
+
+var tempNamePrefix = DefaultTempNamePrefix
+
+// SetTempNamePrefix sets the prefix of the temporary names of the devices, it
+// must be called before moving any device.
+func SetTempNamePrefix(prefix string) {
+	tempNamePrefix = prefix
+}
+
+// IsTempName returns true if the name is a temporary name set by the driver,
+// a device keeps it if the driver crashes while moving it.
+func IsTempName(name string) bool {
+	index, ok := strings.CutPrefix(name, tempNamePrefix)
+	if !ok || index == "" {
+		return false
+	}
+	_, err := strconv.Atoi(index)
+	return err == nil
+}
+
 // setTempName sets a temporary name for netdevice to avoid collisions with interfaces names.
 func setTempName(dev netlink.Link) (netlink.Link, error) {
-	tempName := fmt.Sprintf("%s%d", "temp_", dev.Attrs().Index)
+	tempName := fmt.Sprintf("%s%d", tempNamePrefix, dev.Attrs().Index)
 
 	// rename to tempName
 	if err := netlink.LinkSetName(dev, tempName); err != nil {
-		return nil, fmt.Errorf("failed to rename device %q to %q: %v", dev.Attrs().Name, tempName, err)
+		return nil, fmt.Errorf("failed to rename device %q to %q: %w", dev.Attrs().Name, tempName, err)
 	}
 
 	// Get updated Link obj
 	tempDev, err := netlink.LinkByName(tempName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find %q after rename to %q: %v", dev.Attrs().Name, tempName, err)
+		return nil, fmt.Errorf("failed to find %q after rename to %q: %w", dev.Attrs().Name, tempName, err)
 	}
 
 	return tempDev, nil
 }
 
-func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error {
+// maxFallbackNames is the number of alternative names tried when the original
+// name of a device is in use on the host.
+const maxFallbackNames = 100
+
+// fallbackName returns an alternative name for the device, for which inUse
+// returns false, with a numeric suffix appended to its original name. The
+// suffix is separated by a dash, so the name is still a valid DNS label and the
+// device can be published. The original name is truncated if needed to fit in
+// the 15 characters of the interface names.
+func fallbackName(name string, inUse func(string) bool) (string, error) {
+	for i := 1; i < maxFallbackNames; i++ {
+		suffix := fmt.Sprintf("-%d", i)
+		candidate := name
+		if len(candidate)+len(suffix) > 15 {
+			candidate = candidate[:15-len(suffix)]
+		}
+		candidate += suffix
+		if !inUse(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no name available for %q", name)
+}
+
+// linkInUse returns true if there is an interface with the name in the current
+// network namespace.
+func linkInUse(name string) bool {
+	_, err := netlink.LinkByName(name)
+	_, notFound := err.(netlink.LinkNotFoundError)
+	return !notFound
+}
+
+// MoveLinkIn moves the host interface to the container namespace with the name
+// ifName. If preserveConfig is true, the addresses and routes of the interface,
+// that are flushed when it is moved, are restored in the container namespace
+// before the interface is returned, so its configuration, per example a DHCP
+// lease, is not lost.
+func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string, preserveConfig bool) error {
+	return moveLinkIn(hostIfName, containerNsPAth, ifName, preserveConfig, true)
+}
+
+// MoveLinkInDown moves the host interface to the container namespace with the
+// name ifName and leaves it down, for the applications that manage the
+// interface themselves, per example DPDK.
+func MoveLinkInDown(hostIfName string, containerNsPAth string, ifName string) error {
+	return moveLinkIn(hostIfName, containerNsPAth, ifName, false, false)
+}
+
+func moveLinkIn(hostIfName string, containerNsPAth string, ifName string, preserveConfig bool, bringUp bool) error {
 	containerNs, err := ns.GetNS(containerNsPAth)
 	if err != nil {
 		return err
@@ -40,14 +115,22 @@ func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error
 	}
 	origLinkFlags := hostDev.Attrs().Flags
 	hostDevName := hostDev.Attrs().Name
+	// the configuration is flushed when the device is set down
+	var config *linkConfig
+	if preserveConfig {
+		config, err = getLinkConfig(hostDev)
+		if err != nil {
+			return err
+		}
+	}
 	defaultNs, err := ns.GetCurrentNS()
 	if err != nil {
-		return fmt.Errorf("failed to get host namespace: %v", err)
+		return fmt.Errorf("failed to get host namespace: %w", err)
 	}
 
 	// Devices can be renamed only when down
 	if err = netlink.LinkSetDown(hostDev); err != nil {
-		return fmt.Errorf("failed to set %q down: %v", hostDev.Attrs().Name, err)
+		return fmt.Errorf("failed to set %q down: %w", hostDev.Attrs().Name, err)
 	}
 
 	// restore original link state in case of error
@@ -61,7 +144,7 @@ func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error
 
 	hostDev, err = setTempName(hostDev)
 	if err != nil {
-		return fmt.Errorf("failed to rename device %q to temporary name: %v", hostDevName, err)
+		return fmt.Errorf("failed to rename device %q to temporary name: %w", hostDevName, err)
 	}
 
 	// restore original netdev name in case of error
@@ -72,7 +155,7 @@ func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error
 	}()
 
 	if err = netlink.LinkSetNsFd(hostDev, int(containerNs.Fd())); err != nil {
-		return fmt.Errorf("failed to move %q to container ns: %v", hostDev.Attrs().Name, err)
+		return fmt.Errorf("failed to move %q to container ns: %w", hostDev.Attrs().Name, err)
 	}
 
 	var contDev netlink.Link
@@ -81,7 +164,7 @@ func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error
 		var err error
 		contDev, err = netlink.LinkByName(tempDevName)
 		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", tempDevName, err)
+			return fmt.Errorf("failed to find %q: %w", tempDevName, err)
 		}
 
 		// move netdev back to host namespace in case of error
@@ -98,11 +181,11 @@ func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error
 
 		// Save host device name into the container device's alias property
 		if err = netlink.LinkSetAlias(contDev, hostDevName); err != nil {
-			return fmt.Errorf("failed to set alias to %q: %v", tempDevName, err)
+			return fmt.Errorf("failed to set alias to %q: %w", tempDevName, err)
 		}
 		// Rename container device to respect args.IfName
 		if err = netlink.LinkSetName(contDev, ifName); err != nil {
-			return fmt.Errorf("failed to rename device %q to %q: %v", tempDevName, ifName, err)
+			return fmt.Errorf("failed to rename device %q to %q: %w", tempDevName, ifName, err)
 		}
 
 		// restore tempDevName in case of error
@@ -112,26 +195,42 @@ func MoveLinkIn(hostIfName string, containerNsPAth string, ifName string) error
 			}
 		}()
 
-		// Bring container device up
-		if err = netlink.LinkSetUp(contDev); err != nil {
-			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		// the addresses are restored before the device is up, so it never
+		// sends traffic without them
+		if config != nil {
+			if err = config.restoreAddrs(contDev); err != nil {
+				return err
+			}
 		}
 
-		// bring device down in case of error
-		defer func() {
-			if err != nil {
-				_ = netlink.LinkSetDown(contDev)
+		// Bring container device up
+		if bringUp {
+			if err = netlink.LinkSetUp(contDev); err != nil {
+				return fmt.Errorf("failed to set %q up: %w", ifName, err)
 			}
-		}()
+
+			// bring device down in case of error
+			defer func() {
+				if err != nil {
+					_ = netlink.LinkSetDown(contDev)
+				}
+			}()
+		}
 
 		// Retrieve link again to get up-to-date name and attributes
 		contDev, err = netlink.LinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", ifName, err)
+			return fmt.Errorf("failed to find %q: %w", ifName, err)
+		}
+
+		if config != nil {
+			if err = config.restoreRoutes(contDev); err != nil {
+				return err
+			}
 		}
 		return nil
 	}); err != nil {
-		return fmt.Errorf("failed to exec to container ns: %v", err)
+		return fmt.Errorf("failed to exec to container ns: %w", err)
 	}
 
 	return nil
@@ -153,13 +252,13 @@ func MoveLinkOut(containerNsPAth string, ifName string) error {
 	err = containerNs.Do(func(_ ns.NetNS) error {
 		dev, err := netlink.LinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", ifName, err)
+			return fmt.Errorf("failed to find %q: %w", ifName, err)
 		}
 		origDev = dev
 
 		// Devices can be renamed only when down
 		if err = netlink.LinkSetDown(dev); err != nil {
-			return fmt.Errorf("failed to set %q down: %v", ifName, err)
+			return fmt.Errorf("failed to set %q down: %w", ifName, err)
 		}
 
 		defer func() {
@@ -175,13 +274,13 @@ func MoveLinkOut(containerNsPAth string, ifName string) error {
 
 		newLink, err := setTempName(dev)
 		if err != nil {
-			return fmt.Errorf("failed to rename device %q to temporary name: %v", ifName, err)
+			return fmt.Errorf("failed to rename device %q to temporary name: %w", ifName, err)
 		}
 		dev = newLink
 		tempName = dev.Attrs().Name
 
 		if err = netlink.LinkSetNsFd(dev, int(defaultNs.Fd())); err != nil {
-			return fmt.Errorf("failed to move %q to host netns: %v", tempName, err)
+			return fmt.Errorf("failed to move %q to host netns: %w", tempName, err)
 		}
 		return nil
 	})
@@ -193,10 +292,24 @@ func MoveLinkOut(containerNsPAth string, ifName string) error {
 	// Rename the device to its original name from the host namespace
 	tempDev, err := netlink.LinkByName(tempName)
 	if err != nil {
-		return fmt.Errorf("failed to find %q in host namespace: %v", tempName, err)
+		return fmt.Errorf("failed to find %q in host namespace: %w", tempName, err)
+	}
+
+	// The original name can be taken on the host while the device was in the
+	// container, per example if the slot was reused, use an alternative name
+	// instead of leaving the device with the temporary name.
+	hostName := tempDev.Attrs().Alias
+	if _, err := netlink.LinkByName(hostName); err == nil {
+		fallback, err := fallbackName(hostName, linkInUse)
+		if err != nil {
+			klog.Warningf("failed to find an alternative name for %q: %v", tempName, err)
+		} else {
+			klog.Warningf("original name %q of %q is in use on the host, renaming it to %q", hostName, tempName, fallback)
+			hostName = fallback
+		}
 	}
 
-	if err = netlink.LinkSetName(tempDev, tempDev.Attrs().Alias); err != nil {
+	if err = netlink.LinkSetName(tempDev, hostName); err != nil {
 		// move device back to container ns so it may be retired
 		defer func() {
 			_ = netlink.LinkSetNsFd(tempDev, int(containerNs.Fd()))
@@ -212,7 +325,7 @@ func MoveLinkOut(containerNsPAth string, ifName string) error {
 				return nil
 			})
 		}()
-		return fmt.Errorf("failed to restore %q to original name %q: %v", tempName, tempDev.Attrs().Alias, err)
+		return fmt.Errorf("failed to restore %q to host name %q: %w", tempName, hostName, err)
 	}
 
 	return nil
@@ -0,0 +1,261 @@
+package hostdevice
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// newTestNS returns a new network namespace that is closed when the test
+// ends, the test is skipped if it can not create network namespaces.
+func newTestNS(t *testing.T) ns.NetNS {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+	var netns ns.NetNS
+	var holder ns.NetNS
+	err := func() error {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		orig, err := ns.GetCurrentNS()
+		if err != nil {
+			return err
+		}
+		defer orig.Close()
+		defer orig.Set()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return err
+		}
+		if holder, err = ns.GetCurrentNS(); err != nil {
+			return err
+		}
+		netns, err = ns.GetNS(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), holder.Fd()))
+		return err
+	}()
+	if err != nil {
+		t.Skipf("failed to create a network namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Close()
+		holder.Close()
+	})
+	return netns
+}
+
+func TestFallbackName(t *testing.T) {
+	tests := []struct {
+		name  string
+		inUse []string
+		want  string
+	}{
+		{
+			name:  "eth1",
+			inUse: []string{"eth1"},
+			want:  "eth1-1",
+		},
+		{
+			name:  "eth1",
+			inUse: []string{"eth1", "eth1-1", "eth1-2"},
+			want:  "eth1-3",
+		},
+		{
+			name:  "enp175s0f1np1",
+			inUse: []string{"enp175s0f1np1"},
+			want:  "enp175s0f1np1-1",
+		},
+		{
+			name:  "enp175s0f1np1xy",
+			inUse: []string{"enp175s0f1np1xy", "enp175s0f1np1-1"},
+			want:  "enp175s0f1np1-2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inUse := func(name string) bool {
+				for _, used := range tt.inUse {
+					if used == name {
+						return true
+					}
+				}
+				return false
+			}
+			got, err := fallbackName(tt.name, inUse)
+			if err != nil {
+				t.Fatalf("fallbackName(%q) unexpected error: %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("fallbackName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+			// the discovery only publishes the interfaces with valid names
+			if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+				t.Errorf("fallbackName(%q) = %q can not be published: %v", tt.name, got, errs)
+			}
+		})
+	}
+}
+
+func TestFallbackNameExhausted(t *testing.T) {
+	if _, err := fallbackName("eth1", func(string) bool { return true }); err == nil {
+		t.Fatal("fallbackName() expected error when all the names are in use")
+	}
+}
+
+func TestMoveLinkInPreserveConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		preserveConfig bool
+		wantAddrs      []string
+		wantRoutes     []string
+	}{
+		{
+			name:           "preserve config",
+			preserveConfig: true,
+			wantAddrs:      []string{"192.168.1.2/24", "192.168.1.3/24", "fd00::2/64"},
+			wantRoutes:     []string{"10.0.0.0/8"},
+		},
+		{
+			name: "flush config",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostNS := newTestNS(t)
+			podNS := newTestNS(t)
+			err := hostNS.Do(func(ns.NetNS) error {
+				veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}, PeerName: "eth1-p"}
+				if err := netlink.LinkAdd(veth); err != nil {
+					return err
+				}
+				for _, name := range []string{"eth1-p", "eth1"} {
+					link, err := netlink.LinkByName(name)
+					if err != nil {
+						return err
+					}
+					if err := netlink.LinkSetUp(link); err != nil {
+						return err
+					}
+				}
+				link, err := netlink.LinkByName("eth1")
+				if err != nil {
+					return err
+				}
+				for _, address := range []string{"192.168.1.2/24", "192.168.1.3/24", "fd00::2/64"} {
+					addr, _ := netlink.ParseAddr(address)
+					// the duplicate address detection does not delay the test
+					addr.Flags = unix.IFA_F_NODAD
+					if err := netlink.AddrAdd(link, addr); err != nil {
+						return err
+					}
+				}
+				_, dst, _ := net.ParseCIDR("10.0.0.0/8")
+				route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP("192.168.1.1")}
+				if err := netlink.RouteAdd(route); err != nil {
+					return err
+				}
+				return MoveLinkIn("eth1", podNS.Path(), "net1", tt.preserveConfig)
+			})
+			if err != nil {
+				t.Fatalf("MoveLinkIn() error = %v", err)
+			}
+
+			var addrs, routes []string
+			err = podNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName("net1")
+				if err != nil {
+					return err
+				}
+				list, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+				if err != nil {
+					return err
+				}
+				for _, addr := range list {
+					if addr.IP.IsGlobalUnicast() {
+						addrs = append(addrs, addr.IPNet.String())
+					}
+				}
+				routeList, err := netlink.RouteList(link, netlink.FAMILY_V4)
+				if err != nil {
+					return err
+				}
+				for _, route := range routeList {
+					if route.Gw != nil {
+						routes = append(routes, route.Dst.String())
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to get the config of the moved link: %v", err)
+			}
+			slices.Sort(addrs)
+			if !reflect.DeepEqual(addrs, tt.wantAddrs) {
+				t.Errorf("addresses = %v, want %v", addrs, tt.wantAddrs)
+			}
+			if !reflect.DeepEqual(routes, tt.wantRoutes) {
+				t.Errorf("routes = %v, want %v", routes, tt.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestIsTempName(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   bool
+	}{
+		{name: "knd_12", prefix: DefaultTempNamePrefix, want: true},
+		{name: "knd_", prefix: DefaultTempNamePrefix},
+		{name: "knd_eth1", prefix: DefaultTempNamePrefix},
+		{name: "temp_12", prefix: DefaultTempNamePrefix},
+		{name: "eth1", prefix: DefaultTempNamePrefix},
+		{name: "dra-7", prefix: "dra-", want: true},
+		{name: "knd_7", prefix: "dra-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.prefix, func(t *testing.T) {
+			SetTempNamePrefix(tt.prefix)
+			t.Cleanup(func() { SetTempNamePrefix(DefaultTempNamePrefix) })
+			if got := IsTempName(tt.name); got != tt.want {
+				t.Errorf("IsTempName(%q) with prefix %q = %v, want %v", tt.name, tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTempName(t *testing.T) {
+	netns := newTestNS(t)
+	SetTempNamePrefix("dra-")
+	t.Cleanup(func() { SetTempNamePrefix(DefaultTempNamePrefix) })
+	err := netns.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("eth1")
+		if err != nil {
+			return err
+		}
+		temp, err := setTempName(link)
+		if err != nil {
+			return err
+		}
+		want := fmt.Sprintf("dra-%d", link.Attrs().Index)
+		if temp.Attrs().Name != want || !IsTempName(temp.Attrs().Name) {
+			return fmt.Errorf("temporary name = %q, want %q", temp.Attrs().Name, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -21,7 +21,7 @@ func MoveRDMALinkIn(hostIfName string, containerNsPAth string) error {
 	}
 
 	if err = netlink.RdmaLinkSetNsFd(hostDev, uint32(containerNs.Fd())); err != nil {
-		return fmt.Errorf("failed to move %q to container ns: %v", hostDev.Attrs.Name, err)
+		return fmt.Errorf("failed to move %q to container ns: %w", hostDev.Attrs.Name, err)
 	}
 
 	return nil
@@ -41,11 +41,11 @@ func MoveRDMALinkOut(containerNsPAth string, ifName string) error {
 	err = containerNs.Do(func(_ ns.NetNS) error {
 		dev, err := netlink.RdmaLinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to find %q: %v", ifName, err)
+			return fmt.Errorf("failed to find %q: %w", ifName, err)
 		}
 
 		if err = netlink.RdmaLinkSetNsFd(dev, uint32(defaultNs.Fd())); err != nil {
-			return fmt.Errorf("failed to move %q to host netns: %v", dev.Attrs.Name, err)
+			return fmt.Errorf("failed to move %q to host netns: %w", dev.Attrs.Name, err)
 		}
 		return nil
 	})